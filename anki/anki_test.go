@@ -0,0 +1,156 @@
+package anki
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/MerryMage/libellus/srs"
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+func TestFieldConversion(t *testing.T) {
+	md, media := fieldToMarkdown(`<div>What is <b>this</b>?</div><div><img src="cat.jpg"></div>[sound:meow.mp3] &amp; more&nbsp;text`)
+	if md != "What is **this**?\n\n![](media:cat.jpg)\nmedia:meow.mp3 & more text" {
+		t.Errorf("md = %q", md)
+	}
+	if len(media) != 2 || media[0] != "cat.jpg" || media[1] != "meow.mp3" {
+		t.Errorf("media = %#v", media)
+	}
+
+	field := markdownToField("a **b** <c>\n![](media:cat.jpg)")
+	if field != `a <b>b</b> &lt;c&gt;<br><img src="cat.jpg">` {
+		t.Errorf("field = %q", field)
+	}
+}
+
+func TestNoteBlob(t *testing.T) {
+	reversed := exportModels[reversedModelId]
+	blob, _, err := noteBlob(note{Guid: "f,G<1", Tags: []string{"geo"}, Fields: []string{"France", "Paris"}}, reversed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := wikidata.ParseCard("x", blob).(wikidata.BasicCard)
+	if !ok || !c.Reversible || c.Front != "France" || c.Back != "Paris" || len(c.Tags) != 1 {
+		t.Errorf("c = %#v", c)
+	}
+	if guid := exportGuid(cardId("f,G<1")); guid != "f,G<1" {
+		t.Errorf("guid = %q", guid)
+	}
+
+	cloze := exportModels[clozeModelId]
+	blob, _, err = noteBlob(note{Guid: "g", Fields: []string{"{{c1::Paris}} is in {{c2::France}}", ""}}, cloze)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc, ok := wikidata.ParseCard("x", blob).(wikidata.ClozeCard); !ok || len(cc.Indices()) != 2 {
+		t.Errorf("cc = %#v", cc)
+	}
+
+	if _, _, err := noteBlob(note{Guid: "h", Fields: []string{"front", ""}}, reversed); err == nil {
+		t.Errorf("note with an empty back was accepted")
+	}
+}
+
+func TestPackageRoundTrip(t *testing.T) {
+	now := time.Date(2020, 3, 10, 15, 0, 0, 0, time.UTC)
+	crt := time.Date(2020, 3, 10, 0, 0, 0, 0, time.UTC)
+
+	c := card{Id: 20, Nid: 10, Did: 30, Type: newCardType}
+	logs := exportCard(&c, srs.State{
+		Due:      now.Add(6 * 24 * time.Hour),
+		Interval: 6 * 24 * time.Hour,
+		Reps:     2,
+		Ease:     2.6,
+		Log: []srs.Review{
+			{Time: now.Add(-24 * time.Hour), Grade: srs.Good, Interval: 24 * time.Hour, Duration: 3 * time.Second},
+			{Time: now, Grade: srs.Easy, Interval: 6 * 24 * time.Hour},
+		},
+	}, crt, make(map[int64]bool))
+
+	col := &collection{
+		Crt:    crt.Unix(),
+		Models: exportModels,
+		Decks:  map[int64]deck{30: {Id: 30, Name: "A::B"}},
+		Notes:  []note{{Id: 10, Guid: "guid", Mid: basicModelId, Tags: []string{"t"}, Fields: []string{"front", "back"}}},
+		Cards:  []card{c},
+		Revlog: logs,
+	}
+
+	var buf bytes.Buffer
+	err := writePackage(&buf, col, map[string][]byte{"cat.jpg": []byte("meow")}, now.Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := readPackage(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := p.Collection
+
+	if len(got.Models) != 3 || len(got.Models[clozeModelId].Fields) != 2 || got.Decks[30].Name != "A::B" {
+		t.Errorf("models = %#v, decks = %#v", got.Models, got.Decks)
+	}
+	if len(got.Notes) != 1 || got.Notes[0].Guid != "guid" || got.Notes[0].Fields[1] != "back" || got.Notes[0].Tags[0] != "t" {
+		t.Errorf("notes = %#v", got.Notes)
+	}
+	if len(got.Cards) != 1 || got.Cards[0] != c || c.Due != 6 || c.Ivl != 6 || c.Factor != 2600 {
+		t.Errorf("cards = %#v, want %#v", got.Cards, c)
+	}
+	if len(got.Revlog) != 2 || got.Revlog[1].LastIvl != 1 || got.Revlog[0].Time != 3000 {
+		t.Errorf("revlog = %#v", got.Revlog)
+	}
+	if raw, ok, err := p.readMedia("cat.jpg"); !ok || err != nil || string(raw) != "meow" {
+		t.Errorf("media = %q, %v, %v", raw, ok, err)
+	}
+
+	state, ok := importState(got, got.Cards[0], got.Revlog)
+	if !ok || !state.Due.Equal(crt.AddDate(0, 0, 6)) || state.Interval != 6*24*time.Hour || state.Ease != 2.6 || len(state.Log) != 2 || !state.LastReview.Equal(now) {
+		t.Errorf("state = %#v", state)
+	}
+	if got.SchedVer != 2 || state.Log[0].Grade != srs.Good || state.Log[1].Grade != srs.Easy {
+		t.Errorf("SchedVer = %d, state.Log = %#v", got.SchedVer, state.Log)
+	}
+}
+
+func TestRevlogGrade(t *testing.T) {
+	v1 := &collection{SchedVer: 1}
+	v2 := &collection{SchedVer: 2}
+	tests := []struct {
+		col  *collection
+		r    revlog
+		want srs.Grade
+	}{
+		{v1, revlog{Type: learnRevlogType, Ease: 1}, srs.Again},
+		{v1, revlog{Type: learnRevlogType, Ease: 2}, srs.Good},
+		{v1, revlog{Type: relearnRevlogType, Ease: 3}, srs.Easy},
+		{v1, revlog{Type: learnRevlogType, Ease: 4}, 0},
+		{v1, revlog{Type: reviewRevlogType, Ease: 3}, srs.Good},
+		{v2, revlog{Type: learnRevlogType, Ease: 2}, srs.Hard},
+		{v2, revlog{Type: learnRevlogType, Ease: 3}, srs.Good},
+	}
+	for _, test := range tests {
+		if got := revlogGrade(test.col, test.r); got != test.want {
+			t.Errorf("revlogGrade(%d, %#v) = %v, want %v", test.col.SchedVer, test.r, got, test.want)
+		}
+	}
+}
+
+func TestUnsupportedPackage(t *testing.T) {
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	for _, name := range []string{"collection.anki2", "collection.anki21b"} {
+		fw, _ := z.Create(name)
+		fw.Write([]byte("stub"))
+	}
+	z.Close()
+
+	if _, err := readPackage(bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != UnsupportedFormatError {
+		t.Errorf("err = %v", err)
+	}
+	if _, err := readPackage(bytes.NewReader([]byte("not a zip")), 9); err == nil {
+		t.Errorf("garbage was read as a package")
+	}
+}
@@ -0,0 +1,453 @@
+package anki
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Anki stores a collection as an SQLite database. This is the schema used by
+// Anki 2.1 for collection.anki2 and collection.anki21 in a package; newer
+// releases also write collection.anki21b, which is compressed and uses a
+// different schema, but keep the older files when asked to support older
+// versions.
+const schema = `
+CREATE TABLE col (
+	id integer primary key, crt integer not null, mod integer not null,
+	scm integer not null, ver integer not null, dty integer not null,
+	usn integer not null, ls integer not null, conf text not null,
+	models text not null, decks text not null, dconf text not null,
+	tags text not null
+);
+CREATE TABLE notes (
+	id integer primary key, guid text not null, mid integer not null,
+	mod integer not null, usn integer not null, tags text not null,
+	flds text not null, sfld integer not null, csum integer not null,
+	flags integer not null, data text not null
+);
+CREATE TABLE cards (
+	id integer primary key, nid integer not null, did integer not null,
+	ord integer not null, mod integer not null, usn integer not null,
+	type integer not null, queue integer not null, due integer not null,
+	ivl integer not null, factor integer not null, reps integer not null,
+	lapses integer not null, left integer not null, odue integer not null,
+	odid integer not null, flags integer not null, data text not null
+);
+CREATE TABLE revlog (
+	id integer primary key, cid integer not null, usn integer not null,
+	ease integer not null, ivl integer not null, lastIvl integer not null,
+	factor integer not null, time integer not null, type integer not null
+);
+CREATE TABLE graves (
+	usn integer not null, oid integer not null, type integer not null
+);
+CREATE INDEX ix_notes_usn on notes (usn);
+CREATE INDEX ix_cards_usn on cards (usn);
+CREATE INDEX ix_revlog_usn on revlog (usn);
+CREATE INDEX ix_cards_nid on cards (nid);
+CREATE INDEX ix_cards_sched on cards (did, queue, due);
+CREATE INDEX ix_revlog_cid on revlog (cid);
+CREATE INDEX ix_notes_csum on notes (csum);
+`
+
+const (
+	standardModelType = 0
+	clozeModelType    = 1
+
+	// Values of cards.type.
+	newCardType      = 0
+	learningCardType = 1
+	reviewCardType   = 2
+
+	// Values of cards.queue. Cards in the learning queue are due at a Unix
+	// time rather than on a day.
+	newQueue      = 0
+	learningQueue = 1
+	reviewQueue   = 2
+
+	// Values of revlog.type.
+	learnRevlogType   = 0
+	reviewRevlogType  = 1
+	relearnRevlogType = 2
+
+	defaultDeckId     = 1
+	defaultDeckConfId = 1
+
+	// fieldSeparator separates the fields of a note in notes.flds.
+	fieldSeparator = "\x1f"
+)
+
+type model struct {
+	Id        int64
+	Name      string
+	Type      int
+	Fields    []string
+	Templates []template
+}
+
+type template struct {
+	Name string
+	Qfmt string
+	Afmt string
+}
+
+type deck struct {
+	Id   int64
+	Name string
+}
+
+type note struct {
+	Id     int64
+	Guid   string
+	Mid    int64
+	Mod    int64
+	Tags   []string
+	Fields []string
+}
+
+type card struct {
+	Id     int64
+	Nid    int64
+	Did    int64
+	Ord    int
+	Type   int
+	Queue  int
+	Due    int64
+	Ivl    int64
+	Factor int
+	Reps   int
+	Lapses int
+}
+
+type revlog struct {
+	Id      int64
+	Cid     int64
+	Ease    int
+	Ivl     int64
+	LastIvl int64
+	Factor  int
+	Time    int64
+	Type    int
+}
+
+// collection is the part of an Anki collection which libellus understands.
+// Crt is the Unix time of the start of the day the collection was created;
+// the due dates of review cards count days from it. SchedVer is the version
+// of the scheduler which logged the reviews.
+type collection struct {
+	Crt      int64
+	SchedVer int
+	Models   map[int64]model
+	Decks    map[int64]deck
+	Notes    []note
+	Cards    []card
+	Revlog   []revlog
+}
+
+// jsonConf is the part of col.conf which libellus understands.
+type jsonConf struct {
+	SchedVer int `json:"schedVer"`
+}
+
+// jsonModel is a model as stored in col.models.
+type jsonModel struct {
+	Id        json.Number    `json:"id"`
+	Name      string         `json:"name"`
+	Type      int            `json:"type"`
+	Mod       int64          `json:"mod"`
+	Usn       int            `json:"usn"`
+	Sortf     int            `json:"sortf"`
+	Did       int64          `json:"did"`
+	Tmpls     []jsonTemplate `json:"tmpls"`
+	Flds      []jsonField    `json:"flds"`
+	Css       string         `json:"css"`
+	LatexPre  string         `json:"latexPre"`
+	LatexPost string         `json:"latexPost"`
+	Tags      []string       `json:"tags"`
+	Vers      []int          `json:"vers"`
+	Req       []interface{}  `json:"req"`
+}
+
+type jsonTemplate struct {
+	Name  string      `json:"name"`
+	Ord   int         `json:"ord"`
+	Qfmt  string      `json:"qfmt"`
+	Afmt  string      `json:"afmt"`
+	Did   interface{} `json:"did"`
+	Bqfmt string      `json:"bqfmt"`
+	Bafmt string      `json:"bafmt"`
+}
+
+type jsonField struct {
+	Name   string        `json:"name"`
+	Ord    int           `json:"ord"`
+	Sticky bool          `json:"sticky"`
+	Rtl    bool          `json:"rtl"`
+	Font   string        `json:"font"`
+	Size   int           `json:"size"`
+	Media  []interface{} `json:"media"`
+}
+
+// jsonDeck is a deck as stored in col.decks.
+type jsonDeck struct {
+	Id        json.Number `json:"id"`
+	Name      string      `json:"name"`
+	Desc      string      `json:"desc"`
+	Mod       int64       `json:"mod"`
+	Usn       int         `json:"usn"`
+	Collapsed bool        `json:"collapsed"`
+	Dyn       int         `json:"dyn"`
+	Conf      int64       `json:"conf"`
+	NewToday  [2]int      `json:"newToday"`
+	RevToday  [2]int      `json:"revToday"`
+	LrnToday  [2]int      `json:"lrnToday"`
+	TimeToday [2]int      `json:"timeToday"`
+	ExtendNew int         `json:"extendNew"`
+	ExtendRev int         `json:"extendRev"`
+}
+
+func readCollection(path string) (*collection, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	col := &collection{
+		Models: make(map[int64]model),
+		Decks:  make(map[int64]deck),
+	}
+
+	var confRaw, modelsRaw, decksRaw string
+	err = db.QueryRow("SELECT crt, conf, models, decks FROM col").Scan(&col.Crt, &confRaw, &modelsRaw, &decksRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collections from before the v2 scheduler have no schedVer.
+	conf := jsonConf{SchedVer: 1}
+	err = json.Unmarshal([]byte(confRaw), &conf)
+	if err != nil {
+		return nil, err
+	}
+	col.SchedVer = conf.SchedVer
+
+	var models map[string]jsonModel
+	err = json.Unmarshal([]byte(modelsRaw), &models)
+	if err != nil {
+		return nil, err
+	}
+	for _, jm := range models {
+		id, err := jm.Id.Int64()
+		if err != nil {
+			return nil, err
+		}
+		m := model{Id: id, Name: jm.Name, Type: jm.Type}
+		sort.Slice(jm.Flds, func(i, j int) bool { return jm.Flds[i].Ord < jm.Flds[j].Ord })
+		for _, f := range jm.Flds {
+			m.Fields = append(m.Fields, f.Name)
+		}
+		sort.Slice(jm.Tmpls, func(i, j int) bool { return jm.Tmpls[i].Ord < jm.Tmpls[j].Ord })
+		for _, t := range jm.Tmpls {
+			m.Templates = append(m.Templates, template{Name: t.Name, Qfmt: t.Qfmt, Afmt: t.Afmt})
+		}
+		col.Models[id] = m
+	}
+
+	var decks map[string]jsonDeck
+	err = json.Unmarshal([]byte(decksRaw), &decks)
+	if err != nil {
+		return nil, err
+	}
+	for _, jd := range decks {
+		id, err := jd.Id.Int64()
+		if err != nil {
+			return nil, err
+		}
+		col.Decks[id] = deck{Id: id, Name: jd.Name}
+	}
+
+	rows, err := db.Query("SELECT id, guid, mid, mod, tags, flds FROM notes ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var n note
+		var tags, flds string
+		err = rows.Scan(&n.Id, &n.Guid, &n.Mid, &n.Mod, &tags, &flds)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		n.Tags = strings.Fields(tags)
+		n.Fields = strings.Split(flds, fieldSeparator)
+		col.Notes = append(col.Notes, n)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query("SELECT id, nid, did, ord, type, queue, due, ivl, factor, reps, lapses FROM cards ORDER BY nid, ord")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var c card
+		err = rows.Scan(&c.Id, &c.Nid, &c.Did, &c.Ord, &c.Type, &c.Queue, &c.Due, &c.Ivl, &c.Factor, &c.Reps, &c.Lapses)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		col.Cards = append(col.Cards, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query("SELECT id, cid, ease, ivl, lastIvl, factor, time, type FROM revlog ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var r revlog
+		err = rows.Scan(&r.Id, &r.Cid, &r.Ease, &r.Ivl, &r.LastIvl, &r.Factor, &r.Time, &r.Type)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		col.Revlog = append(col.Revlog, r)
+	}
+	rows.Close()
+	return col, rows.Err()
+}
+
+// fieldChecksum is the notes.csum of a note whose sort field is sfld.
+func fieldChecksum(sfld string) int64 {
+	sum := sha1.Sum([]byte(sfld))
+	return int64(binary.BigEndian.Uint32(sum[:4]))
+}
+
+func writeCollection(path string, col *collection, mod int64) error {
+	db, err := sql.Open("sqlite3", "file:"+path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(schema)
+	if err != nil {
+		return err
+	}
+
+	models := make(map[string]jsonModel)
+	for id, m := range col.Models {
+		jm := jsonModel{
+			Id:        json.Number(strconv.FormatInt(id, 10)),
+			Name:      m.Name,
+			Type:      m.Type,
+			Mod:       mod,
+			Usn:       -1,
+			Did:       defaultDeckId,
+			Css:       ".card { font-family: arial; font-size: 20px; text-align: center; }\n.cloze { font-weight: bold; color: blue; }\n",
+			LatexPre:  "\\documentclass[12pt]{article}\n\\special{papersize=3in,5in}\n\\usepackage[utf8]{inputenc}\n\\usepackage{amssymb,amsmath}\n\\pagestyle{empty}\n\\setlength{\\parindent}{0in}\n\\begin{document}\n",
+			LatexPost: "\\end{document}",
+			Tags:      []string{},
+			Vers:      []int{},
+			Req:       []interface{}{},
+		}
+		for i, f := range m.Fields {
+			jm.Flds = append(jm.Flds, jsonField{Name: f, Ord: i, Font: "Arial", Size: 20, Media: []interface{}{}})
+		}
+		for i, t := range m.Templates {
+			jm.Tmpls = append(jm.Tmpls, jsonTemplate{Name: t.Name, Ord: i, Qfmt: t.Qfmt, Afmt: t.Afmt})
+			if m.Type == standardModelType {
+				// The field each template requires to produce a card.
+				jm.Req = append(jm.Req, []interface{}{i, "any", []int{i}})
+			}
+		}
+		models[strconv.FormatInt(id, 10)] = jm
+	}
+
+	decks := make(map[string]jsonDeck)
+	for id, d := range col.Decks {
+		decks[strconv.FormatInt(id, 10)] = jsonDeck{
+			Id:        json.Number(strconv.FormatInt(id, 10)),
+			Name:      d.Name,
+			Mod:       mod,
+			Usn:       -1,
+			Conf:      defaultDeckConfId,
+			ExtendNew: 10,
+			ExtendRev: 50,
+		}
+	}
+
+	modelsRaw, err := json.Marshal(models)
+	if err != nil {
+		return err
+	}
+	decksRaw, err := json.Marshal(decks)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO col VALUES (1, ?, ?, ?, 11, 0, 0, 0, ?, ?, ?, ?, '{}')",
+		col.Crt, mod*1000, mod*1000, defaultConf, string(modelsRaw), string(decksRaw), defaultDeckConf)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range col.Notes {
+		sfld := ""
+		if len(n.Fields) > 0 {
+			sfld = stripHTML(n.Fields[0])
+		}
+		tags := ""
+		if len(n.Tags) > 0 {
+			tags = " " + strings.Join(n.Tags, " ") + " "
+		}
+		_, err = tx.Exec("INSERT INTO notes VALUES (?, ?, ?, ?, -1, ?, ?, ?, ?, 0, '')",
+			n.Id, n.Guid, n.Mid, n.Mod, tags, strings.Join(n.Fields, fieldSeparator), sfld, fieldChecksum(sfld))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, c := range col.Cards {
+		_, err = tx.Exec("INSERT INTO cards VALUES (?, ?, ?, ?, ?, -1, ?, ?, ?, ?, ?, ?, ?, 0, 0, 0, 0, '')",
+			c.Id, c.Nid, c.Did, c.Ord, mod, c.Type, c.Queue, c.Due, c.Ivl, c.Factor, c.Reps, c.Lapses)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, r := range col.Revlog {
+		_, err = tx.Exec("INSERT INTO revlog VALUES (?, ?, -1, ?, ?, ?, ?, ?, ?)",
+			r.Id, r.Cid, r.Ease, r.Ivl, r.LastIvl, r.Factor, r.Time, r.Type)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+const defaultConf = `{"activeDecks":[1],"curDeck":1,"newSpread":0,"collapseTime":1200,"timeLim":0,"estTimes":true,"dueCounts":true,"curModel":null,"nextPos":1,"sortType":"noteFld","sortBackwards":false,"addToCur":true,"schedVer":2}`
+
+const defaultDeckConf = `{"1":{"id":1,"name":"Default","mod":0,"usn":0,"maxTaken":60,"autoplay":true,"timer":0,"replayq":true,"dyn":false,` +
+	`"new":{"bury":true,"delays":[1,10],"initialFactor":2500,"ints":[1,4,7],"order":1,"perDay":20,"separate":true},` +
+	`"lapse":{"delays":[10],"leechAction":0,"leechFails":8,"minInt":1,"mult":0},` +
+	`"rev":{"bury":true,"ease4":1.3,"fuzz":0.05,"ivlFct":1,"maxIvl":36500,"minSpace":1,"perDay":100}}}`
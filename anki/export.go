@@ -0,0 +1,242 @@
+package anki
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"hash/fnv"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MerryMage/libellus/srs"
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+// Exported notes use these note types, which are fixed so that exporting
+// again updates the notes of an earlier export rather than adding new ones.
+const (
+	basicModelId    int64 = 1600000000001
+	reversedModelId int64 = 1600000000002
+	clozeModelId    int64 = 1600000000003
+)
+
+const answerSeparator = "\n\n<hr id=answer>\n\n"
+
+var exportModels = map[int64]model{
+	basicModelId: {
+		Id:     basicModelId,
+		Name:   "libellus Basic",
+		Type:   standardModelType,
+		Fields: []string{"Front", "Back"},
+		Templates: []template{
+			{Name: "Card 1", Qfmt: "{{Front}}", Afmt: "{{FrontSide}}" + answerSeparator + "{{Back}}"},
+		},
+	},
+	reversedModelId: {
+		Id:     reversedModelId,
+		Name:   "libellus Basic (and reversed card)",
+		Type:   standardModelType,
+		Fields: []string{"Front", "Back"},
+		Templates: []template{
+			{Name: "Card 1", Qfmt: "{{Front}}", Afmt: "{{FrontSide}}" + answerSeparator + "{{Back}}"},
+			{Name: "Card 2", Qfmt: "{{Back}}", Afmt: "{{FrontSide}}" + answerSeparator + "{{Front}}"},
+		},
+	},
+	clozeModelId: {
+		Id:     clozeModelId,
+		Name:   "libellus Cloze",
+		Type:   clozeModelType,
+		Fields: []string{"Text", "Back Extra"},
+		Templates: []template{
+			{Name: "Cloze", Qfmt: "{{cloze:Text}}", Afmt: "{{cloze:Text}}<br>\n{{Back Extra}}"},
+		},
+	},
+}
+
+// exportId returns a stable Anki id for s. Anki ids are normally creation
+// times in milliseconds, but any distinct positive integers will do.
+func exportId(s string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return int64(h.Sum64()>>12) + 1
+}
+
+// exportGuid returns the guid of the note made from the card cid. Cards
+// which came from Anki get back the guid of their note.
+func exportGuid(cid wikidata.CardId) string {
+	if strings.HasPrefix(string(cid), "anki-") {
+		if guid, err := hex.DecodeString(string(cid)[len("anki-"):]); err == nil {
+			return string(guid)
+		}
+	}
+	sum := sha1.Sum([]byte(cid))
+	return base64.RawStdEncoding.EncodeToString(sum[:8])
+}
+
+// deckName returns the name of the deck for the page at path, nesting decks
+// as the pages are nested.
+func deckName(path string) string {
+	name := "libellus"
+	for _, part := range strings.Split(strings.Trim(path, "/"), "/") {
+		if part != "" {
+			name += "::" + part
+		}
+	}
+	return name
+}
+
+func exportInterval(d time.Duration) int64 {
+	if d < 24*time.Hour {
+		return -int64(d / time.Second)
+	}
+	return int64(math.Round(float64(d) / float64(24*time.Hour)))
+}
+
+func exportFactor(ease float64) int {
+	if ease == 0 {
+		return 2500
+	}
+	return int(math.Round(ease * 1000))
+}
+
+// exportCard fills in the scheduling of c from state, the state of its
+// review item, and returns its review log. crt is the start of the day the
+// exported collection counts due days from. revlogIds holds the ids already
+// used by the review log, which must be distinct.
+func exportCard(c *card, state srs.State, crt time.Time, revlogIds map[int64]bool) []revlog {
+	c.Reps = state.Reps
+	c.Lapses = state.Lapses
+	c.Factor = exportFactor(state.Ease)
+
+	if state.Interval < 24*time.Hour {
+		c.Type, c.Queue = learningCardType, learningQueue
+		c.Due = state.Due.Unix()
+	} else {
+		c.Type, c.Queue = reviewCardType, reviewQueue
+		y, m, d := state.Due.In(crt.Location()).Date()
+		due := time.Date(y, m, d, 0, 0, 0, 0, crt.Location())
+		c.Due = int64(math.Round(due.Sub(crt).Hours() / 24))
+		c.Ivl = exportInterval(state.Interval)
+	}
+
+	var logs []revlog
+	var lastIvl int64
+	for _, r := range state.Log {
+		id := r.Time.UnixNano() / int64(time.Millisecond)
+		for revlogIds[id] {
+			id++
+		}
+		revlogIds[id] = true
+
+		ivl := exportInterval(r.Interval)
+		kind := learnRevlogType
+		if lastIvl > 0 {
+			kind = reviewRevlogType
+		}
+		logs = append(logs, revlog{
+			Id:      id,
+			Cid:     c.Id,
+			Ease:    int(r.Grade),
+			Ivl:     ivl,
+			LastIvl: lastIvl,
+			Factor:  c.Factor,
+			Time:    int64(r.Duration / time.Millisecond),
+			Type:    kind,
+		})
+		lastIvl = ivl
+	}
+	return logs
+}
+
+// Export writes the cards of the page at path and its subpages to w as an
+// Anki package, along with their media and the review history in store.
+// Each page becomes a deck. Cards which cannot be parsed are left out.
+func Export(w io.Writer, snap *wikidata.Snapshot, store *srs.Store, path string, now time.Time) error {
+	y, m, d := now.Date()
+	crt := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+
+	col := &collection{
+		Crt:    crt.Unix(),
+		Models: exportModels,
+		Decks: map[int64]deck{
+			defaultDeckId: {Id: defaultDeckId, Name: "Default"},
+		},
+	}
+	media := make(map[string][]byte)
+	revlogIds := make(map[int64]bool)
+	position := int64(0)
+
+	for _, meta := range snap.Cards(path) {
+		_, c := snap.LookupCard(meta.Identifier)
+
+		n := note{
+			Id:   exportId("note:" + string(meta.Identifier)),
+			Guid: exportGuid(meta.Identifier),
+			Mod:  now.Unix(),
+			Tags: c.GetInfo().Tags,
+		}
+		var items []wikidata.CardId
+		var ords []int
+
+		switch c := c.(type) {
+		case wikidata.BasicCard:
+			n.Mid = basicModelId
+			n.Fields = []string{markdownToField(c.Front), markdownToField(c.Back)}
+			items, ords = []wikidata.CardId{meta.Identifier}, []int{0}
+			if c.Reversible {
+				n.Mid = reversedModelId
+				items, ords = append(items, meta.Identifier+"/reverse"), append(ords, 1)
+			}
+
+		case wikidata.ClozeCard:
+			n.Mid = clozeModelId
+			n.Fields = []string{markdownToField(c.Text), ""}
+			for _, index := range c.Indices() {
+				items = append(items, meta.Identifier+wikidata.CardId("/c"+strconv.Itoa(index)))
+				ords = append(ords, index-1)
+			}
+
+		default:
+			continue
+		}
+
+		did := exportId("deck:" + meta.ParentParentPath)
+		if _, ok := col.Decks[did]; !ok {
+			col.Decks[did] = deck{Id: did, Name: deckName(meta.ParentParentPath)}
+		}
+
+		for _, name := range c.GetInfo().Media {
+			if _, ok := media[name]; ok {
+				continue
+			}
+			if raw, err := snap.ReadKnowledgeMedia(meta.ParentIdentifier, name); err == nil {
+				media[name] = raw
+			}
+		}
+
+		col.Notes = append(col.Notes, n)
+		for i, item := range items {
+			position++
+			ac := card{
+				Id:    exportId("card:" + string(item)),
+				Nid:   n.Id,
+				Did:   did,
+				Ord:   ords[i],
+				Type:  newCardType,
+				Queue: newQueue,
+				Due:   position,
+			}
+			if store != nil {
+				if state, ok := store.State(item); ok {
+					col.Revlog = append(col.Revlog, exportCard(&ac, state, crt, revlogIds)...)
+				}
+			}
+			col.Cards = append(col.Cards, ac)
+		}
+	}
+
+	return writePackage(w, col, media, now.Unix())
+}
@@ -0,0 +1,68 @@
+package anki
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Anki fields are HTML while card blobs are markdown. The conversions here
+// only cover what Anki's editor produces for plain notes: line breaks,
+// emphasis, images and sounds. Other markup is dropped on import.
+var (
+	breakRegexp    = regexp.MustCompile(`(?i)<br\s*/?>|</?(div|p)(\s[^>]*)?>`)
+	boldRegexp     = regexp.MustCompile(`(?i)</?(b|strong)(\s[^>]*)?>`)
+	italicRegexp   = regexp.MustCompile(`(?i)</?(i|em)(\s[^>]*)?>`)
+	imageRegexp    = regexp.MustCompile(`(?i)<img\s[^>]*?src\s*=\s*["']?([^"'\s>]+)["']?[^>]*>`)
+	soundRegexp    = regexp.MustCompile(`\[sound:([^\]]+)\]`)
+	tagRegexp      = regexp.MustCompile(`<[^>]*>`)
+	blankRegexp    = regexp.MustCompile(`\n{3,}`)
+	markdownImage  = regexp.MustCompile(`!\[[^\]]*\]\(media:([^)\s]+)\)`)
+	markdownMedia  = regexp.MustCompile(`media:([^\s()<>"'\[\]]+)`)
+	markdownBold   = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	markdownItalic = regexp.MustCompile(`\*(.+?)\*`)
+)
+
+// fieldToMarkdown converts the HTML of a field to markdown. Media referenced
+// by the field are returned by name.
+func fieldToMarkdown(field string) (string, []string) {
+	var media []string
+
+	s := strings.Replace(field, "\r\n", "\n", -1)
+	s = imageRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		name := html.UnescapeString(imageRegexp.FindStringSubmatch(m)[1])
+		media = append(media, name)
+		return "![](media:" + name + ")"
+	})
+	s = soundRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		name := soundRegexp.FindStringSubmatch(m)[1]
+		media = append(media, name)
+		return "media:" + name
+	})
+	s = breakRegexp.ReplaceAllString(s, "\n")
+	s = boldRegexp.ReplaceAllString(s, "**")
+	s = italicRegexp.ReplaceAllString(s, "*")
+	s = tagRegexp.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = strings.Replace(s, "\u00a0", " ", -1)
+	s = blankRegexp.ReplaceAllString(s, "\n\n")
+
+	return strings.TrimSpace(s), media
+}
+
+// markdownToField converts markdown written by fieldToMarkdown, or by hand
+// in the same style, back to HTML for a field.
+func markdownToField(md string) string {
+	s := html.EscapeString(md)
+	s = markdownImage.ReplaceAllString(s, `<img src="$1">`)
+	s = markdownMedia.ReplaceAllString(s, `[sound:$1]`)
+	s = markdownBold.ReplaceAllString(s, "<b>$1</b>")
+	s = markdownItalic.ReplaceAllString(s, "<i>$1</i>")
+	return strings.Replace(s, "\n", "<br>", -1)
+}
+
+// stripHTML returns the text of a field, as Anki uses for sorting and
+// duplicate checks.
+func stripHTML(field string) string {
+	return strings.TrimSpace(html.UnescapeString(tagRegexp.ReplaceAllString(field, "")))
+}
@@ -0,0 +1,411 @@
+package anki
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MerryMage/libellus/objstore"
+	"github.com/MerryMage/libellus/objstore/commit"
+	"github.com/MerryMage/libellus/srs"
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+var EmptyPackageError error = errors.New("anki: package has no notes")
+
+// ImportResult summarizes what Import did. Skipped lists the notes and media
+// which could not be imported, with the reason.
+type ImportResult struct {
+	Decks    int
+	Notes    int
+	Media    int
+	Reviewed int
+	Skipped  []string
+}
+
+// cardId is the id of the card blob made from a note. It is derived from the
+// note's guid, which Anki uses to recognize a note when it is imported again,
+// so that Export can give the note back the same guid.
+func cardId(guid string) wikidata.CardId {
+	return wikidata.CardId("anki-" + hex.EncodeToString([]byte(guid)))
+}
+
+// knowledgeId is the id of the knowledge holding the notes of a deck.
+func knowledgeId(did int64) wikidata.KnowledgeId {
+	return wikidata.KnowledgeId("anki-" + strconv.FormatInt(did, 10))
+}
+
+// itemSuffix returns what is appended to the id of a card blob to get the id
+// of the review item for the card with template ord of a note of model m.
+// ok is false if no review item corresponds to the card.
+func itemSuffix(m model, ord int) (string, bool) {
+	if m.Type == clozeModelType {
+		return "/c" + strconv.Itoa(ord+1), true
+	}
+	switch ord {
+	case 0:
+		return "", true
+	case 1:
+		return "/reverse", true
+	}
+	return "", false
+}
+
+// slug turns a deck name component into a page name.
+func slug(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			dash = false
+			b.WriteRune(r)
+			continue
+		}
+		dash = true
+	}
+	if b.Len() == 0 {
+		return "deck"
+	}
+	return b.String()
+}
+
+// noteBlob returns the contents of the card blob for n and the media it
+// references.
+func noteBlob(n note, m model) ([]byte, []string, error) {
+	var b strings.Builder
+	var media []string
+
+	field := func(i int) string {
+		if i >= len(n.Fields) {
+			return ""
+		}
+		md, fieldMedia := fieldToMarkdown(n.Fields[i])
+		media = append(media, fieldMedia...)
+		return md
+	}
+
+	b.WriteString("ID: " + string(cardId(n.Guid)) + "\n")
+
+	switch {
+	case m.Type == clozeModelType:
+		b.WriteString("Type: " + wikidata.ClozeCardType + "\n")
+	case len(m.Templates) >= 2:
+		b.WriteString("Type: " + wikidata.ReversibleCardType + "\n")
+	default:
+		b.WriteString("Type: " + wikidata.BasicCardType + "\n")
+	}
+	if len(n.Tags) > 0 {
+		b.WriteString("Tags: " + strings.Join(n.Tags, " ") + "\n")
+	}
+	b.WriteString("\n")
+
+	if m.Type == clozeModelType {
+		// The cloze text comes first; the remaining fields, such as
+		// "Back Extra", are kept below it.
+		for i := range n.Fields {
+			if text := field(i); text != "" {
+				b.WriteString(text + "\n\n")
+			}
+		}
+		return []byte(strings.TrimSpace(b.String()) + "\n"), media, nil
+	}
+
+	front := field(0)
+	var back []string
+	for i := 1; i < len(n.Fields); i++ {
+		if text := field(i); text != "" {
+			back = append(back, text)
+		}
+	}
+	if front == "" || len(back) == 0 {
+		return nil, nil, errors.New("note has an empty side")
+	}
+	b.WriteString(front + "\n---\n" + strings.Join(back, "\n\n") + "\n")
+
+	return []byte(b.String()), media, nil
+}
+
+func ankiInterval(ivl int64) time.Duration {
+	if ivl < 0 {
+		return time.Duration(-ivl) * time.Second
+	}
+	return time.Duration(ivl) * 24 * time.Hour
+}
+
+// revlogGrade returns the grade of the review r. The v1 scheduler only has
+// three buttons for cards in learning, so there 2 is Good and 3 is Easy.
+func revlogGrade(col *collection, r revlog) srs.Grade {
+	if col.SchedVer < 2 && (r.Type == learnRevlogType || r.Type == relearnRevlogType) {
+		switch r.Ease {
+		case 1:
+			return srs.Again
+		case 2:
+			return srs.Good
+		case 3:
+			return srs.Easy
+		}
+		return 0
+	}
+	return srs.Grade(r.Ease)
+}
+
+// importState returns the scheduling state of c with its review log. ok is
+// false for cards which have never been studied.
+func importState(col *collection, c card, logs []revlog) (srs.State, bool) {
+	if c.Type == newCardType {
+		return srs.State{}, false
+	}
+
+	// Cards still in learning have no factor yet. Their Ease is then 0,
+	// which scheduleSM2 in srs/sm2.go replaces with its initial ease.
+	state := srs.State{
+		Interval: ankiInterval(c.Ivl),
+		Reps:     c.Reps,
+		Lapses:   c.Lapses,
+		Ease:     float64(c.Factor) / 1000,
+	}
+
+	// Learning cards in the learning queue are due at a time; other cards
+	// are due on a day counted from the creation of the collection.
+	if c.Queue == learningQueue || (c.Queue < 0 && c.Type == learningCardType) {
+		state.Due = time.Unix(c.Due, 0)
+	} else {
+		state.Due = time.Unix(col.Crt, 0).AddDate(0, 0, int(c.Due))
+	}
+
+	for _, r := range logs {
+		grade := revlogGrade(col, r)
+		if !grade.Valid() {
+			continue
+		}
+		state.Log = append(state.Log, srs.Review{
+			Time:      time.Unix(0, r.Id*int64(time.Millisecond)),
+			Grade:     grade,
+			Algorithm: srs.SM2,
+			Interval:  ankiInterval(r.Ivl),
+			Duration:  time.Duration(r.Time) * time.Millisecond,
+		})
+	}
+
+	if len(state.Log) > 0 {
+		state.LastReview = state.Log[len(state.Log)-1].Time
+	} else {
+		state.LastReview = state.Due.Add(-state.Interval)
+	}
+
+	return state, true
+}
+
+type pageUpdate struct {
+	info    wikidata.PageInfo
+	changed bool
+}
+
+// Import adds the notes of the package read from r to the wiki in a single
+// commit, one knowledge per deck, and their review history to store. Decks
+// become pages under root, following the deck hierarchy. A deck which was
+// imported before is updated in place, wherever its knowledge now lives, and
+// review history is only imported for items which have none yet.
+func Import(r io.ReaderAt, size int64, repo *objstore.Repository, wd *wikidata.WikiData, store *srs.Store, root string, sig commit.Signature) (ImportResult, error) {
+	var result ImportResult
+
+	p, err := readPackage(r, size)
+	if err != nil {
+		return result, err
+	}
+	col := p.Collection
+
+	cardsByNote := make(map[int64][]card)
+	for _, c := range col.Cards {
+		cardsByNote[c.Nid] = append(cardsByNote[c.Nid], c)
+	}
+	logsByCard := make(map[int64][]revlog)
+	for _, r := range col.Revlog {
+		logsByCard[r.Cid] = append(logsByCard[r.Cid], r)
+	}
+
+	// A note whose cards are spread over several decks goes to the deck of
+	// its first card.
+	notesByDeck := make(map[int64][]note)
+	for _, n := range col.Notes {
+		if cards := cardsByNote[n.Id]; len(cards) > 0 {
+			notesByDeck[cards[0].Did] = append(notesByDeck[cards[0].Did], n)
+		}
+	}
+	if len(notesByDeck) == 0 {
+		return result, EmptyPackageError
+	}
+
+	var decks []deck
+	for did := range notesByDeck {
+		d, ok := col.Decks[did]
+		if !ok {
+			d = deck{Id: did, Name: "Deck " + strconv.FormatInt(did, 10)}
+		}
+		decks = append(decks, d)
+	}
+	sort.Slice(decks, func(i, j int) bool {
+		return decks[i].Name < decks[j].Name
+	})
+
+	snap := wd.Snapshot()
+	trans, err := repo.StartTransaction(wd.Ref())
+	if err != nil {
+		return result, err
+	}
+
+	pages := make(map[string]*pageUpdate)
+	page := func(path string, title string) *pageUpdate {
+		if pu, ok := pages[path]; ok {
+			return pu
+		}
+		pu := &pageUpdate{}
+		if existing, ok := snap.LookupPage(path); ok && !existing.NoInfo {
+			pu.info = existing.PageInfo
+		} else {
+			pu.info.Title = title
+			pu.changed = true
+		}
+		pages[path] = pu
+		return pu
+	}
+
+	states := make(map[wikidata.CardId]srs.State)
+
+	for _, d := range decks {
+		kid := knowledgeId(d.Id)
+
+		var pagePath string
+		if km, ok := snap.LookupKnowledgeMeta(kid); ok {
+			pagePath = km.ParentPath
+			// Drop the cards of notes which are no longer in the deck, but
+			// keep any cards which were added in the wiki.
+			for _, cid := range km.Cards {
+				cm, ok := snap.LookupCardMeta(cid)
+				if !ok || !strings.HasPrefix(cm.Name, "anki-") {
+					continue
+				}
+				err = trans.Delete(wikidata.PageTreePath(pagePath) + "/" + string(kid) + "/_cards/" + cm.Name)
+				if err != nil {
+					return result, err
+				}
+			}
+		} else {
+			pagePath = strings.TrimSuffix(root, "/")
+			names := strings.Split(d.Name, "::")
+			for _, name := range names {
+				pagePath += "/" + slug(name)
+				page(pagePath, name)
+			}
+
+			pu := page(pagePath, names[len(names)-1])
+			pu.info.Knowledges = append(pu.info.Knowledges, kid)
+			pu.changed = true
+
+			kpath := wikidata.PageTreePath(pagePath) + "/" + string(kid)
+			err = trans.AddOrReplace(kpath+"/_info", []byte(`{"Type":"`+wikidata.MarkdownKnowledgeType+`"}`+"\n"))
+			if err == nil {
+				err = trans.AddOrReplace(kpath+"/_data.md", []byte("Cards imported from the Anki deck *"+d.Name+"*.\n"))
+			}
+			if err != nil {
+				return result, err
+			}
+		}
+
+		kpath := wikidata.PageTreePath(pagePath) + "/" + string(kid)
+		added := make(map[string]bool)
+		result.Decks++
+
+		for _, n := range notesByDeck[d.Id] {
+			m, ok := col.Models[n.Mid]
+			if !ok {
+				result.Skipped = append(result.Skipped, "note "+strconv.FormatInt(n.Id, 10)+": unknown note type")
+				continue
+			}
+
+			blob, media, err := noteBlob(n, m)
+			if err != nil {
+				result.Skipped = append(result.Skipped, "note "+strconv.FormatInt(n.Id, 10)+": "+err.Error())
+				continue
+			}
+
+			cid := cardId(n.Guid)
+			err = trans.AddOrReplace(kpath+"/_cards/"+string(cid), blob)
+			if err != nil {
+				return result, err
+			}
+			result.Notes++
+
+			for _, name := range media {
+				if added[name] {
+					continue
+				}
+				added[name] = true
+				if !wikidata.ValidMediaName(name) {
+					result.Skipped = append(result.Skipped, "media "+strconv.Quote(name)+": invalid name")
+					continue
+				}
+				raw, ok, err := p.readMedia(name)
+				if !ok {
+					result.Skipped = append(result.Skipped, "media "+strconv.Quote(name)+": not in package")
+					continue
+				} else if err != nil {
+					return result, err
+				}
+				err = trans.AddOrReplace(kpath+"/_media/"+name, raw)
+				if err != nil {
+					return result, err
+				}
+				result.Media++
+			}
+
+			for _, c := range cardsByNote[n.Id] {
+				suffix, ok := itemSuffix(m, c.Ord)
+				if !ok {
+					continue
+				}
+				if state, ok := importState(col, c, logsByCard[c.Id]); ok {
+					states[cid+wikidata.CardId(suffix)] = state
+				}
+			}
+		}
+	}
+
+	var paths []string
+	for path, pu := range pages {
+		if pu.changed {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		raw, err := json.Marshal(pages[path].info)
+		if err != nil {
+			return result, err
+		}
+		err = trans.AddOrReplace(wikidata.PageTreePath(path)+"/_info", append(raw, '\n'))
+		if err != nil {
+			return result, err
+		}
+	}
+
+	err = trans.Store(commit.Commit{
+		Author:    sig,
+		Committer: sig,
+		Message:   "Import " + strconv.Itoa(result.Notes) + " notes from Anki into " + root + "\n",
+	})
+	if err != nil {
+		return result, err
+	}
+
+	result.Reviewed, err = store.Import(states)
+	return result, err
+}
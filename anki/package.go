@@ -0,0 +1,196 @@
+package anki
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+var (
+	NoCollectionError      error = errors.New("anki: package contains no collection")
+	UnsupportedFormatError error = errors.New("anki: package only has a collection.anki21b, which is not supported; export it with support for older Anki versions")
+	BadMediaError          error = errors.New("anki: package media index is not understood")
+)
+
+// A package (.apkg) is a zip file holding a collection, a JSON object
+// "media" which maps the names of the other files in the zip, "0", "1" and
+// so on, to the names of the media they hold.
+type ankiPackage struct {
+	Collection *collection
+	media      map[string]*zip.File
+}
+
+// readMedia returns the contents of the media file called name. ok is false
+// if the package does not have it.
+func (p *ankiPackage) readMedia(name string) ([]byte, bool, error) {
+	f, ok := p.media[name]
+	if !ok {
+		return nil, false, nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, true, err
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	return b, true, err
+}
+
+func findFile(z *zip.Reader, name string) *zip.File {
+	for _, f := range z.File {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func readPackage(r io.ReaderAt, size int64) (*ankiPackage, error) {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	// collection.anki21 is written alongside collection.anki2 by Anki 2.1
+	// and holds the real collection; collection.anki2 is then a stub.
+	colFile := findFile(z, "collection.anki21")
+	if colFile == nil {
+		colFile = findFile(z, "collection.anki2")
+		if findFile(z, "collection.anki21b") != nil {
+			return nil, UnsupportedFormatError
+		}
+	}
+	if colFile == nil {
+		return nil, NoCollectionError
+	}
+
+	tmp, err := ioutil.TempDir("", "libellus-anki-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	colPath := filepath.Join(tmp, "collection")
+	err = extract(colFile, colPath)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ankiPackage{media: make(map[string]*zip.File)}
+	p.Collection, err = readCollection(colPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if mediaFile := findFile(z, "media"); mediaFile != nil {
+		rc, err := mediaFile.Open()
+		if err != nil {
+			return nil, err
+		}
+		var index map[string]string
+		err = json.NewDecoder(rc).Decode(&index)
+		rc.Close()
+		if err != nil {
+			return nil, BadMediaError
+		}
+		for number, name := range index {
+			if f := findFile(z, number); f != nil {
+				p.media[name] = f
+			}
+		}
+	}
+
+	return p, nil
+}
+
+func extract(f *zip.File, path string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, rc)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func writePackage(w io.Writer, col *collection, media map[string][]byte, mod int64) error {
+	tmp, err := ioutil.TempDir("", "libellus-anki-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	colPath := filepath.Join(tmp, "collection.anki2")
+	err = writeCollection(colPath, col, mod)
+	if err != nil {
+		return err
+	}
+
+	z := zip.NewWriter(w)
+
+	err = addFile(z, "collection.anki2", colPath)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range media {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	index := make(map[string]string)
+	for i, name := range names {
+		number := strconv.Itoa(i)
+		index[number] = name
+		fw, err := z.Create(number)
+		if err != nil {
+			return err
+		}
+		_, err = fw.Write(media[name])
+		if err != nil {
+			return err
+		}
+	}
+
+	fw, err := z.Create("media")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(fw).Encode(index)
+	if err != nil {
+		return err
+	}
+
+	return z.Close()
+}
+
+func addFile(z *zip.Writer, name string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fw, err := z.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, f)
+	return err
+}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -35,18 +36,22 @@ type rateLimitEntry struct {
 	Expiry time.Time
 }
 
+// csrfField is the form field which carries the CSRF token of a session.
+const csrfField = "csrf"
+
 type Auth struct {
 	config
 
-	httpOnly  bool
-	cookies   map[string]bool
+	httpOnly bool
+	// cookies maps the session cookies to their CSRF tokens.
+	cookies   map[string]string
 	ratelimit map[string]rateLimitEntry
 }
 
 func NewAuth(configFile string, httpOnly bool) *Auth {
 	auth := &Auth{
 		httpOnly:  httpOnly,
-		cookies:   make(map[string]bool),
+		cookies:   make(map[string]string),
 		ratelimit: make(map[string]rateLimitEntry),
 	}
 	raw, err := ioutil.ReadFile(configFile)
@@ -77,10 +82,26 @@ func (auth *Auth) IsAuthenticated(r *http.Request) bool {
 	if cookie == nil {
 		return false
 	}
-	if value, ok := auth.cookies[*cookie]; ok {
-		return value
+	_, ok := auth.cookies[*cookie]
+	return ok
+}
+
+// CSRFToken returns the token which the forms served to the session of r
+// post back, or "" if r is not authenticated.
+func (auth *Auth) CSRFToken(r *http.Request) string {
+	cookie := auth.getCookie(r)
+	if cookie == nil {
+		return ""
 	}
-	return false
+	return auth.cookies[*cookie]
+}
+
+// ValidCSRFToken reports whether the form posted with r, which must already
+// be parsed, carries the CSRF token of its session. The session cookie alone
+// does not show that the user sent the form, as another site could have.
+func (auth *Auth) ValidCSRFToken(r *http.Request) bool {
+	token := auth.CSRFToken(r)
+	return token != "" && subtle.ConstantTimeCompare([]byte(r.PostForm.Get(csrfField)), []byte(token)) == 1
 }
 
 func (auth *Auth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -169,14 +190,21 @@ func (auth *Auth) login(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte("bad luck"))
 			return
 		}
+		token, err := generateRandomString()
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("bad luck"))
+			return
+		}
 
-		auth.cookies[newcookie] = true
+		auth.cookies[newcookie] = token
 		http.SetCookie(w, &http.Cookie{
-			Name:    "libellus",
-			Value:   newcookie,
-			Expires: time.Now().Add(14 * 24 * time.Hour),
-			Secure:  !auth.httpOnly,
-			Path:    "/",
+			Name:     "libellus",
+			Value:    newcookie,
+			Expires:  time.Now().Add(14 * 24 * time.Hour),
+			Secure:   !auth.httpOnly,
+			Path:     "/",
+			SameSite: http.SameSiteStrictMode,
 		})
 		http.Redirect(w, r, "/"+r.Form.Get("redirect"), 303)
 
@@ -197,6 +225,7 @@ func (auth *Auth) logout(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`
 <html>
     <form action="/_auth/logout" method="post">
+        <input type="hidden" name="` + csrfField + `" value="` + html.EscapeString(auth.CSRFToken(r)) + `" />
         <button type="submit">Logout</button>
     </form>
 </html>
@@ -205,6 +234,12 @@ func (auth *Auth) logout(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == http.MethodPost {
+		if r.ParseForm() != nil || !auth.ValidCSRFToken(r) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("invalid form"))
+			return
+		}
+
 		cookie := auth.getCookie(r)
 		if cookie == nil {
 			w.Write([]byte("cookie == nil. Internal error?"))
@@ -230,6 +265,7 @@ func (auth *Auth) clear(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`
 <html>
     <form action="/_auth/clear" method="post">
+        <input type="hidden" name="` + csrfField + `" value="` + html.EscapeString(auth.CSRFToken(r)) + `" />
         <button type="submit">Clear Auth</button>
     </form>
 </html>
@@ -238,8 +274,14 @@ func (auth *Auth) clear(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == http.MethodPost {
+		if r.ParseForm() != nil || !auth.ValidCSRFToken(r) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("invalid form"))
+			return
+		}
+
 		num := len(auth.cookies)
-		auth.cookies = make(map[string]bool)
+		auth.cookies = make(map[string]string)
 		w.Write([]byte(fmt.Sprintf("successful auth clear of %d session(s)", num)))
 		return
 	}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/MerryMage/libellus/auth"
 	"github.com/MerryMage/libellus/objstore"
+	"github.com/MerryMage/libellus/srs"
 	"github.com/MerryMage/libellus/wikidata"
 )
 
@@ -17,4 +18,5 @@ type Config struct {
 	Authentication  *auth.Auth
 	StaticData      packr.Box
 	WikiData        *wikidata.WikiData
+	Srs             *srs.Store
 }
@@ -17,6 +17,7 @@ import (
 	"github.com/MerryMage/libellus/auth"
 	"github.com/MerryMage/libellus/common"
 	"github.com/MerryMage/libellus/objstore"
+	"github.com/MerryMage/libellus/srs"
 	"github.com/MerryMage/libellus/wiki"
 	"github.com/MerryMage/libellus/wikidata"
 )
@@ -29,6 +30,7 @@ var (
 	httpEndpoint    = flag.String("http_endpoint", "127.0.0.1:8080", "HTTP endpoint")
 	privateDir      = flag.String("private_dir", "./libellus_private/", "private data directory")
 	objStoreDir     = flag.String("objstore_dir", "./libellus_objstore/", "object store directory")
+	rejectProblems  = flag.Bool("reject_new_problems", false, "If True, rejects edits which introduce new errors into the wiki")
 )
 
 var app *wiki.Wiki
@@ -168,7 +170,18 @@ func main() {
 		Authentication:  auth.NewAuth(*privateDir+"/auth/account.json", *httpOnly),
 		StaticData:      packr.NewBox("./static"),
 	}
-	config.WikiData = wikidata.New(config.Repo, "master")
+	config.WikiData = wikidata.New(config.Repo, "master", config.PrivateWikiDir)
+	config.WikiData.Watch()
+	if *rejectProblems {
+		config.WikiData.RejectNewProblems()
+	}
+
+	srsStore, err := srs.Open(config.PrivateSrsDir)
+	if err != nil {
+		log.Fatalf("srs.Open() failed with %s", err)
+	}
+	config.Srs = srsStore
+
 	app = wiki.NewWiki(config)
 
 	if *httpOnly {
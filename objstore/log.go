@@ -0,0 +1,82 @@
+package objstore
+
+import (
+	"github.com/MerryMage/libellus/objstore/commit"
+	"github.com/MerryMage/libellus/objstore/objid"
+	"github.com/MerryMage/libellus/objstore/tree"
+)
+
+type LogEntry struct {
+	Oid    objid.Oid
+	Commit commit.Commit
+}
+
+// Log returns the first-parent history starting at start, newest first.
+func (repo *Repository) Log(start objid.Oid) ([]LogEntry, error) {
+	var log []LogEntry
+
+	oid := start
+	for {
+		c, err := repo.Commit(oid)
+		if err != nil {
+			return log, err
+		}
+
+		log = append(log, LogEntry{Oid: oid, Commit: c})
+
+		if len(c.Parents) == 0 {
+			return log, nil
+		}
+		oid = c.Parents[0]
+	}
+}
+
+// LookupOid returns the oid of the entry at path within the tree treeoid, or
+// the zero oid if there is no such entry. The empty path refers to the tree
+// itself.
+func (repo *Repository) LookupOid(treeoid objid.Oid, path string) (objid.Oid, error) {
+	if path == "" || treeoid.IsZero() {
+		return treeoid, nil
+	}
+
+	e, err := tree.Lookup(repo, treeoid, path)
+	switch err.(type) {
+	case nil:
+		return e.Oid, nil
+	case tree.NotFoundError, tree.NotATreeError:
+		return objid.Oid{}, nil
+	}
+	return objid.Oid{}, err
+}
+
+// PathLog returns the commits in the first-parent history starting at start
+// which changed, added or removed the entry at path, newest first.
+func (repo *Repository) PathLog(start objid.Oid, path string) ([]LogEntry, error) {
+	log, err := repo.Log(start)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []LogEntry
+
+	for i, le := range log {
+		current, err := repo.LookupOid(le.Commit.Tree, path)
+		if err != nil {
+			return ret, err
+		}
+
+		var previous objid.Oid
+		if i+1 < len(log) {
+			previous, err = repo.LookupOid(log[i+1].Commit.Tree, path)
+			if err != nil {
+				return ret, err
+			}
+		}
+
+		if current != previous {
+			ret = append(ret, le)
+		}
+	}
+
+	return ret, nil
+}
@@ -1,6 +1,7 @@
 package objfile
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
 
@@ -59,36 +60,60 @@ func (store Store) Exists(oid objid.Oid) (bool, error) {
 	return true, nil
 }
 
+// Store writes the object oid unless it already exists. Objects are written
+// to a temporary file first and then renamed into place, so that a
+// concurrent Get never sees a partially written object.
 func (store Store) Store(oid objid.Oid, payload []byte) error {
 	objpath := store.pathToObjectFile(oid)
 
-	err := os.MkdirAll(store.dirContainingObjectFile(oid), 0777)
+	exists, err := store.Exists(oid)
+	if err != nil || exists {
+		return err
+	}
+
+	err = os.MkdirAll(store.dirContainingObjectFile(oid), 0777)
 	if err != nil {
 		return err
 	}
 
-	f, err := os.Create(objpath)
+	f, err := ioutil.TempFile(store.dirContainingObjectFile(oid), "tmp_obj_")
 	if err != nil {
 		return err
 	}
+	tmppath := f.Name()
 
 	_, err = f.Write(payload)
 	if err != nil {
 		f.Close()
-		os.Remove(objpath)
+		os.Remove(tmppath)
 		return err
 	}
 
 	err = f.Sync()
 	if err != nil {
 		f.Close()
-		os.Remove(objpath)
+		os.Remove(tmppath)
+		return err
+	}
+
+	// TempFile creates the file private to the user; objects are read-only,
+	// as in git.
+	err = f.Chmod(0444)
+	if err != nil {
+		f.Close()
+		os.Remove(tmppath)
 		return err
 	}
 
 	err = f.Close()
 	if err != nil {
-		os.Remove(objpath)
+		os.Remove(tmppath)
+		return err
+	}
+
+	err = os.Rename(tmppath, objpath)
+	if err != nil {
+		os.Remove(tmppath)
 		return err
 	}
 
@@ -18,6 +18,10 @@ func (o Oid) Equals(o2 Oid) bool {
 	return o.Bytes == o2.Bytes
 }
 
+func (o Oid) IsZero() bool {
+	return o.Bytes == [20]byte{}
+}
+
 func (o Oid) Write(w io.Writer) error {
 	_, err := w.Write(o.Bytes[:])
 	return err
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/MerryMage/libellus/objstore/commit"
@@ -27,6 +28,13 @@ type Repository struct {
 	lock     sync.RWMutex
 	path     string
 	objStore objfile.Store
+
+	// refLock serializes ref updates made by Transactions.
+	refLock sync.Mutex
+
+	hooksLock          sync.Mutex
+	refUpdateHooks     []func(ref string)
+	refValidationHooks []func(ref string, oid objid.Oid) error
 }
 
 func NewRepository(path string) *Repository {
@@ -102,14 +110,16 @@ func (repo *Repository) storeCommit(c commit.Commit) (objid.Oid, error) {
 	return repo.store(objtype.Commit, b.Bytes())
 }
 
-func (repo *Repository) RefOid(ref string) (objid.Oid, error) {
+// readRefFile reads the ref at refpath, falling back to packed-refs if there
+// is no loose file for it, as after git pack-refs or git gc.
+func (repo *Repository) readRefFile(refpath string) (objid.Oid, error) {
 	repo.lock.RLock()
 	defer repo.lock.RUnlock()
 
-	refpath := filepath.Join(repo.path, "refs", "heads", ref)
-
-	rawoid, err := ioutil.ReadFile(refpath)
-	if err != nil {
+	rawoid, err := ioutil.ReadFile(filepath.Join(repo.path, refpath))
+	if os.IsNotExist(err) {
+		return repo.readPackedRef(filepath.ToSlash(refpath), err)
+	} else if err != nil {
 		return objid.Oid{}, err
 	}
 
@@ -117,6 +127,83 @@ func (repo *Repository) RefOid(ref string) (objid.Oid, error) {
 	return objid.FromString(string(rawoid))
 }
 
+// readPackedRef looks up the ref name in packed-refs. notFound is returned if
+// it is not there either.
+func (repo *Repository) readPackedRef(name string, notFound error) (objid.Oid, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(repo.path, "packed-refs"))
+	if os.IsNotExist(err) {
+		return objid.Oid{}, notFound
+	} else if err != nil {
+		return objid.Oid{}, err
+	}
+
+	for _, line := range strings.Split(string(raw), "\n") {
+		// Comments start with # and peeled tags with ^.
+		line = strings.TrimRight(line, "\r")
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == name {
+			return objid.FromString(fields[0])
+		}
+	}
+	return objid.Oid{}, notFound
+}
+
+func (repo *Repository) RefOid(ref string) (objid.Oid, error) {
+	return repo.readRefFile(filepath.Join("refs", "heads", ref))
+}
+
+// RefFiles returns the files whose modification may change the value of ref.
+func (repo *Repository) RefFiles(ref string) []string {
+	return []string{
+		filepath.Join(repo.path, "refs", "heads", ref),
+		filepath.Join(repo.path, "packed-refs"),
+	}
+}
+
+// OnRefUpdate registers f to be called whenever a Transaction made through
+// repo updates a ref. Updates made by other processes are not reported.
+func (repo *Repository) OnRefUpdate(f func(ref string)) {
+	repo.hooksLock.Lock()
+	defer repo.hooksLock.Unlock()
+	repo.refUpdateHooks = append(repo.refUpdateHooks, f)
+}
+
+// ValidateRefUpdate registers f to be called before a Transaction made
+// through repo points ref at the commit oid. If f returns an error, the ref is
+// left unchanged and the Transaction fails with that error.
+func (repo *Repository) ValidateRefUpdate(f func(ref string, oid objid.Oid) error) {
+	repo.hooksLock.Lock()
+	defer repo.hooksLock.Unlock()
+	repo.refValidationHooks = append(repo.refValidationHooks, f)
+}
+
+func (repo *Repository) validateRefUpdate(ref string, oid objid.Oid) error {
+	repo.hooksLock.Lock()
+	hooks := repo.refValidationHooks
+	repo.hooksLock.Unlock()
+
+	for _, f := range hooks {
+		err := f(ref, oid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repo *Repository) notifyRefUpdate(ref string) {
+	repo.hooksLock.Lock()
+	hooks := repo.refUpdateHooks
+	repo.hooksLock.Unlock()
+
+	for _, f := range hooks {
+		f(ref)
+	}
+}
+
 func (repo *Repository) Ref(ref string) (commit.Commit, objid.Oid, error) {
 	oid, err := repo.RefOid(ref)
 	if err != nil {
@@ -136,7 +223,8 @@ func (repo *Repository) Ref(ref string) (commit.Commit, objid.Oid, error) {
 
 func (repo *Repository) writeRef(ref string, oid objid.Oid) error {
 	refpath := filepath.Join(repo.path, "refs", "heads", ref)
-	f, err := os.OpenFile(refpath, os.O_RDWR|os.O_TRUNC, 0666)
+	// The ref may only be in packed-refs, where the loose file overrides it.
+	f, err := os.OpenFile(refpath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
@@ -148,6 +236,19 @@ func (repo *Repository) writeRef(ref string, oid objid.Oid) error {
 	return f.Close()
 }
 
+func (repo *Repository) Commit(oid objid.Oid) (commit.Commit, error) {
+	o, err := repo.Get(oid)
+	if err != nil {
+		return commit.Commit{}, err
+	} else if o.ObjType() != objtype.Commit {
+		o.Close()
+		return commit.Commit{}, NotACommitError
+	}
+	defer o.Close()
+
+	return commit.Read(o)
+}
+
 func (repo *Repository) Tree(oid objid.Oid) (tree.Tree, error) {
 	o, err := repo.Get(oid)
 	if err != nil {
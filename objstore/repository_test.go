@@ -0,0 +1,83 @@
+package objstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MerryMage/libellus/objstore/commit"
+	"github.com/MerryMage/libellus/objstore/objid"
+	"github.com/MerryMage/libellus/objstore/objtype"
+)
+
+var testSignature = commit.Signature{Name: "Test", Email: "test@example.com", Timestamp: 1500000000, Timezone: "+0000"}
+
+// tempRepo creates a repository whose master branch has a single empty
+// commit.
+func tempRepo(t *testing.T) (string, *Repository, objid.Oid) {
+	dir, err := ioutil.TempDir("", "objstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(dir, "refs", "heads"), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepository(dir)
+	treeoid, err := repo.Store(objtype.Tree, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	commit.Commit{Author: testSignature, Committer: testSignature, Message: "Initial\n", Tree: treeoid}.Write(&b)
+	coid, err := repo.Store(objtype.Commit, b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.writeRef("master", coid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, repo, coid
+}
+
+func TestPackedRefs(t *testing.T) {
+	dir, repo, coid := tempRepo(t)
+	defer os.RemoveAll(dir)
+
+	// As left behind by git pack-refs --all.
+	os.Remove(filepath.Join(dir, "refs", "heads", "master"))
+	packed := "# pack-refs with: peeled fully-peeled sorted \n" +
+		coid.String() + " refs/heads/master\n" +
+		coid.String() + " refs/tags/v1\n^" + coid.String() + "\n"
+	err := ioutil.WriteFile(filepath.Join(dir, "packed-refs"), []byte(packed), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if oid, err := repo.RefOid("master"); err != nil || oid != coid {
+		t.Errorf("RefOid = %v, %v", oid, err)
+	}
+	if oid, err := repo.ResolveRevision("v1"); err != nil || oid != coid {
+		t.Errorf("ResolveRevision = %v, %v", oid, err)
+	}
+	if _, err := repo.RefOid("other"); !os.IsNotExist(err) {
+		t.Errorf("RefOid(other) err = %v", err)
+	}
+
+	trans, err := repo.StartTransaction("master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trans.Add("file", []byte("x"))
+	err = trans.Store(commit.Commit{Author: testSignature, Committer: testSignature, Message: "Add file\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oid, err := repo.RefOid("master"); err != nil || oid == coid {
+		t.Errorf("RefOid = %v, %v", oid, err)
+	}
+}
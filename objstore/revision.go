@@ -0,0 +1,126 @@
+package objstore
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/MerryMage/libellus/objstore/objid"
+	"github.com/MerryMage/libellus/objstore/objtype"
+)
+
+var (
+	UnknownRevisionError   error = errors.New("repository: unknown revision")
+	AmbiguousRevisionError error = errors.New("repository: ambiguous revision")
+	BadTagError            error = errors.New("repository: malformed tag object")
+)
+
+func isHex(s string) bool {
+	for _, ch := range s {
+		if (ch < '0' || ch > '9') && (ch < 'a' || ch > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolveRevision resolves a full or abbreviated commit oid, a tag name or a
+// branch name to the oid of a commit. Annotated tags are peeled.
+func (repo *Repository) ResolveRevision(rev string) (objid.Oid, error) {
+	if rev == "" || strings.Contains(rev, "..") {
+		return objid.Oid{}, UnknownRevisionError
+	}
+
+	for _, dir := range []string{"tags", "heads"} {
+		if oid, err := repo.readRefFile(filepath.Join("refs", dir, rev)); err == nil {
+			return repo.peelToCommit(oid)
+		}
+	}
+
+	rev = strings.ToLower(rev)
+	if len(rev) < 4 || len(rev) > 40 || !isHex(rev) {
+		return objid.Oid{}, UnknownRevisionError
+	}
+
+	if len(rev) == 40 {
+		oid, err := objid.FromString(rev)
+		if err != nil {
+			return objid.Oid{}, err
+		}
+		return repo.peelToCommit(oid)
+	}
+
+	oid, err := repo.expandAbbreviatedOid(rev)
+	if err != nil {
+		return objid.Oid{}, err
+	}
+	return repo.peelToCommit(oid)
+}
+
+func (repo *Repository) expandAbbreviatedOid(prefix string) (objid.Oid, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	dir, err := os.Open(filepath.Join(repo.path, "objects", prefix[:2]))
+	if os.IsNotExist(err) {
+		return objid.Oid{}, UnknownRevisionError
+	} else if err != nil {
+		return objid.Oid{}, err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return objid.Oid{}, err
+	}
+
+	var found string
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix[2:]) {
+			if found != "" {
+				return objid.Oid{}, AmbiguousRevisionError
+			}
+			found = prefix[:2] + name
+		}
+	}
+
+	if found == "" {
+		return objid.Oid{}, UnknownRevisionError
+	}
+	return objid.FromString(found)
+}
+
+func (repo *Repository) peelToCommit(oid objid.Oid) (objid.Oid, error) {
+	for {
+		o, err := repo.Get(oid)
+		if err != nil {
+			return objid.Oid{}, err
+		}
+
+		switch o.ObjType() {
+		case objtype.Commit:
+			o.Close()
+			return oid, nil
+		case objtype.Tag:
+			raw, err := ioutil.ReadAll(o)
+			o.Close()
+			if err != nil {
+				return objid.Oid{}, err
+			}
+			line := bytes.SplitN(raw, []byte{'\n'}, 2)[0]
+			parts := bytes.SplitN(line, []byte{' '}, 2)
+			if len(parts) != 2 || string(parts[0]) != "object" {
+				return objid.Oid{}, BadTagError
+			}
+			oid, err = objid.FromString(string(parts[1]))
+			if err != nil {
+				return objid.Oid{}, err
+			}
+		default:
+			o.Close()
+			return objid.Oid{}, NotACommitError
+		}
+	}
+}
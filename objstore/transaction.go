@@ -13,6 +13,7 @@ import (
 var (
 	PathAlreadyExistsError error = errors.New("transaction: path already exists")
 	PathDoesNotExistError  error = errors.New("transaction: path does not exist")
+	RefChangedError        error = errors.New("transaction: ref was updated since the transaction started")
 )
 
 type transactionTreeEntry struct {
@@ -44,6 +45,11 @@ func (repo *Repository) StartTransaction(ref string) (*Transaction, error) {
 	return trans, err
 }
 
+// Parent returns the commit the transaction started from.
+func (trans *Transaction) Parent() objid.Oid {
+	return trans.parent
+}
+
 func catPath(parent string, next string) string {
 	if parent != "" {
 		return parent + "/" + next
@@ -77,6 +83,13 @@ func (trans *Transaction) flattenTree(currentPath string, currentTree objid.Oid)
 	return nil
 }
 
+// Lookup returns the oid of the blob at path as the tree stands in the
+// transaction so far.
+func (trans *Transaction) Lookup(path string) (objid.Oid, bool) {
+	e, ok := trans.flatTree[path]
+	return e.Oid, ok
+}
+
 func (trans *Transaction) Add(path string, payload []byte) error {
 	if _, ok := trans.flatTree[path]; ok {
 		return PathAlreadyExistsError
@@ -104,6 +117,27 @@ func (trans *Transaction) Delete(path string) error {
 	return nil
 }
 
+// DeleteTree removes path and every entry below it.
+func (trans *Transaction) DeleteTree(path string) error {
+	prefix := path + "/"
+	for p := range trans.flatTree {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(trans.flatTree, p)
+		}
+	}
+	return nil
+}
+
+// ReplaceTree replaces path and everything below it with the contents of the
+// tree treeoid.
+func (trans *Transaction) ReplaceTree(path string, treeoid objid.Oid) error {
+	err := trans.DeleteTree(path)
+	if err != nil {
+		return err
+	}
+	return trans.flattenTree(path, treeoid)
+}
+
 func (trans *Transaction) Move(src string, dest string) error {
 	if _, ok := trans.flatTree[dest]; ok {
 		return PathAlreadyExistsError
@@ -119,6 +153,33 @@ func (trans *Transaction) Move(src string, dest string) error {
 	return nil
 }
 
+// MoveTree moves path and every entry below it to dest, which must not exist
+// yet.
+func (trans *Transaction) MoveTree(src string, dest string) error {
+	srcPrefix := src + "/"
+	destPrefix := dest + "/"
+
+	var moved []string
+	for p := range trans.flatTree {
+		if p == dest || strings.HasPrefix(p, destPrefix) {
+			return PathAlreadyExistsError
+		}
+		if p == src || strings.HasPrefix(p, srcPrefix) {
+			moved = append(moved, p)
+		}
+	}
+	if len(moved) == 0 {
+		return PathDoesNotExistError
+	}
+
+	for _, p := range moved {
+		trans.flatTree[dest+p[len(src):]] = trans.flatTree[p]
+		delete(trans.flatTree, p)
+	}
+
+	return nil
+}
+
 func (trans *Transaction) unflattenTree() map[string]*tree.Tree {
 	trees := make(map[string]*tree.Tree)
 
@@ -182,5 +243,33 @@ func (trans *Transaction) Store(c commit.Commit) error {
 		return err
 	}
 
+	err = trans.updateRef(coid)
+	if err != nil {
+		return err
+	}
+
+	trans.repo.notifyRefUpdate(trans.ref)
+	return nil
+}
+
+// updateRef points the ref at coid, unless another transaction has updated
+// it since this one started; the other commit would otherwise be lost.
+func (trans *Transaction) updateRef(coid objid.Oid) error {
+	trans.repo.refLock.Lock()
+	defer trans.repo.refLock.Unlock()
+
+	current, err := trans.repo.RefOid(trans.ref)
+	if err != nil {
+		return err
+	}
+	if !current.Equals(trans.parent) {
+		return RefChangedError
+	}
+
+	err = trans.repo.validateRefUpdate(trans.ref, coid)
+	if err != nil {
+		return err
+	}
+
 	return trans.repo.writeRef(trans.ref, coid)
 }
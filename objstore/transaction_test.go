@@ -0,0 +1,43 @@
+package objstore
+
+import (
+	"os"
+	"testing"
+
+	"github.com/MerryMage/libellus/objstore/commit"
+)
+
+func TestConcurrentTransactions(t *testing.T) {
+	dir, repo, coid := tempRepo(t)
+	defer os.RemoveAll(dir)
+
+	first, err := repo.StartTransaction("master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := repo.StartTransaction("master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first.Add("a", []byte("a"))
+	err = first.Store(commit.Commit{Author: testSignature, Committer: testSignature, Message: "Add a\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := repo.RefOid("master")
+	if err != nil || stored == coid {
+		t.Fatalf("RefOid = %v, %v", stored, err)
+	}
+
+	// The second transaction started from the old head, so storing it
+	// would lose a.
+	second.Add("b", []byte("b"))
+	err = second.Store(commit.Commit{Author: testSignature, Committer: testSignature, Message: "Add b\n"})
+	if err != RefChangedError {
+		t.Errorf("err = %v", err)
+	}
+	if oid, err := repo.RefOid("master"); err != nil || oid != stored {
+		t.Errorf("RefOid = %v, %v", oid, err)
+	}
+}
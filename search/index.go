@@ -0,0 +1,259 @@
+package search
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math"
+	"sort"
+	"strings"
+)
+
+// BM25 parameters.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Document is a unit of search. Text is indexed; the other fields identify
+// where the text came from.
+type Document struct {
+	Path      string
+	Knowledge string
+	Title     string
+	Text      string
+}
+
+type posting struct {
+	Doc       int
+	Positions []int
+}
+
+// Index is an inverted index over stemmed words. An Index must not be
+// modified once it is being searched.
+type Index struct {
+	docs     []Document
+	lengths  []int
+	total    int
+	postings map[string][]posting
+	words    map[string]string
+}
+
+func NewIndex() *Index {
+	return &Index{
+		postings: make(map[string][]posting),
+		words:    make(map[string]string),
+	}
+}
+
+func (idx *Index) Add(doc Document) {
+	idx.AddAnalyzed(doc, Analyze(doc.Text))
+}
+
+// AddAnalyzed adds a document whose text has already been analyzed. The text
+// of the document is replaced with the analyzed text.
+func (idx *Index) AddAnalyzed(doc Document, a Analysis) {
+	id := len(idx.docs)
+	tokens := a.Tokens
+	doc.Text = a.Text
+
+	idx.docs = append(idx.docs, doc)
+	idx.lengths = append(idx.lengths, len(tokens))
+	idx.total += len(tokens)
+
+	positions := make(map[string][]int)
+	var order []string
+	for i, t := range tokens {
+		if positions[t.Stem] == nil {
+			order = append(order, t.Stem)
+		}
+		positions[t.Stem] = append(positions[t.Stem], i)
+		idx.words[t.Word] = t.Stem
+	}
+
+	for _, stem := range order {
+		idx.postings[stem] = append(idx.postings[stem], posting{
+			Doc:       id,
+			Positions: positions[stem],
+		})
+	}
+}
+
+func (idx *Index) Len() int {
+	return len(idx.docs)
+}
+
+type persistedIndex struct {
+	Docs     []Document
+	Lengths  []int
+	Total    int
+	Postings map[string][]posting
+	Words    map[string]string
+}
+
+// GobEncode lets a built Index be saved, so that it need not be rebuilt.
+func (idx *Index) GobEncode() ([]byte, error) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(persistedIndex{
+		Docs:     idx.docs,
+		Lengths:  idx.lengths,
+		Total:    idx.total,
+		Postings: idx.postings,
+		Words:    idx.words,
+	})
+	return b.Bytes(), err
+}
+
+func (idx *Index) GobDecode(data []byte) error {
+	var persisted persistedIndex
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&persisted)
+	if err != nil {
+		return err
+	}
+
+	*idx = *NewIndex()
+	idx.docs = persisted.Docs
+	idx.lengths = persisted.Lengths
+	idx.total = persisted.Total
+	for stem, postings := range persisted.Postings {
+		idx.postings[stem] = postings
+	}
+	for word, stem := range persisted.Words {
+		idx.words[word] = stem
+	}
+	return nil
+}
+
+type Fragment struct {
+	Text  string
+	Match bool
+}
+
+type Result struct {
+	Path      string
+	Knowledge string
+	Title     string
+	Score     float64
+	Snippet   []Fragment
+}
+
+// clauseMatches returns the term frequency of a clause in every document it
+// occurs in.
+func (idx *Index) clauseMatches(c clause) map[int]int {
+	freqs := make(map[int]int)
+
+	switch {
+	case c.prefix:
+		stems := make(map[string]bool)
+		for word, stem := range idx.words {
+			if strings.HasPrefix(word, c.words[0]) {
+				stems[stem] = true
+			}
+		}
+		for stem := range stems {
+			for _, p := range idx.postings[stem] {
+				freqs[p.Doc] += len(p.Positions)
+			}
+		}
+
+	case len(c.stems) == 1:
+		for _, p := range idx.postings[c.stems[0]] {
+			freqs[p.Doc] = len(p.Positions)
+		}
+
+	default:
+		following := make([]map[int]map[int]bool, len(c.stems))
+		for i, stem := range c.stems[1:] {
+			following[i+1] = make(map[int]map[int]bool)
+			for _, p := range idx.postings[stem] {
+				set := make(map[int]bool)
+				for _, pos := range p.Positions {
+					set[pos] = true
+				}
+				following[i+1][p.Doc] = set
+			}
+		}
+
+		for _, p := range idx.postings[c.stems[0]] {
+			n := 0
+			for _, pos := range p.Positions {
+				matched := true
+				for i := 1; i < len(c.stems); i++ {
+					if !following[i][p.Doc][pos+i] {
+						matched = false
+						break
+					}
+				}
+				if matched {
+					n++
+				}
+			}
+			if n > 0 {
+				freqs[p.Doc] = n
+			}
+		}
+	}
+
+	return freqs
+}
+
+// Search returns up to limit documents matching every clause of query,
+// ranked by BM25. A clause is a word, a "quoted phrase" or a prefix*.
+func (idx *Index) Search(query string, limit int) []Result {
+	clauses := parseQuery(query)
+	if len(clauses) == 0 || len(idx.docs) == 0 {
+		return nil
+	}
+
+	n := float64(len(idx.docs))
+	avgLength := float64(idx.total) / n
+	scores := make(map[int]float64)
+
+	for i, c := range clauses {
+		freqs := idx.clauseMatches(c)
+		df := float64(len(freqs))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+
+		next := make(map[int]float64)
+		for doc, tf := range freqs {
+			if _, ok := scores[doc]; !ok && i != 0 {
+				continue
+			}
+			norm := bm25K1 * (1 - bm25B + bm25B*float64(idx.lengths[doc])/avgLength)
+			next[doc] = scores[doc] + idf*float64(tf)*(bm25K1+1)/(float64(tf)+norm)
+		}
+		scores = next
+	}
+
+	ranked := make([]int, 0, len(scores))
+	for doc := range scores {
+		ranked = append(ranked, doc)
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		di, dj := ranked[i], ranked[j]
+		if scores[di] != scores[dj] {
+			return scores[di] > scores[dj]
+		}
+		if idx.docs[di].Path != idx.docs[dj].Path {
+			return idx.docs[di].Path < idx.docs[dj].Path
+		}
+		return idx.docs[di].Knowledge < idx.docs[dj].Knowledge
+	})
+
+	if limit > 0 && len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+
+	results := make([]Result, 0, len(ranked))
+	for _, doc := range ranked {
+		d := idx.docs[doc]
+		results = append(results, Result{
+			Path:      d.Path,
+			Knowledge: d.Knowledge,
+			Title:     d.Title,
+			Score:     scores[doc],
+			Snippet:   snippet(d.Text, clauses),
+		})
+	}
+	return results
+}
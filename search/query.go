@@ -0,0 +1,179 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+// snippetBefore and snippetAfter are the number of words shown around the
+// first match in a snippet.
+const (
+	snippetBefore = 8
+	snippetAfter  = 24
+)
+
+type clause struct {
+	words  []string
+	stems  []string
+	prefix bool
+}
+
+func (c clause) matches(t Token) bool {
+	if c.prefix {
+		return strings.HasPrefix(t.Word, c.words[0])
+	}
+	for _, stem := range c.stems {
+		if t.Stem == stem {
+			return true
+		}
+	}
+	return false
+}
+
+func newClause(tokens []Token) clause {
+	var c clause
+	for _, t := range tokens {
+		c.words = append(c.words, t.Word)
+		c.stems = append(c.stems, t.Stem)
+	}
+	return c
+}
+
+// parseQuery splits a query into clauses. Quoted text becomes a phrase, a
+// word ending in * becomes a prefix, and any other word must match by stem.
+func parseQuery(query string) []clause {
+	var clauses []clause
+
+	for query != "" {
+		query = strings.TrimLeftFunc(query, unicode.IsSpace)
+		if query == "" {
+			break
+		}
+
+		if query[0] == '"' {
+			end := strings.IndexByte(query[1:], '"')
+			var phrase string
+			if end == -1 {
+				phrase, query = query[1:], ""
+			} else {
+				phrase, query = query[1:end+1], query[end+2:]
+			}
+			if tokens := tokenize(phrase); len(tokens) > 0 {
+				clauses = append(clauses, newClause(tokens))
+			}
+			continue
+		}
+
+		end := strings.IndexFunc(query, unicode.IsSpace)
+		var word string
+		if end == -1 {
+			word, query = query, ""
+		} else {
+			word, query = query[:end], query[end:]
+		}
+
+		tokens := tokenize(word)
+		if len(tokens) == 0 {
+			continue
+		}
+
+		if strings.HasSuffix(word, "*") && len(tokens) == 1 {
+			clauses = append(clauses, clause{
+				words:  []string{tokens[0].Word},
+				prefix: true,
+			})
+			continue
+		}
+
+		clauses = append(clauses, newClause(tokens))
+	}
+
+	return clauses
+}
+
+func collapseSpace(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		if unicode.IsSpace(r) {
+			if !space {
+				b.WriteByte(' ')
+			}
+			space = true
+			continue
+		}
+		space = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func appendFragment(fragments []Fragment, text string, match bool) []Fragment {
+	text = collapseSpace(text)
+	if text == "" {
+		return fragments
+	}
+	return append(fragments, Fragment{Text: text, Match: match})
+}
+
+// snippet returns an excerpt of text around the first word matching any of
+// clauses, with the matching words marked.
+func snippet(text string, clauses []clause) []Fragment {
+	tokens := tokenize(text)
+
+	isMatch := func(t Token) bool {
+		for _, c := range clauses {
+			if c.matches(t) {
+				return true
+			}
+		}
+		return false
+	}
+
+	first := 0
+	for i, t := range tokens {
+		if isMatch(t) {
+			first = i
+			break
+		}
+	}
+
+	lo := first - snippetBefore
+	if lo < 0 {
+		lo = 0
+	}
+	hi := first + snippetAfter
+	if hi > len(tokens) {
+		hi = len(tokens)
+	}
+
+	var fragments []Fragment
+	if lo > 0 {
+		fragments = append(fragments, Fragment{Text: "… "})
+	}
+
+	pos := 0
+	if lo < len(tokens) {
+		pos = tokens[lo].Start
+	}
+	for _, t := range tokens[lo:hi] {
+		if !isMatch(t) {
+			continue
+		}
+		fragments = appendFragment(fragments, text[pos:t.Start], false)
+		fragments = appendFragment(fragments, text[t.Start:t.End], true)
+		pos = t.End
+	}
+
+	end := len(text)
+	if hi < len(tokens) {
+		end = tokens[hi-1].End
+	}
+	fragments = appendFragment(fragments, text[pos:end], false)
+
+	if hi < len(tokens) {
+		fragments = append(fragments, Fragment{Text: " …"})
+	}
+
+	return fragments
+}
@@ -0,0 +1,119 @@
+package search
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+func TestStem(t *testing.T) {
+	cases := map[string]string{
+		"caresses":       "caress",
+		"ponies":         "poni",
+		"cats":           "cat",
+		"feed":           "feed",
+		"agreed":         "agre",
+		"plastered":      "plaster",
+		"motoring":       "motor",
+		"hopping":        "hop",
+		"falling":        "fall",
+		"filing":         "file",
+		"happy":          "happi",
+		"relational":     "relat",
+		"conditional":    "condit",
+		"digitizer":      "digit",
+		"generalization": "gener",
+		"hopefulness":    "hope",
+		"electrical":     "electr",
+		"adjustment":     "adjust",
+		"adoption":       "adopt",
+		"controlling":    "control",
+		"rate":           "rate",
+		"running":        "run",
+		"runs":           "run",
+		"x86":            "x86",
+	}
+
+	for word, expected := range cases {
+		if stem := Stem(word); stem != expected {
+			t.Errorf("Stem(%#v) = %#v, want %#v", word, stem, expected)
+		}
+	}
+}
+
+func testIndex() *Index {
+	idx := NewIndex()
+	idx.Add(Document{Path: "/a", Knowledge: "k1", Text: "The quick brown fox jumps over the lazy dog."})
+	idx.Add(Document{Path: "/b", Knowledge: "k2", Text: "Foxes are running.\nA brown dog sleeps; the dog runs."})
+	idx.Add(Document{Path: "/c", Title: "Computation", Text: "Computation"})
+	return idx
+}
+
+func TestSearchStemmed(t *testing.T) {
+	results := testIndex().Search("fox", 0)
+	if len(results) != 2 {
+		t.Fatalf("results = %#v", results)
+	}
+
+	results = testIndex().Search("dog run", 0)
+	if len(results) != 1 || results[0].Path != "/b" {
+		t.Errorf("results = %#v", results)
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	results := testIndex().Search("dog", 0)
+	if len(results) != 2 || results[0].Path != "/b" || results[1].Path != "/a" {
+		t.Errorf("results = %#v", results)
+	}
+}
+
+func TestSearchPhrase(t *testing.T) {
+	results := testIndex().Search(`"brown dog"`, 0)
+	if len(results) != 1 || results[0].Path != "/b" {
+		t.Errorf("results = %#v", results)
+	}
+
+	results = testIndex().Search(`"dog brown"`, 0)
+	if len(results) != 0 {
+		t.Errorf("results = %#v", results)
+	}
+}
+
+func TestSearchPrefix(t *testing.T) {
+	results := testIndex().Search("comp*", 0)
+	if len(results) != 1 || results[0].Path != "/c" || results[0].Title != "Computation" {
+		t.Errorf("results = %#v", results)
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	results := testIndex().Search("lazy", 0)
+	if len(results) != 1 {
+		t.Fatalf("results = %#v", results)
+	}
+
+	snippet := results[0].Snippet
+	if len(snippet) != 3 || snippet[0].Text != "The quick brown fox jumps over the " || !snippet[1].Match || snippet[1].Text != "lazy" || snippet[2].Text != " dog." {
+		t.Errorf("snippet = %#v", snippet)
+	}
+}
+
+func TestIndexGob(t *testing.T) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(testIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var idx Index
+	err = gob.NewDecoder(&b).Decode(&idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := idx.Search("dog", 0)
+	if idx.Len() != 3 || len(results) != 2 || results[0].Path != "/b" || results[1].Path != "/a" {
+		t.Errorf("results = %#v", results)
+	}
+}
@@ -0,0 +1,350 @@
+package search
+
+// Stem reduces a lowercase English word to its stem using the Porter
+// stemming algorithm.
+func Stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word
+		}
+	}
+
+	s := &stemmer{b: []byte(word)}
+	s.step1ab()
+	s.step1c()
+	s.step2()
+	s.step3()
+	s.step4()
+	s.step5()
+	return string(s.b)
+}
+
+type stemmer struct {
+	b []byte
+	j int
+}
+
+func (s *stemmer) cons(i int) bool {
+	switch s.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		if i == 0 {
+			return true
+		}
+		return !s.cons(i - 1)
+	}
+	return true
+}
+
+// m measures the number of consonant sequences in b[0:j+1].
+func (s *stemmer) m() int {
+	n := 0
+	i := 0
+	for {
+		if i > s.j {
+			return n
+		}
+		if !s.cons(i) {
+			break
+		}
+		i++
+	}
+	i++
+	for {
+		for {
+			if i > s.j {
+				return n
+			}
+			if s.cons(i) {
+				break
+			}
+			i++
+		}
+		i++
+		n++
+		for {
+			if i > s.j {
+				return n
+			}
+			if !s.cons(i) {
+				break
+			}
+			i++
+		}
+		i++
+	}
+}
+
+func (s *stemmer) vowelInStem() bool {
+	for i := 0; i <= s.j; i++ {
+		if !s.cons(i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *stemmer) doubleC(i int) bool {
+	if i < 1 || s.b[i] != s.b[i-1] {
+		return false
+	}
+	return s.cons(i)
+}
+
+// cvc is true if b[i-2:i+1] is consonant-vowel-consonant and the last
+// consonant is not w, x or y.
+func (s *stemmer) cvc(i int) bool {
+	if i < 2 || !s.cons(i) || s.cons(i-1) || !s.cons(i-2) {
+		return false
+	}
+	switch s.b[i] {
+	case 'w', 'x', 'y':
+		return false
+	}
+	return true
+}
+
+func (s *stemmer) ends(suffix string) bool {
+	k := len(s.b) - 1
+	if len(suffix) > k+1 {
+		return false
+	}
+	if string(s.b[k+1-len(suffix):]) != suffix {
+		return false
+	}
+	s.j = k - len(suffix)
+	return true
+}
+
+func (s *stemmer) setTo(replacement string) {
+	s.b = append(s.b[:s.j+1], replacement...)
+}
+
+func (s *stemmer) r(replacement string) {
+	if s.m() > 0 {
+		s.setTo(replacement)
+	}
+}
+
+func (s *stemmer) step1ab() {
+	if s.b[len(s.b)-1] == 's' {
+		if s.ends("sses") {
+			s.b = s.b[:len(s.b)-2]
+		} else if s.ends("ies") {
+			s.setTo("i")
+		} else if len(s.b) > 1 && s.b[len(s.b)-2] != 's' {
+			s.b = s.b[:len(s.b)-1]
+		}
+	}
+
+	if s.ends("eed") {
+		if s.m() > 0 {
+			s.b = s.b[:len(s.b)-1]
+		}
+	} else if (s.ends("ed") || s.ends("ing")) && s.vowelInStem() {
+		s.b = s.b[:s.j+1]
+		k := len(s.b) - 1
+		if s.ends("at") {
+			s.setTo("ate")
+		} else if s.ends("bl") {
+			s.setTo("ble")
+		} else if s.ends("iz") {
+			s.setTo("ize")
+		} else if s.doubleC(k) {
+			switch s.b[k] {
+			case 'l', 's', 'z':
+			default:
+				s.b = s.b[:k]
+			}
+		} else {
+			s.j = k
+			if s.m() == 1 && s.cvc(k) {
+				s.b = append(s.b, 'e')
+			}
+		}
+	}
+}
+
+func (s *stemmer) step1c() {
+	if s.ends("y") && s.vowelInStem() {
+		s.b[len(s.b)-1] = 'i'
+	}
+}
+
+func (s *stemmer) step2() {
+	if len(s.b) < 2 {
+		return
+	}
+	switch s.b[len(s.b)-2] {
+	case 'a':
+		if s.ends("ational") {
+			s.r("ate")
+		} else if s.ends("tional") {
+			s.r("tion")
+		}
+	case 'c':
+		if s.ends("enci") {
+			s.r("ence")
+		} else if s.ends("anci") {
+			s.r("ance")
+		}
+	case 'e':
+		if s.ends("izer") {
+			s.r("ize")
+		}
+	case 'l':
+		if s.ends("bli") {
+			s.r("ble")
+		} else if s.ends("alli") {
+			s.r("al")
+		} else if s.ends("entli") {
+			s.r("ent")
+		} else if s.ends("eli") {
+			s.r("e")
+		} else if s.ends("ousli") {
+			s.r("ous")
+		}
+	case 'o':
+		if s.ends("ization") {
+			s.r("ize")
+		} else if s.ends("ation") {
+			s.r("ate")
+		} else if s.ends("ator") {
+			s.r("ate")
+		}
+	case 's':
+		if s.ends("alism") {
+			s.r("al")
+		} else if s.ends("iveness") {
+			s.r("ive")
+		} else if s.ends("fulness") {
+			s.r("ful")
+		} else if s.ends("ousness") {
+			s.r("ous")
+		}
+	case 't':
+		if s.ends("aliti") {
+			s.r("al")
+		} else if s.ends("iviti") {
+			s.r("ive")
+		} else if s.ends("biliti") {
+			s.r("ble")
+		}
+	case 'g':
+		if s.ends("logi") {
+			s.r("log")
+		}
+	}
+}
+
+func (s *stemmer) step3() {
+	switch s.b[len(s.b)-1] {
+	case 'e':
+		if s.ends("icate") {
+			s.r("ic")
+		} else if s.ends("ative") {
+			s.r("")
+		} else if s.ends("alize") {
+			s.r("al")
+		}
+	case 'i':
+		if s.ends("iciti") {
+			s.r("ic")
+		}
+	case 'l':
+		if s.ends("ical") {
+			s.r("ic")
+		} else if s.ends("ful") {
+			s.r("")
+		}
+	case 's':
+		if s.ends("ness") {
+			s.r("")
+		}
+	}
+}
+
+func (s *stemmer) step4() {
+	if len(s.b) < 2 {
+		return
+	}
+	switch s.b[len(s.b)-2] {
+	case 'a':
+		if !s.ends("al") {
+			return
+		}
+	case 'c':
+		if !s.ends("ance") && !s.ends("ence") {
+			return
+		}
+	case 'e':
+		if !s.ends("er") {
+			return
+		}
+	case 'i':
+		if !s.ends("ic") {
+			return
+		}
+	case 'l':
+		if !s.ends("able") && !s.ends("ible") {
+			return
+		}
+	case 'n':
+		if !s.ends("ant") && !s.ends("ement") && !s.ends("ment") && !s.ends("ent") {
+			return
+		}
+	case 'o':
+		if s.ends("ion") && s.j >= 0 && (s.b[s.j] == 's' || s.b[s.j] == 't') {
+			break
+		}
+		if !s.ends("ou") {
+			return
+		}
+	case 's':
+		if !s.ends("ism") {
+			return
+		}
+	case 't':
+		if !s.ends("ate") && !s.ends("iti") {
+			return
+		}
+	case 'u':
+		if !s.ends("ous") {
+			return
+		}
+	case 'v':
+		if !s.ends("ive") {
+			return
+		}
+	case 'z':
+		if !s.ends("ize") {
+			return
+		}
+	default:
+		return
+	}
+	if s.m() > 1 {
+		s.b = s.b[:s.j+1]
+	}
+}
+
+func (s *stemmer) step5() {
+	s.j = len(s.b) - 1
+	k := s.j
+	if s.b[k] == 'e' {
+		s.j = k - 1
+		a := s.m()
+		if a > 1 || (a == 1 && !s.cvc(k-1)) {
+			s.b = s.b[:k]
+		}
+	}
+	k = len(s.b) - 1
+	s.j = k
+	if s.b[k] == 'l' && s.doubleC(k) && s.m() > 1 {
+		s.b = s.b[:k]
+	}
+}
@@ -0,0 +1,65 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Token is a word in a text, with its stem and byte offsets.
+type Token struct {
+	Word  string
+	Stem  string
+	Start int
+	End   int
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// tokenize splits text into lowercase words, recording each word's stem and
+// its byte offsets within text.
+func tokenize(text string) []Token {
+	var tokens []Token
+
+	start := -1
+	for i := 0; i <= len(text); {
+		r, size := utf8.RuneError, 1
+		if i < len(text) {
+			r, size = utf8.DecodeRuneInString(text[i:])
+		}
+
+		if i < len(text) && isWordRune(r) {
+			if start == -1 {
+				start = i
+			}
+		} else if start != -1 {
+			word := strings.ToLower(text[start:i])
+			tokens = append(tokens, Token{
+				Word:  word,
+				Stem:  Stem(word),
+				Start: start,
+				End:   i,
+			})
+			start = -1
+		}
+
+		i += size
+	}
+
+	return tokens
+}
+
+// Analysis is a tokenized text, ready to be added to an Index.
+type Analysis struct {
+	Text   string
+	Tokens []Token
+}
+
+func Analyze(text string) Analysis {
+	return Analysis{
+		Text:   text,
+		Tokens: tokenize(text),
+	}
+}
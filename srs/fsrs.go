@@ -0,0 +1,78 @@
+package srs
+
+import (
+	"math"
+	"time"
+)
+
+// fsrsWeights are the default parameters of FSRS-4.5.
+var fsrsWeights = [17]float64{
+	0.4872, 1.4003, 3.7145, 13.8206, 5.1618, 1.2298, 0.8975, 0.031,
+	1.6474, 0.1367, 1.0461, 2.1072, 0.0793, 0.3246, 1.587, 0.2272, 2.8755,
+}
+
+const (
+	fsrsDecay           = -0.5
+	fsrsFactor          = 19.0 / 81.0
+	fsrsTargetRetention = 0.9
+	fsrsMaximumInterval = 36500
+)
+
+// fsrsRetrievability is the probability of recalling a card with stability
+// stability after elapsed days.
+func fsrsRetrievability(elapsed float64, stability float64) float64 {
+	return math.Pow(1+fsrsFactor*elapsed/stability, fsrsDecay)
+}
+
+func fsrsInitialDifficulty(g Grade) float64 {
+	w := fsrsWeights
+	return clamp(w[4]-float64(g-Good)*w[5], 1, 10)
+}
+
+func clamp(x float64, lo float64, hi float64) float64 {
+	return math.Min(hi, math.Max(lo, x))
+}
+
+// scheduleFSRS implements the Free Spaced Repetition Scheduler, version 4.5.
+func scheduleFSRS(s State, g Grade, now time.Time) State {
+	w := fsrsWeights
+
+	if s.New() || s.Stability == 0 {
+		s.Stability = w[g-1]
+		s.Difficulty = fsrsInitialDifficulty(g)
+	} else {
+		elapsed := math.Max(0, inDays(now.Sub(s.LastReview)))
+		r := fsrsRetrievability(elapsed, s.Stability)
+		d := s.Difficulty
+
+		if g == Again {
+			s.Stability = w[11] * math.Pow(d, -w[12]) * (math.Pow(s.Stability+1, w[13]) - 1) * math.Exp(w[14]*(1-r))
+		} else {
+			bonus := 1.0
+			if g == Hard {
+				bonus = w[15]
+			} else if g == Easy {
+				bonus = w[16]
+			}
+			s.Stability *= 1 + math.Exp(w[8])*(11-d)*math.Pow(s.Stability, -w[9])*(math.Exp(w[10]*(1-r))-1)*bonus
+		}
+
+		// Difficulty reverts towards the initial difficulty of Easy.
+		d -= w[6] * float64(g-Good)
+		s.Difficulty = clamp(w[7]*fsrsInitialDifficulty(Easy)+(1-w[7])*d, 1, 10)
+	}
+
+	if g == Again {
+		if s.Reps > 0 {
+			s.Lapses++
+		}
+		s.Reps = 0
+		s.Interval = 0
+		return s
+	}
+
+	interval := s.Stability / fsrsFactor * (math.Pow(fsrsTargetRetention, 1/fsrsDecay) - 1)
+	s.Reps++
+	s.Interval = days(clamp(math.Round(interval), 1, fsrsMaximumInterval))
+	return s
+}
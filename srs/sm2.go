@@ -0,0 +1,54 @@
+package srs
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	sm2InitialEase = 2.5
+	sm2MinimumEase = 1.3
+)
+
+// scheduleSM2 implements SuperMemo 2 with Anki's four grades: Hard grows the
+// interval slowly and Easy grows it by an extra bonus.
+func scheduleSM2(s State, g Grade, now time.Time) State {
+	if s.Ease == 0 {
+		s.Ease = sm2InitialEase
+	}
+
+	interval := inDays(s.Interval)
+
+	switch g {
+	case Again:
+		if s.Reps > 0 {
+			s.Lapses++
+		}
+		s.Reps = 0
+		s.Ease = math.Max(sm2MinimumEase, s.Ease-0.2)
+		s.Interval = 0
+		return s
+
+	case Hard:
+		interval = math.Max(1, interval*1.2)
+		s.Ease = math.Max(sm2MinimumEase, s.Ease-0.15)
+
+	case Good, Easy:
+		switch s.Reps {
+		case 0:
+			interval = 1
+		case 1:
+			interval = 6
+		default:
+			interval = interval * s.Ease
+		}
+		if g == Easy {
+			interval *= 1.3
+			s.Ease += 0.15
+		}
+	}
+
+	s.Reps++
+	s.Interval = days(math.Round(math.Max(1, interval)))
+	return s
+}
@@ -0,0 +1,243 @@
+package srs
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+var start = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func TestSM2(t *testing.T) {
+	var s State
+	now := start
+
+	var intervals []float64
+	for _, g := range []Grade{Good, Good, Good, Again, Good} {
+		s = schedule(SM2, s, g, now)
+		intervals = append(intervals, inDays(s.Interval))
+		now = s.Due
+	}
+
+	if intervals[0] != 1 || intervals[1] != 6 || intervals[2] != 15 || intervals[3] != 0 || intervals[4] != 1 {
+		t.Errorf("intervals = %#v", intervals)
+	}
+	if s.Lapses != 1 || s.Ease != 2.3 {
+		t.Errorf("s = %#v", s)
+	}
+}
+
+func TestFSRS(t *testing.T) {
+	var s State
+	now := start
+
+	s = schedule(FSRS, s, Good, now)
+	if inDays(s.Interval) != 4 || s.Difficulty != fsrsInitialDifficulty(Good) {
+		t.Errorf("s = %#v", s)
+	}
+
+	previous := s.Interval
+	now = s.Due
+	s = schedule(FSRS, s, Good, now)
+	if s.Interval <= previous {
+		t.Errorf("s.Interval = %v, previous = %v", s.Interval, previous)
+	}
+
+	now = s.Due
+	lapsed := schedule(FSRS, s, Again, now)
+	if lapsed.Stability >= s.Stability || lapsed.Lapses != 1 || !lapsed.Due.Equal(now.Add(relearnDelay)) {
+		t.Errorf("lapsed = %#v", lapsed)
+	}
+}
+
+func TestFSRSDifficulty(t *testing.T) {
+	// Reference values from FSRS-4.5 with the default weights.
+	tests := []struct {
+		g    Grade
+		want float64
+	}{
+		{Again, 6.706247},
+		{Hard, 5.836569},
+		{Good, 4.966892},
+		{Easy, 4.097214},
+	}
+	for _, test := range tests {
+		s := State{Stability: 10, Difficulty: 5, Reps: 3, LastReview: start}
+		s = schedule(FSRS, s, test.g, start.AddDate(0, 0, 10))
+		if math.Abs(s.Difficulty-test.want) > 1e-6 {
+			t.Errorf("%v: s.Difficulty = %v, want %v", test.g, s.Difficulty, test.want)
+		}
+	}
+}
+
+func tempStore(t *testing.T) (string, *Store) {
+	dir, err := ioutil.TempDir("", "srs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, s
+}
+
+func TestStoreReplay(t *testing.T) {
+	dir, s := tempStore(t)
+	defer os.RemoveAll(dir)
+
+	s.SetAlgorithm("/lang", FSRS)
+	s.Review("a", "/math", Good, start, 0)
+	s.Review("b", "/lang/fr", Good, start, 0)
+	s.Review("a", "/math", Good, start.Add(24*time.Hour), 0)
+	s.Close()
+
+	f, _ := os.OpenFile(filepath.Join(dir, reviewsFile), os.O_WRONLY|os.O_APPEND, 0666)
+	f.Write([]byte(`{"Seq":4,"Card":"a"`))
+	f.Close()
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	a, ok := s.State("a")
+	if !ok || len(a.Log) != 2 || a.Reps != 2 || inDays(a.Interval) != 6 || a.Log[0].Algorithm != SM2 {
+		t.Errorf("a = %#v", a)
+	}
+	b, ok := s.State("b")
+	if !ok || len(b.Log) != 1 || b.Log[0].Algorithm != FSRS {
+		t.Errorf("b = %#v", b)
+	}
+
+	if _, err := s.Review("a", "/math", Good, start.Add(7*24*time.Hour), 0); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := s.State("a"); len(a.Log) != 3 {
+		t.Errorf("a = %#v", a)
+	}
+}
+
+func TestStoreCompact(t *testing.T) {
+	dir, s := tempStore(t)
+	defer os.RemoveAll(dir)
+
+	s.Review("a", "/", Good, start, 0)
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	s.Review("a", "/", Easy, start.Add(24*time.Hour), 0)
+	s.Close()
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	a, _ := s.State("a")
+	if len(a.Log) != 2 || a.Log[1].Grade != Easy || a.Reps != 2 {
+		t.Errorf("a = %#v", a)
+	}
+
+	due := s.Due(start.Add(365 * 24 * time.Hour))
+	if len(due) != 1 || due[0] != "a" {
+		t.Errorf("due = %#v", due)
+	}
+	if due := s.Due(start); len(due) != 0 {
+		t.Errorf("due = %#v", due)
+	}
+}
+
+func TestRenameCard(t *testing.T) {
+	dir, s := tempStore(t)
+	defer os.RemoveAll(dir)
+
+	s.Review("a", "/math", Good, start, 0)
+	s.Review("a/reverse", "/math", Good, start, 0)
+	s.Review("ab", "/math", Good, start, 0)
+	s.Review("b/reverse", "/math", Good, start, 0)
+	if err := s.RenameCard("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if b, ok := s.State("b"); !ok || len(b.Log) != 1 {
+		t.Errorf("b = %#v", b)
+	}
+	if _, ok := s.State("a"); ok {
+		t.Errorf("a was not moved")
+	}
+	// b/reverse already had a state, so a/reverse stays put.
+	if _, ok := s.State("a/reverse"); !ok {
+		t.Errorf("a/reverse was moved")
+	}
+	if _, ok := s.State("ab"); !ok {
+		t.Errorf("ab was moved")
+	}
+
+	orphans := s.Orphans(map[wikidata.CardId]bool{"b": true, "ab": true})
+	if len(orphans) != 1 || orphans[0] != "a/reverse" {
+		t.Errorf("orphans = %#v", orphans)
+	}
+}
+
+func TestAlgorithm(t *testing.T) {
+	dir, s := tempStore(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	s.SetAlgorithm("/", FSRS)
+	s.SetAlgorithm("/foo", SM2)
+
+	if a := s.Algorithm("/foo/bar"); a != SM2 {
+		t.Errorf("Algorithm(/foo/bar) = %v", a)
+	}
+	if a := s.Algorithm("/foobar"); a != FSRS {
+		t.Errorf("Algorithm(/foobar) = %v", a)
+	}
+	if err := s.SetAlgorithm("/", "nonsense"); err != BadAlgorithmError {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestStatistics(t *testing.T) {
+	dir, s := tempStore(t)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+
+	s.Review("a", "/x", Good, start, 10*time.Second)
+	s.Review("a", "/x", Again, start.Add(24*time.Hour), 20*time.Second)
+	s.Review("b", "/y", Good, start.Add(24*time.Hour), 0)
+
+	now := start.Add(24 * time.Hour)
+	stats := s.Statistics(now, map[wikidata.CardId]string{"a": "/x", "b": "/y", "c": "/y"})
+
+	if stats.TotalReviews != 3 || stats.AverageSeconds != 15 {
+		t.Errorf("stats = %#v", stats)
+	}
+	if last := stats.Reviews[len(stats.Reviews)-1]; last.Day != "2020-01-02" || last.Count != 2 || last.Level != 4 {
+		t.Errorf("last = %#v", last)
+	}
+	if r := stats.Retention[1]; r.Reviews != 1 || r.Recalled != 0 {
+		t.Errorf("stats.Retention = %#v", stats.Retention)
+	}
+	if stats.Forecast[0].Count != 1 || stats.Forecast[1].Count != 1 {
+		t.Errorf("stats.Forecast = %#v", stats.Forecast)
+	}
+	if len(stats.Pages) != 2 || stats.Pages[0].Learning != 1 || stats.Pages[1].New != 1 || stats.Pages[1].Young != 1 {
+		t.Errorf("stats.Pages = %#v", stats.Pages)
+	}
+}
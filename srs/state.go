@@ -0,0 +1,124 @@
+package srs
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	BadGradeError     error = errors.New("srs: grade must be between Again and Easy")
+	BadAlgorithmError error = errors.New("srs: unknown scheduling algorithm")
+)
+
+// Grade is how well a card was recalled.
+type Grade int
+
+const (
+	Again Grade = iota + 1
+	Hard
+	Good
+	Easy
+)
+
+func (g Grade) Valid() bool {
+	return g >= Again && g <= Easy
+}
+
+func (g Grade) String() string {
+	switch g {
+	case Again:
+		return "again"
+	case Hard:
+		return "hard"
+	case Good:
+		return "good"
+	case Easy:
+		return "easy"
+	}
+	return fmt.Sprintf("grade(%d)", int(g))
+}
+
+// Algorithm names a scheduler.
+type Algorithm string
+
+const (
+	SM2  Algorithm = "sm2"
+	FSRS Algorithm = "fsrs"
+
+	DefaultAlgorithm = SM2
+)
+
+func (a Algorithm) Valid() bool {
+	return a == SM2 || a == FSRS
+}
+
+// relearnDelay is how soon a card graded Again is shown again.
+const relearnDelay = 10 * time.Minute
+
+// Review is one entry of a card's review log.
+type Review struct {
+	Time      time.Time
+	Grade     Grade
+	Algorithm Algorithm
+	// Interval is the time until the card was next due, as scheduled by
+	// this review.
+	Interval time.Duration
+	// Duration is how long the answer took, or zero if unknown.
+	Duration time.Duration
+}
+
+// State is the scheduling state of a card. A card which has never been
+// reviewed has the zero State and is due immediately.
+type State struct {
+	Due        time.Time
+	Interval   time.Duration
+	LastReview time.Time
+	Reps       int
+	Lapses     int
+
+	// Ease is used by SM-2.
+	Ease float64
+	// Stability and Difficulty are used by FSRS.
+	Stability  float64
+	Difficulty float64
+
+	Log []Review
+}
+
+func (s State) New() bool {
+	return s.LastReview.IsZero()
+}
+
+func (s State) IsDue(now time.Time) bool {
+	return !s.Due.After(now)
+}
+
+func days(n float64) time.Duration {
+	return time.Duration(n * float64(24*time.Hour))
+}
+
+func inDays(d time.Duration) float64 {
+	return float64(d) / float64(24*time.Hour)
+}
+
+// schedule returns the state of a card after it is graded g at now.
+func schedule(alg Algorithm, s State, g Grade, now time.Time) State {
+	next := s
+	next.Log = nil
+
+	switch alg {
+	case FSRS:
+		next = scheduleFSRS(next, g, now)
+	default:
+		next = scheduleSM2(next, g, now)
+	}
+
+	next.LastReview = now
+	next.Due = now.Add(next.Interval)
+	if g == Again {
+		next.Due = now.Add(relearnDelay)
+	}
+
+	return next
+}
@@ -0,0 +1,192 @@
+package srs
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+const (
+	heatmapDays  = 365
+	forecastDays = 30
+
+	// matureInterval is the interval from which a card counts as mature.
+	matureInterval = 21 * 24 * time.Hour
+)
+
+type DayCount struct {
+	Day   string
+	Count int
+	// Level is Count relative to the busiest day, from 0 to 4.
+	Level int
+}
+
+// RetentionBucket counts the reviews of cards whose previous interval was at
+// least MinDays and less than MaxDays (MaxDays is 0 for the last bucket).
+type RetentionBucket struct {
+	MinDays  int
+	MaxDays  int
+	Reviews  int
+	Recalled int
+	Rate     float64
+}
+
+// PageMaturity counts the cards on a page by how well they are known. Cards
+// are learning until their interval reaches a day, young until it reaches
+// matureInterval and mature after that.
+type PageMaturity struct {
+	Path     string
+	New      int
+	Learning int
+	Young    int
+	Mature   int
+}
+
+type Statistics struct {
+	TotalReviews   int
+	AverageSeconds float64
+	Reviews        []DayCount
+	Retention      []RetentionBucket
+	Forecast       []DayCount
+	Pages          []PageMaturity
+}
+
+var retentionBuckets = [][2]int{{0, 1}, {1, 7}, {7, 21}, {21, 90}, {90, 0}}
+
+func dayKey(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// setLevels fills in the Level of every day relative to the busiest one.
+func setLevels(days []DayCount) {
+	max := 0
+	for _, d := range days {
+		if d.Count > max {
+			max = d.Count
+		}
+	}
+	for i := range days {
+		if days[i].Count > 0 {
+			days[i].Level = 1 + 3*days[i].Count/max
+			if days[i].Level > 4 {
+				days[i].Level = 4
+			}
+		}
+	}
+}
+
+// Statistics summarizes the review log as of now. pages maps the id of every
+// card currently in the wiki to the page it is on; it determines which cards
+// count as new and how cards are grouped by page.
+func (s *Store) Statistics(now time.Time, pages map[wikidata.CardId]string) Statistics {
+	states := s.States()
+	today := startOfDay(now)
+
+	var stats Statistics
+
+	reviewsPerDay := make(map[string]int)
+	var totalDuration time.Duration
+	timed := 0
+	buckets := make([]RetentionBucket, len(retentionBuckets))
+	for i, b := range retentionBuckets {
+		buckets[i].MinDays, buckets[i].MaxDays = b[0], b[1]
+	}
+
+	for _, state := range states {
+		for i, r := range state.Log {
+			stats.TotalReviews++
+			reviewsPerDay[dayKey(r.Time.In(now.Location()))]++
+
+			if r.Duration > 0 {
+				totalDuration += r.Duration
+				timed++
+			}
+
+			if i == 0 {
+				continue
+			}
+			previous := inDays(state.Log[i-1].Interval)
+			for j, b := range retentionBuckets {
+				if previous >= float64(b[0]) && (b[1] == 0 || previous < float64(b[1])) {
+					buckets[j].Reviews++
+					if r.Grade != Again {
+						buckets[j].Recalled++
+					}
+					break
+				}
+			}
+		}
+	}
+
+	if timed > 0 {
+		stats.AverageSeconds = (totalDuration / time.Duration(timed)).Seconds()
+	}
+
+	for i := range buckets {
+		if buckets[i].Reviews > 0 {
+			buckets[i].Rate = float64(buckets[i].Recalled) / float64(buckets[i].Reviews)
+		}
+	}
+	stats.Retention = buckets
+
+	for i := heatmapDays - 1; i >= 0; i-- {
+		day := dayKey(today.AddDate(0, 0, -i))
+		stats.Reviews = append(stats.Reviews, DayCount{Day: day, Count: reviewsPerDay[day]})
+	}
+	setLevels(stats.Reviews)
+
+	forecast := make([]DayCount, forecastDays)
+	for i := range forecast {
+		forecast[i].Day = dayKey(today.AddDate(0, 0, i))
+	}
+	byPage := make(map[string]*PageMaturity)
+
+	for cid, path := range pages {
+		pm, ok := byPage[path]
+		if !ok {
+			pm = &PageMaturity{Path: path}
+			byPage[path] = pm
+		}
+
+		state, ok := states[cid]
+		switch {
+		case !ok:
+			pm.New++
+			continue
+		case state.Interval < 24*time.Hour:
+			pm.Learning++
+		case state.Interval < matureInterval:
+			pm.Young++
+		default:
+			pm.Mature++
+		}
+
+		// Overdue cards are due today.
+		day := int(math.Round(startOfDay(state.Due).Sub(today).Hours() / 24))
+		if day < 0 {
+			day = 0
+		}
+		if day < forecastDays {
+			forecast[day].Count++
+		}
+	}
+
+	setLevels(forecast)
+	stats.Forecast = forecast
+
+	for _, pm := range byPage {
+		stats.Pages = append(stats.Pages, *pm)
+	}
+	sort.Slice(stats.Pages, func(i, j int) bool {
+		return stats.Pages[i].Path < stats.Pages[j].Path
+	})
+
+	return stats
+}
@@ -0,0 +1,520 @@
+package srs
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+const (
+	stateFile   = "state.json"
+	reviewsFile = "reviews.log"
+	decksFile   = "decks.json"
+	// reconciledFile holds the commit whose cards the states were last
+	// reconciled with.
+	reconciledFile = "reconciled"
+
+	// compactThreshold is the number of records appended to the review log
+	// after which it is folded into the state file.
+	compactThreshold = 1000
+)
+
+// record is a line of the review log. State is the state of Card after
+// Review, without its log. A record with From set instead moves the state of
+// From, log and all, to Card, and one with Import set gives Card the State it
+// carries, log included.
+type record struct {
+	Seq    uint64
+	Card   wikidata.CardId
+	From   wikidata.CardId `json:",omitempty"`
+	Import bool            `json:",omitempty"`
+	Review Review
+	State  State
+}
+
+type persistedState struct {
+	Seq    uint64
+	States map[wikidata.CardId]State
+}
+
+// Store keeps the review state of every card in a directory. Reviews are
+// appended to a log which is synced before Review returns, so a crash loses
+// at most a review in progress. The log is periodically compacted into a
+// state file.
+type Store struct {
+	lock   sync.Mutex
+	dir    string
+	log    *os.File
+	seq    uint64
+	since  int
+	states map[wikidata.CardId]State
+	decks  map[string]Algorithm
+}
+
+func Open(dir string) (*Store, error) {
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		dir:    dir,
+		states: make(map[wikidata.CardId]State),
+		decks:  make(map[string]Algorithm),
+	}
+
+	err = readJSON(filepath.Join(dir, decksFile), &s.decks)
+	if err != nil {
+		return nil, err
+	}
+
+	var persisted persistedState
+	err = readJSON(filepath.Join(dir, stateFile), &persisted)
+	if err != nil {
+		return nil, err
+	}
+	s.seq = persisted.Seq
+	for cid, state := range persisted.States {
+		s.states[cid] = state
+	}
+
+	s.log, err = os.OpenFile(filepath.Join(dir, reviewsFile), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.replay()
+	if err != nil {
+		s.log.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func readJSON(path string, v interface{}) error {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmppath := path + ".tmp"
+	f, err := os.Create(tmppath)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmppath)
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		os.Remove(tmppath)
+		return err
+	}
+
+	return os.Rename(tmppath, path)
+}
+
+// replay applies the records of the review log which are newer than the
+// state file. A record cut short by a crash is discarded, along with
+// anything after it.
+func (s *Store) replay() error {
+	r := bufio.NewReader(s.log)
+	var offset int64
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Println(s.dir, "- discarding incomplete review record")
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			log.Println(s.dir, "- discarding corrupt review log from offset", offset, "-", err)
+			break
+		}
+		offset += int64(len(line))
+
+		if rec.Seq <= s.seq {
+			continue
+		}
+		s.apply(rec)
+	}
+
+	err := s.log.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	_, err = s.log.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (s *Store) apply(rec record) {
+	if rec.Import {
+		s.states[rec.Card] = rec.State
+		s.seq = rec.Seq
+		s.since++
+		return
+	}
+
+	if rec.From != "" {
+		if state, ok := s.states[rec.From]; ok {
+			s.states[rec.Card] = state
+			delete(s.states, rec.From)
+		}
+		s.seq = rec.Seq
+		s.since++
+		return
+	}
+
+	prev := s.states[rec.Card]
+	next := rec.State
+	next.Log = append(append([]Review(nil), prev.Log...), rec.Review)
+	s.states[rec.Card] = next
+	s.seq = rec.Seq
+	s.since++
+}
+
+// Algorithm returns the scheduler of the deck containing the page at path.
+// A deck is a page subtree; the deepest deck containing path wins.
+func (s *Store) Algorithm(path string) Algorithm {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.algorithm(path)
+}
+
+func (s *Store) algorithm(path string) Algorithm {
+	best, alg := -1, DefaultAlgorithm
+	for deck, a := range s.decks {
+		if deck != "/" && path != deck && !strings.HasPrefix(path, deck+"/") {
+			continue
+		}
+		if len(deck) > best {
+			best, alg = len(deck), a
+		}
+	}
+	return alg
+}
+
+// SetAlgorithm selects the scheduler for the page subtree at deck.
+func (s *Store) SetAlgorithm(deck string, alg Algorithm) error {
+	if !alg.Valid() {
+		return BadAlgorithmError
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	decks := make(map[string]Algorithm)
+	for k, v := range s.decks {
+		decks[k] = v
+	}
+	decks[deck] = alg
+
+	raw, err := json.MarshalIndent(decks, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(filepath.Join(s.dir, decksFile), raw)
+	if err != nil {
+		return err
+	}
+
+	s.decks = decks
+	return nil
+}
+
+// Decks returns the scheduler of every deck with one set.
+func (s *Store) Decks() map[string]Algorithm {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	decks := make(map[string]Algorithm)
+	for k, v := range s.decks {
+		decks[k] = v
+	}
+	return decks
+}
+
+// State returns the state of cid. ok is false if cid has never been reviewed.
+func (s *Store) State(cid wikidata.CardId) (State, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	state, ok := s.states[cid]
+	return state, ok
+}
+
+// States returns the state of every card which has been reviewed.
+func (s *Store) States() map[wikidata.CardId]State {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	states := make(map[wikidata.CardId]State, len(s.states))
+	for k, v := range s.states {
+		states[k] = v
+	}
+	return states
+}
+
+// Due returns the reviewed cards which are due at now, most overdue first.
+func (s *Store) Due(now time.Time) []wikidata.CardId {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var due []wikidata.CardId
+	for cid, state := range s.states {
+		if state.IsDue(now) {
+			due = append(due, cid)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		di, dj := s.states[due[i]].Due, s.states[due[j]].Due
+		if !di.Equal(dj) {
+			return di.Before(dj)
+		}
+		return due[i] < due[j]
+	})
+	return due
+}
+
+// Review records that cid, a card on the page at path, was graded g at now
+// after taking took to answer, and returns its new state.
+func (s *Store) Review(cid wikidata.CardId, path string, g Grade, now time.Time, took time.Duration) (State, error) {
+	if !g.Valid() {
+		return State{}, BadGradeError
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	alg := s.algorithm(path)
+	next := schedule(alg, s.states[cid], g, now)
+
+	rec := record{
+		Seq:  s.seq + 1,
+		Card: cid,
+		Review: Review{
+			Time:      now,
+			Grade:     g,
+			Algorithm: alg,
+			Interval:  next.Due.Sub(now),
+			Duration:  took,
+		},
+		State: next,
+	}
+
+	err := s.appendRecord(rec)
+	if err != nil {
+		return State{}, err
+	}
+	s.apply(rec)
+
+	if s.since >= compactThreshold {
+		err = s.compact()
+		if err != nil {
+			log.Println(s.dir, "-", err)
+		}
+	}
+
+	return s.states[cid], nil
+}
+
+// Import gives each item in states the state, including its log, which
+// was kept for it by another program. Items which already have a state are
+// left alone. It returns the number of items imported.
+func (s *Store) Import(states map[wikidata.CardId]State) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var ids []wikidata.CardId
+	for cid := range states {
+		if _, ok := s.states[cid]; !ok {
+			ids = append(ids, cid)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	for i, cid := range ids {
+		rec := record{
+			Seq:    s.seq + 1,
+			Card:   cid,
+			Import: true,
+			State:  states[cid],
+		}
+		err := s.appendRecord(rec)
+		if err != nil {
+			return i, err
+		}
+		s.apply(rec)
+	}
+
+	if s.since >= compactThreshold {
+		err := s.compact()
+		if err != nil {
+			log.Println(s.dir, "-", err)
+		}
+	}
+
+	return len(ids), nil
+}
+
+// RenameCard moves the state of the card from, and of the items reviewed
+// from it such as from/reverse, to the card to. Items which already have a
+// state under to are left alone.
+func (s *Store) RenameCard(from wikidata.CardId, to wikidata.CardId) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var ids []wikidata.CardId
+	for cid := range s.states {
+		if cid == from || strings.HasPrefix(string(cid), string(from)+"/") {
+			ids = append(ids, cid)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	for _, cid := range ids {
+		target := to + cid[len(from):]
+		if _, ok := s.states[target]; ok {
+			log.Println(s.dir, "- not moving", cid, "to", target, "which already has a state")
+			continue
+		}
+
+		rec := record{
+			Seq:  s.seq + 1,
+			Card: target,
+			From: cid,
+		}
+		err := s.appendRecord(rec)
+		if err != nil {
+			return err
+		}
+		s.apply(rec)
+	}
+
+	return nil
+}
+
+// Orphans returns the items with a state whose card is not in live, sorted.
+func (s *Store) Orphans(live map[wikidata.CardId]bool) []wikidata.CardId {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var orphans []wikidata.CardId
+	for cid := range s.states {
+		card := wikidata.CardId(strings.SplitN(string(cid), "/", 2)[0])
+		if !live[card] {
+			orphans = append(orphans, cid)
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i] < orphans[j]
+	})
+	return orphans
+}
+
+// Reconciled returns the commit last passed to SetReconciled, or "" if there
+// is none.
+func (s *Store) Reconciled() (string, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(s.dir, reconciledFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
+
+// SetReconciled records that the states have been reconciled with the cards
+// of commit.
+func (s *Store) SetReconciled(commit string) error {
+	return writeFileAtomic(filepath.Join(s.dir, reconciledFile), []byte(commit+"\n"))
+}
+
+func (s *Store) appendRecord(rec record) error {
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.log.Write(append(raw, '\n'))
+	if err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// Compact folds the review log into the state file.
+func (s *Store) Compact() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.compact()
+}
+
+func (s *Store) compact() error {
+	raw, err := json.Marshal(persistedState{
+		Seq:    s.seq,
+		States: s.states,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(filepath.Join(s.dir, stateFile), raw)
+	if err != nil {
+		return err
+	}
+
+	// Records up to s.seq are now in the state file and would be skipped on
+	// replay, so losing the truncation to a crash is harmless.
+	err = s.log.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = s.log.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	s.since = 0
+	return nil
+}
+
+func (s *Store) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.log.Close()
+}
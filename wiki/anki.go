@@ -0,0 +1,102 @@
+package wiki
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MerryMage/libellus/anki"
+)
+
+// maxAnkiUpload is the largest Anki package which can be imported. Parts of
+// the upload beyond a small in-memory buffer are kept in temporary files.
+const maxAnkiUpload = 512 << 20
+
+type RenderedAnki struct {
+	Path      string
+	CSRFToken string
+	Result    *anki.ImportResult
+	Error     string
+}
+
+func (wiki *Wiki) serveAnki(w http.ResponseWriter, r *http.Request) {
+	if !wiki.config.Authentication.IsAuthenticated(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			path = "/"
+		}
+		wiki.ankiTemplate.Execute(w, RenderedAnki{Path: path, CSRFToken: wiki.config.Authentication.CSRFToken(r)})
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAnkiUpload)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("ParseMultipartForm failure"))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	if !wiki.checkCSRF(w, r) {
+		return
+	}
+
+	path := r.FormValue("path")
+	if path == "" || !validatePath(&path) {
+		wiki.invalidPathResponse(w, r)
+		return
+	}
+
+	f, header, err := r.FormFile("package")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("no package uploaded"))
+		return
+	}
+	defer f.Close()
+
+	rendered := RenderedAnki{Path: path, CSRFToken: wiki.config.Authentication.CSRFToken(r)}
+	result, err := anki.Import(f, header.Size, wiki.config.Repo, wiki.config.WikiData, wiki.config.Srs, path, wiki.signature(r))
+	rendered.Result = &result
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		rendered.Error = err.Error()
+	}
+	wiki.ankiTemplate.Execute(w, rendered)
+}
+
+func (wiki *Wiki) serveAnkiExport(w http.ResponseWriter, r *http.Request) {
+	if !wiki.config.Authentication.IsAuthenticated(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		path = "/"
+	}
+	if !validatePath(&path) {
+		wiki.invalidPathResponse(w, r)
+		return
+	}
+
+	var buf bytes.Buffer
+	err := anki.Export(&buf, wiki.config.WikiData.Snapshot(), wiki.config.Srs, path, time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("export failed: " + err.Error()))
+		return
+	}
+
+	name := "libellus" + strings.Replace(strings.TrimSuffix(path, "/"), "/", "-", -1) + ".apkg"
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Write(buf.Bytes())
+}
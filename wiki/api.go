@@ -0,0 +1,266 @@
+package wiki
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MerryMage/libellus/objstore/objid"
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+// apiPrefix is where version 1 of the JSON API is served. Fields are only
+// ever added within a version.
+const apiPrefix = "/_api/v1/"
+
+type APIRevision struct {
+	Commit string
+	Author string
+	Time   time.Time
+}
+
+type APIPage struct {
+	Path         string
+	Title        string
+	Children     []string
+	Knowledges   []string
+	Created      APIRevision
+	LastModified APIRevision
+}
+
+type APIKnowledge struct {
+	Identifier   string
+	Page         string
+	Info         wikidata.KnowledgeInfo
+	Source       map[string]string
+	Media        []string
+	Cards        []string
+	Created      APIRevision
+	LastModified APIRevision
+}
+
+type APICard struct {
+	Identifier string
+	Knowledge  string
+	Page       string
+	Virtual    bool
+	Card       wikidata.Card
+}
+
+type APIError struct {
+	Error string
+}
+
+func apiRevision(rev wikidata.Revision) APIRevision {
+	if !rev.Valid() {
+		return APIRevision{}
+	}
+	return APIRevision{
+		Commit: rev.Commit.String(),
+		Author: rev.Author.Name,
+		Time:   rev.Time(),
+	}
+}
+
+// writeAPIError reports msg to an API client with the given status.
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(APIError{Error: msg})
+}
+
+// apiETag tags a resource by the oid of its contents and the page it is on,
+// since a knowledge or card keeps its oid when it is moved.
+func apiETag(oid objid.Oid, path string) string {
+	return oid.String() + ":" + path
+}
+
+// writeAPIResponse writes v as JSON tagged with etag, or just 304 Not Modified
+// if the client already has that version.
+func writeAPIResponse(w http.ResponseWriter, r *http.Request, etag string, v interface{}) {
+	etag = `"` + etag + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if match = strings.TrimSpace(match); match == etag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// apiPath is the wiki path named by the rest of an API URL, "/" if it is
+// empty.
+func apiPath(rest string) (string, bool) {
+	path := "/" + strings.Trim(rest, "/")
+	return path, validatePath(&path)
+}
+
+// serveAPI serves read-only JSON views of the current snapshot:
+//
+//	/_api/v1/revision          the commit the wiki is at
+//	/_api/v1/pages/<path>      a page, its children and knowledges
+//	/_api/v1/knowledges/<kid>  a knowledge with the source of its files
+//	/_api/v1/cards?path=<path> the cards of a page and its subpages
+//	/_api/v1/cards/<cid>       a card
+//
+// Responses are tagged with the oid of the tree or blob they were read from,
+// so clients can revalidate with If-None-Match.
+func (wiki *Wiki) serveAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, "invalid method")
+		return
+	}
+
+	snap := wiki.config.WikiData.Snapshot()
+	endpoint := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	resource, rest := endpoint, ""
+	if i := strings.IndexByte(endpoint, '/'); i >= 0 {
+		resource, rest = endpoint[:i], endpoint[i+1:]
+	}
+
+	switch resource {
+	case "revision":
+		rev := snap.Revision()
+		writeAPIResponse(w, r, rev.Commit.String(), apiRevision(rev))
+
+	case "pages":
+		path, ok := apiPath(rest)
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "invalid path")
+			return
+		}
+		wiki.serveAPIPage(w, r, snap, path)
+
+	case "knowledges":
+		wiki.serveAPIKnowledge(w, r, snap, wikidata.KnowledgeId(rest))
+
+	case "cards":
+		// Cards are study material, and like reviews are not public.
+		if !wiki.config.Authentication.IsAuthenticated(r) {
+			writeAPIError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if rest == "" {
+			wiki.serveAPICards(w, r, snap)
+			return
+		}
+		wiki.serveAPICard(w, r, snap, wikidata.CardId(rest))
+
+	default:
+		writeAPIError(w, http.StatusNotFound, "unknown endpoint")
+	}
+}
+
+func (wiki *Wiki) serveAPIPage(w http.ResponseWriter, r *http.Request, snap *wikidata.Snapshot, path string) {
+	page, ok := snap.LookupPage(path)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "page not found")
+		return
+	}
+
+	rendered := APIPage{
+		Path:         page.Path,
+		Title:        page.Title,
+		Children:     page.Children,
+		Knowledges:   []string{},
+		Created:      apiRevision(page.History.Created),
+		LastModified: apiRevision(page.History.LastModified),
+	}
+	if rendered.Children == nil {
+		rendered.Children = []string{}
+	}
+	for _, kid := range page.ActualKnowledges {
+		rendered.Knowledges = append(rendered.Knowledges, string(kid))
+	}
+
+	writeAPIResponse(w, r, page.TreeOid.String(), rendered)
+}
+
+func (wiki *Wiki) serveAPIKnowledge(w http.ResponseWriter, r *http.Request, snap *wikidata.Snapshot, kid wikidata.KnowledgeId) {
+	km, ok := snap.LookupKnowledgeMeta(kid)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "knowledge not found")
+		return
+	}
+	_, k := snap.LookupKnowledge(kid)
+
+	rendered := APIKnowledge{
+		Identifier:   string(kid),
+		Page:         km.ParentPath,
+		Info:         k.GetInfo(),
+		Source:       make(map[string]string),
+		Media:        []string{},
+		Cards:        []string{},
+		Created:      apiRevision(km.History.Created),
+		LastModified: apiRevision(km.History.LastModified),
+	}
+	for _, name := range knowledgeFiles(wiki.config.Repo, snap, km) {
+		raw, err := wiki.config.Repo.ReadBlobFromTreeOid(km.TreeOid, name)
+		if err != nil {
+			continue
+		}
+		rendered.Source[name] = string(raw)
+	}
+	for _, f := range snap.KnowledgeMedia(kid) {
+		rendered.Media = append(rendered.Media, f.Name)
+	}
+	for _, cid := range km.Cards {
+		rendered.Cards = append(rendered.Cards, string(cid))
+	}
+	if cm, ok := snap.LookupCardMeta(wikidata.VirtualCardId(kid)); ok && cm.Virtual {
+		rendered.Cards = append(rendered.Cards, string(cm.Identifier))
+	}
+
+	writeAPIResponse(w, r, apiETag(km.TreeOid, km.ParentPath), rendered)
+}
+
+func (wiki *Wiki) serveAPICards(w http.ResponseWriter, r *http.Request, snap *wikidata.Snapshot) {
+	path, ok := apiPath(r.URL.Query().Get("path"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "invalid path")
+		return
+	}
+	page, ok := snap.LookupPage(path)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "page not found")
+		return
+	}
+
+	cards := []APICard{}
+	for _, cm := range snap.Cards(path) {
+		_, card := snap.LookupCard(cm.Identifier)
+		cards = append(cards, APICard{
+			Identifier: string(cm.Identifier),
+			Knowledge:  string(cm.ParentIdentifier),
+			Page:       cm.ParentParentPath,
+			Virtual:    cm.Virtual,
+			Card:       card,
+		})
+	}
+
+	// The tree of a page holds its subpages too.
+	writeAPIResponse(w, r, page.TreeOid.String(), cards)
+}
+
+func (wiki *Wiki) serveAPICard(w http.ResponseWriter, r *http.Request, snap *wikidata.Snapshot, cid wikidata.CardId) {
+	cm, ok := snap.LookupCardMeta(cid)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "card not found")
+		return
+	}
+	_, card := snap.LookupCard(cid)
+
+	writeAPIResponse(w, r, apiETag(cm.BlobOid, cm.ParentParentPath), APICard{
+		Identifier: string(cid),
+		Knowledge:  string(cm.ParentIdentifier),
+		Page:       cm.ParentParentPath,
+		Virtual:    cm.Virtual,
+		Card:       card,
+	})
+}
@@ -0,0 +1,139 @@
+package wiki
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestAPIPath(t *testing.T) {
+	for rest, want := range map[string]string{"": "/", "/": "/", "foo/bar": "/foo/bar", "foo/bar/": "/foo/bar"} {
+		if path, ok := apiPath(rest); !ok || path != want {
+			t.Errorf("apiPath(%#v) = %#v, %v", rest, path, ok)
+		}
+	}
+	if path, ok := apiPath("foo/_bar"); ok {
+		t.Errorf("apiPath(\"foo/_bar\") = %#v", path)
+	}
+}
+
+func TestAPIResponseNotModified(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeAPIResponse(w, httptest.NewRequest("GET", "/_api/v1/revision", nil), "abc", []string{"x"})
+	if w.Code != 200 || w.Header().Get("ETag") != `"abc"` || w.Body.String() != "[\"x\"]\n" {
+		t.Errorf("w = %#v", w)
+	}
+
+	r := httptest.NewRequest("GET", "/_api/v1/revision", nil)
+	r.Header.Set("If-None-Match", `"def", "abc"`)
+	w = httptest.NewRecorder()
+	writeAPIResponse(w, r, "abc", []string{"x"})
+	if w.Code != 304 || w.Body.Len() != 0 {
+		t.Errorf("w = %#v", w)
+	}
+}
+
+// getAPI fetches target from wiki in the session of cookie and decodes the
+// response into v, returning the status code and ETag.
+func getAPI(t *testing.T, wiki *Wiki, cookie *http.Cookie, target string, v interface{}) (int, string) {
+	w := serve(wiki, cookie, http.MethodGet, target, nil)
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Errorf("%s: %v", target, err)
+		}
+	}
+	return w.Code, w.Header().Get("ETag")
+}
+
+// apiCard is APICard with the card decoded as a basic card.
+type apiCard struct {
+	Identifier string
+	Knowledge  string
+	Page       string
+	Virtual    bool
+	Card       struct{ Front, Back string }
+}
+
+func TestAPIEndpoints(t *testing.T) {
+	dir, wiki := tempWiki(t, map[string]string{
+		"_wiki/_page/_info":            `{"Title": "Root"}`,
+		"_wiki/foo/_page/_info":        `{"Title": "Foo"}`,
+		"_wiki/foo/_page/k1/_info":     `{"Type": "markdown"}`,
+		"_wiki/foo/_page/k1/_data.md":  "text",
+		"_wiki/foo/_page/k1/_cards/c1": "Front\n---\nBack\n",
+		"_wiki/foo/sub/_page/_info":    `{"Title": "Sub"}`,
+		"_wiki/bar/_page/_info":        `{"Title": "Bar"}`,
+	})
+	defer os.RemoveAll(dir)
+	cookie := login(t, wiki)
+
+	var rev APIRevision
+	code, revTag := getAPI(t, wiki, nil, "/_api/v1/revision", &rev)
+	head, _ := wiki.config.Repo.RefOid("master")
+	if code != http.StatusOK || rev.Commit != head.String() || revTag != `"`+head.String()+`"` {
+		t.Errorf("revision: code = %d, rev = %#v, ETag = %s", code, rev, revTag)
+	}
+
+	var page APIPage
+	code, pageTag := getAPI(t, wiki, nil, "/_api/v1/pages/foo", &page)
+	if code != http.StatusOK || page.Title != "Foo" || !reflect.DeepEqual(page.Children, []string{"/foo/sub"}) || !reflect.DeepEqual(page.Knowledges, []string{"k1"}) {
+		t.Errorf("pages: code = %d, page = %#v", code, page)
+	}
+	_, barTag := getAPI(t, wiki, nil, "/_api/v1/pages/bar", &page)
+
+	var knowledge APIKnowledge
+	code, knowledgeTag := getAPI(t, wiki, nil, "/_api/v1/knowledges/k1", &knowledge)
+	if code != http.StatusOK || knowledge.Page != "/foo" || knowledge.Source["_data.md"] != "text" || !reflect.DeepEqual(knowledge.Cards, []string{"c1"}) {
+		t.Errorf("knowledges: code = %d, knowledge = %#v", code, knowledge)
+	}
+
+	var cards []apiCard
+	if code, _ := getAPI(t, wiki, nil, "/_api/v1/cards?path=/foo", &cards); code != http.StatusUnauthorized {
+		t.Errorf("anonymous cards: code = %d", code)
+	}
+	if code, _ := getAPI(t, wiki, nil, "/_api/v1/cards/c1", &cards); code != http.StatusUnauthorized {
+		t.Errorf("anonymous card: code = %d", code)
+	}
+	code, _ = getAPI(t, wiki, cookie, "/_api/v1/cards?path=/foo", &cards)
+	if code != http.StatusOK || len(cards) != 1 || cards[0].Identifier != "c1" || cards[0].Knowledge != "k1" || cards[0].Page != "/foo" || cards[0].Card.Back != "Back" {
+		t.Errorf("cards: code = %d, cards = %#v", code, cards)
+	}
+	var card apiCard
+	code, cardTag := getAPI(t, wiki, cookie, "/_api/v1/cards/c1", &card)
+	if code != http.StatusOK || card.Identifier != "c1" || card.Virtual {
+		t.Errorf("card: code = %d, card = %#v", code, card)
+	}
+
+	for _, target := range []string{"/_api/v1/pages/missing", "/_api/v1/knowledges/k9", "/_api/v1/cards/c9", "/_api/v1/cards?path=/missing", "/_api/v1/nonsense"} {
+		if code, _ := getAPI(t, wiki, cookie, target, &struct{}{}); code != http.StatusNotFound {
+			t.Errorf("%s: code = %d", target, code)
+		}
+	}
+
+	// Changing a card changes the tags of everything it is part of, and
+	// nothing else.
+	commitFiles(t, wiki.config.Repo, map[string]string{"_wiki/foo/_page/k1/_cards/c1": "Front\n---\nChanged\n"})
+	for _, test := range []struct {
+		target  string
+		old     string
+		changed bool
+	}{
+		{"/_api/v1/revision", revTag, true},
+		{"/_api/v1/pages/foo", pageTag, true},
+		{"/_api/v1/pages/bar", barTag, false},
+		{"/_api/v1/knowledges/k1", knowledgeTag, true},
+		{"/_api/v1/cards/c1", cardTag, true},
+	} {
+		r := httptest.NewRequest(http.MethodGet, test.target, nil)
+		r.AddCookie(cookie)
+		r.Header.Set("If-None-Match", test.old)
+		w := httptest.NewRecorder()
+		wiki.ServeHTTP(w, r)
+		if changed := w.Code == http.StatusOK; changed != test.changed || (w.Header().Get("ETag") != test.old) != test.changed {
+			t.Errorf("%s: code = %d, ETag = %s, was %s", test.target, w.Code, w.Header().Get("ETag"), test.old)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package wiki
+
+import (
+	"html"
+	"strconv"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+var KindCloze = ast.NewNodeKind("Cloze")
+
+type clozeNode struct {
+	ast.BaseInline
+
+	Deletion wikidata.ClozeDeletion
+}
+
+func (n *clozeNode) Kind() ast.NodeKind {
+	return KindCloze
+}
+
+func (n *clozeNode) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{
+		"Index":  strconv.Itoa(n.Deletion.Index),
+		"Answer": n.Deletion.Answer,
+	}, nil)
+}
+
+type clozeParser struct{}
+
+func (clozeParser) Trigger() []byte {
+	return []byte{'{'}
+}
+
+func (clozeParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	d, length, ok := wikidata.MatchCloze(string(line))
+	if !ok {
+		return nil
+	}
+	block.Advance(length)
+	return &clozeNode{Deletion: d}
+}
+
+type clozeRenderer struct{}
+
+func (clozeRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindCloze, renderCloze)
+}
+
+// renderCloze shows the answer of a deletion, highlighted so that the reader
+// can see what the generated card asks for.
+func renderCloze(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+
+	d := node.(*clozeNode).Deletion
+	title := "c" + strconv.Itoa(d.Index)
+	if d.Hint != "" {
+		title += ": " + d.Hint
+	}
+	w.WriteString(`<span class="cloze" title="` + html.EscapeString(title) + `">` + html.EscapeString(d.Answer) + `</span>`)
+	return ast.WalkSkipChildren, nil
+}
+
+// clozeExtension adds {{c1::answer}} and {{c1::answer::hint}} cloze deletions
+// to goldmark.
+type clozeExtension struct{}
+
+func (clozeExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithInlineParsers(util.Prioritized(clozeParser{}, 199)))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(clozeRenderer{}, 199)))
+}
@@ -0,0 +1,416 @@
+package wiki
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/MerryMage/libellus/objstore"
+	"github.com/MerryMage/libellus/objstore/commit"
+	"github.com/MerryMage/libellus/objstore/filemode"
+	"github.com/MerryMage/libellus/objstore/tree"
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+var (
+	EditConflictError         error = errors.New("wiki: changed by someone else since the form was opened")
+	PageNotFoundError         error = errors.New("wiki: page not found")
+	EmptyTitleError           error = errors.New("wiki: a page needs a title")
+	UnknownKnowledgeError     error = errors.New("wiki: knowledge order lists a knowledge which is not on the page")
+	DuplicateKnowledgeError   error = errors.New("wiki: knowledge order lists a knowledge twice")
+	UnknownKnowledgeTypeError error = errors.New("wiki: _info names an unknown knowledge type")
+	NotEditableError          error = errors.New("wiki: file cannot be edited")
+)
+
+// editVersion identifies the version of a file a form was filled in from: the
+// oid of its blob, or the empty string if it did not exist.
+func editVersion(trans *objstore.Transaction, path string) string {
+	if oid, ok := trans.Lookup(path); ok {
+		return oid.String()
+	}
+	return ""
+}
+
+// normalizeNewlines undoes the CRLF line endings browsers submit textareas
+// with.
+func normalizeNewlines(s string) string {
+	return strings.Replace(s, "\r\n", "\n", -1)
+}
+
+// startEdit starts a transaction on the branch of the wiki for an edit which
+// was worked out from snap. If the branch has moved on since, the edit could
+// miss changes it should have covered, so EditConflictError is returned.
+func (wiki *Wiki) startEdit(snap *wikidata.Snapshot) (*objstore.Transaction, error) {
+	trans, err := wiki.config.Repo.StartTransaction(wiki.config.WikiData.Ref())
+	if err != nil {
+		return nil, err
+	}
+	if !trans.Parent().Equals(snap.Revision().Commit) {
+		return nil, EditConflictError
+	}
+	return trans, nil
+}
+
+// storeEdit commits trans, reporting a commit which raced with it as a
+// conflict.
+func storeEdit(trans *objstore.Transaction, message string, sig commit.Signature) error {
+	err := trans.Store(commit.Commit{
+		Author:    sig,
+		Committer: sig,
+		Message:   message,
+	})
+	if err == objstore.RefChangedError {
+		return EditConflictError
+	}
+	return err
+}
+
+// editPage sets the title and knowledge order in the _info of the page at
+// path. base is the version of _info the edit was made to; if _info has
+// changed since, nothing is committed and EditConflictError is returned.
+// Fields of _info other than the title and order are kept.
+func (wiki *Wiki) editPage(path string, title string, order []wikidata.KnowledgeId, base string, sig commit.Signature) error {
+	repo := wiki.config.Repo
+	wd := wiki.config.WikiData
+
+	page, ok := wd.Snapshot().LookupPage(path)
+	if !ok {
+		return PageNotFoundError
+	}
+	if strings.TrimSpace(title) == "" {
+		return EmptyTitleError
+	}
+
+	onPage := make(map[wikidata.KnowledgeId]bool)
+	for _, kid := range page.ActualKnowledges {
+		onPage[kid] = true
+	}
+	seen := make(map[wikidata.KnowledgeId]bool)
+	for _, kid := range order {
+		if !onPage[kid] {
+			return UnknownKnowledgeError
+		}
+		if seen[kid] {
+			return DuplicateKnowledgeError
+		}
+		seen[kid] = true
+	}
+
+	trans, err := repo.StartTransaction(wd.Ref())
+	if err != nil {
+		return err
+	}
+
+	infoPath := wikidata.PageTreePath(path) + "/_info"
+	if editVersion(trans, infoPath) != base {
+		return EditConflictError
+	}
+
+	err = updatePageInfo(repo, trans, path, func(info *pageInfoFields) {
+		info.Title = strings.TrimSpace(title)
+		info.Knowledges = order
+	})
+	if err != nil {
+		return err
+	}
+
+	return storeEdit(trans, "Edit "+path+"\n", sig)
+}
+
+// pageInfoFields is the _info of a page, keeping any fields besides the title
+// and knowledge order as they are.
+type pageInfoFields struct {
+	wikidata.PageInfo
+	other map[string]json.RawMessage
+}
+
+// updatePageInfo rewrites the _info of the page at path in trans with f. A
+// missing or broken _info is replaced outright.
+func updatePageInfo(repo *objstore.Repository, trans *objstore.Transaction, path string, f func(info *pageInfoFields)) error {
+	infoPath := wikidata.PageTreePath(path) + "/_info"
+
+	info := pageInfoFields{other: make(map[string]json.RawMessage)}
+	if oid, ok := trans.Lookup(infoPath); ok {
+		raw, err := repo.ReadBlob(oid)
+		if err != nil {
+			return err
+		}
+		json.Unmarshal(raw, &info.other)
+		json.Unmarshal(raw, &info.PageInfo)
+	}
+
+	f(&info)
+
+	info.other["Title"], _ = json.Marshal(info.Title)
+	if len(info.Knowledges) > 0 {
+		info.other["Knowledges"], _ = json.Marshal(info.Knowledges)
+	} else {
+		delete(info.other, "Knowledges")
+	}
+
+	raw, err := json.MarshalIndent(info.other, "", "\t")
+	if err != nil {
+		return err
+	}
+	return trans.AddOrReplace(infoPath, append(raw, '\n'))
+}
+
+// knowledgeFiles returns the files of a knowledge which can be edited as
+// text: _info and its _data files.
+func knowledgeFiles(repo *objstore.Repository, snap *wikidata.Snapshot, km wikidata.KnowledgeMeta) []string {
+	files := []string{"_info"}
+
+	t, err := repo.Tree(km.TreeOid)
+	if err == nil {
+		for _, e := range t.Entries {
+			if strings.HasPrefix(e.Name, "_data") && (e.Mode == filemode.Regular || e.Mode == filemode.Executable) {
+				files = append(files, e.Name)
+			}
+		}
+	}
+
+	// A new or broken markdown knowledge may not have its _data.md yet.
+	if _, k := snap.LookupKnowledge(km.Identifier); len(files) == 1 && k.GetInfo().Type == wikidata.MarkdownKnowledgeType {
+		files = append(files, "_data.md")
+	}
+
+	return files
+}
+
+// editKnowledge replaces the files of the knowledge kid with the contents in
+// files. bases holds the version of each file the edit was made to; if any
+// has changed since, nothing is committed and EditConflictError is returned.
+// Files whose contents are unchanged are left alone.
+func (wiki *Wiki) editKnowledge(kid wikidata.KnowledgeId, files map[string]string, bases map[string]string, sig commit.Signature) error {
+	repo := wiki.config.Repo
+	wd := wiki.config.WikiData
+
+	snap := wd.Snapshot()
+	km, ok := snap.LookupKnowledgeMeta(kid)
+	if !ok {
+		return KnowledgeNotFoundError
+	}
+
+	editable := make(map[string]bool)
+	for _, name := range knowledgeFiles(repo, snap, km) {
+		editable[name] = true
+	}
+
+	var names []string
+	for name := range files {
+		if !editable[name] {
+			return NotEditableError
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if info, ok := files["_info"]; ok {
+		var ki wikidata.KnowledgeInfo
+		if err := json.Unmarshal([]byte(info), &ki); err != nil {
+			return errors.New("wiki: _info: " + err.Error())
+		}
+		if !wikidata.KnownKnowledgeType(ki.Type) {
+			return UnknownKnowledgeTypeError
+		}
+	}
+
+	trans, err := repo.StartTransaction(wd.Ref())
+	if err != nil {
+		return err
+	}
+
+	dir := wikidata.PageTreePath(km.ParentPath) + "/" + string(kid) + "/"
+	changed := false
+	for _, name := range names {
+		path := dir + name
+		if editVersion(trans, path) != bases[name] {
+			return EditConflictError
+		}
+
+		data := []byte(normalizeNewlines(files[name]))
+		if oid, ok := trans.Lookup(path); ok {
+			current, err := repo.ReadBlob(oid)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(current, data) {
+				continue
+			}
+		}
+
+		err = trans.AddOrReplace(path, data)
+		if err != nil {
+			return err
+		}
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+	return storeEdit(trans, "Edit "+string(kid)+" on "+km.ParentPath+"\n", sig)
+}
+
+type RenderedEditFile struct {
+	Name    string
+	Content string
+	Base    string
+}
+
+type RenderedEdit struct {
+	PagePath  string
+	Knowledge string
+
+	// Editing a page.
+	Title string
+	Order string
+	Base  string
+
+	// Editing a knowledge.
+	Files []RenderedEditFile
+
+	CSRFToken string
+	Conflict  bool
+	Error     string
+}
+
+// serveEdit shows and takes the edit forms of pages, /_edit?path=, and
+// knowledges, /_edit?kid=.
+func (wiki *Wiki) serveEdit(w http.ResponseWriter, r *http.Request) {
+	if !wiki.config.Authentication.IsAuthenticated(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("ParseForm failure"))
+		return
+	}
+	if r.Method == http.MethodPost && !wiki.checkCSRF(w, r) {
+		return
+	}
+
+	if r.Form.Get("kid") != "" {
+		wiki.serveEditKnowledge(w, r, wikidata.KnowledgeId(r.Form.Get("kid")))
+		return
+	}
+
+	path := r.Form.Get("path")
+	if path == "" || !validatePath(&path) {
+		wiki.invalidPathResponse(w, r)
+		return
+	}
+	wiki.serveEditPage(w, r, path)
+}
+
+func (wiki *Wiki) editFailed(w http.ResponseWriter, rendered *RenderedEdit, err error) {
+	rendered.Error = err.Error()
+	if err == EditConflictError {
+		rendered.Conflict = true
+		w.WriteHeader(http.StatusConflict)
+	} else {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	wiki.editTemplate.Execute(w, rendered)
+}
+
+func (wiki *Wiki) serveEditPage(w http.ResponseWriter, r *http.Request, path string) {
+	if r.Method == http.MethodPost {
+		var order []wikidata.KnowledgeId
+		for _, line := range strings.Split(normalizeNewlines(r.Form.Get("order")), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				order = append(order, wikidata.KnowledgeId(line))
+			}
+		}
+
+		err := wiki.editPage(path, r.Form.Get("title"), order, r.Form.Get("base"), wiki.signature(r))
+		if err == nil {
+			http.Redirect(w, r, path, http.StatusSeeOther)
+			return
+		}
+		wiki.editFailed(w, &RenderedEdit{
+			PagePath:  path,
+			Title:     r.Form.Get("title"),
+			Order:     r.Form.Get("order"),
+			Base:      r.Form.Get("base"),
+			CSRFToken: wiki.config.Authentication.CSRFToken(r),
+		}, err)
+		return
+	}
+
+	snap := wiki.config.WikiData.Snapshot()
+	page, ok := snap.LookupPage(path)
+	if !ok {
+		wiki.invalidPathResponse(w, r)
+		return
+	}
+
+	rendered := RenderedEdit{
+		PagePath:  path,
+		Title:     page.Title,
+		CSRFToken: wiki.config.Authentication.CSRFToken(r),
+	}
+	for _, kid := range page.ActualKnowledges {
+		rendered.Order += string(kid) + "\n"
+	}
+	if e, err := tree.Lookup(wiki.config.Repo, page.TreeOid, "_page/_info"); err == nil {
+		rendered.Base = e.Oid.String()
+	}
+	wiki.editTemplate.Execute(w, rendered)
+}
+
+func (wiki *Wiki) serveEditKnowledge(w http.ResponseWriter, r *http.Request, kid wikidata.KnowledgeId) {
+	snap := wiki.config.WikiData.Snapshot()
+	km, ok := snap.LookupKnowledgeMeta(kid)
+	if !ok {
+		wiki.invalidPathResponse(w, r)
+		return
+	}
+
+	names := knowledgeFiles(wiki.config.Repo, snap, km)
+
+	if r.Method == http.MethodPost {
+		files := make(map[string]string)
+		bases := make(map[string]string)
+		rendered := RenderedEdit{PagePath: km.ParentPath, Knowledge: string(kid), CSRFToken: wiki.config.Authentication.CSRFToken(r)}
+		for _, name := range names {
+			if content, ok := r.Form["file:"+name]; ok {
+				files[name] = content[0]
+				bases[name] = r.Form.Get("base:" + name)
+				rendered.Files = append(rendered.Files, RenderedEditFile{Name: name, Content: content[0], Base: bases[name]})
+			}
+		}
+
+		err := wiki.editKnowledge(kid, files, bases, wiki.signature(r))
+		if err == nil {
+			http.Redirect(w, r, km.ParentPath+"#"+url.PathEscape(string(kid)), http.StatusSeeOther)
+			return
+		}
+		wiki.editFailed(w, &rendered, err)
+		return
+	}
+
+	rendered := RenderedEdit{PagePath: km.ParentPath, Knowledge: string(kid), CSRFToken: wiki.config.Authentication.CSRFToken(r)}
+	for _, name := range names {
+		f := RenderedEditFile{Name: name}
+		if e, err := tree.Lookup(wiki.config.Repo, km.TreeOid, name); err == nil {
+			raw, err := wiki.config.Repo.ReadBlob(e.Oid)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("could not read " + name))
+				return
+			}
+			f.Content = string(raw)
+			f.Base = e.Oid.String()
+		}
+		rendered.Files = append(rendered.Files, f)
+	}
+	wiki.editTemplate.Execute(w, rendered)
+}
@@ -0,0 +1,53 @@
+package wiki
+
+import (
+	"os"
+	"testing"
+
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+// currentVersion is the version of the file at path an edit form would be
+// opened with.
+func currentVersion(t *testing.T, wiki *Wiki, path string) string {
+	trans, err := wiki.config.Repo.StartTransaction(wiki.config.WikiData.Ref())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return editVersion(trans, path)
+}
+
+func TestEditConflict(t *testing.T) {
+	dir, wiki := tempWiki(t, map[string]string{
+		"_wiki/_page/_info":       `{"Title": "Root", "Knowledges": ["k1"]}`,
+		"_wiki/_page/k1/_info":    `{"Type": "markdown"}`,
+		"_wiki/_page/k1/_data.md": "text",
+	})
+	defer os.RemoveAll(dir)
+
+	infoBase := currentVersion(t, wiki, "_wiki/_page/_info")
+	err := wiki.editPage("/", "Home", []wikidata.KnowledgeId{"k1"}, infoBase, testSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wiki.editPage("/", "Other", []wikidata.KnowledgeId{"k1"}, infoBase, testSignature)
+	if err != EditConflictError {
+		t.Errorf("editPage err = %v", err)
+	}
+	if page, _ := wiki.config.WikiData.Snapshot().LookupPage("/"); page.Title != "Home" {
+		t.Errorf("page.Title = %q", page.Title)
+	}
+
+	dataBase := currentVersion(t, wiki, "_wiki/_page/k1/_data.md")
+	err = wiki.editKnowledge("k1", map[string]string{"_data.md": "first"}, map[string]string{"_data.md": dataBase}, testSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wiki.editKnowledge("k1", map[string]string{"_data.md": "second"}, map[string]string{"_data.md": dataBase}, testSignature)
+	if err != EditConflictError {
+		t.Errorf("editKnowledge err = %v", err)
+	}
+	if _, k := wiki.config.WikiData.Snapshot().LookupKnowledge("k1"); k.(wikidata.MarkdownKnowledge).Markdown != "first" {
+		t.Errorf("k = %#v", k)
+	}
+}
@@ -0,0 +1,69 @@
+package wiki
+
+import (
+	"sync"
+
+	"github.com/MerryMage/libellus/objstore/objid"
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+const historyCacheSize = 16
+
+// historyCache holds Snapshots of past commits, evicting the least recently
+// built Snapshot once full.
+type historyCache struct {
+	lock    sync.Mutex
+	entries map[objid.Oid]*wikidata.Snapshot
+	order   []objid.Oid
+}
+
+func newHistoryCache() *historyCache {
+	return &historyCache{
+		entries: make(map[objid.Oid]*wikidata.Snapshot),
+	}
+}
+
+func (hc *historyCache) get(coid objid.Oid) (*wikidata.Snapshot, bool) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+	snap, ok := hc.entries[coid]
+	return snap, ok
+}
+
+func (hc *historyCache) put(coid objid.Oid, snap *wikidata.Snapshot) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+
+	if _, ok := hc.entries[coid]; ok {
+		return
+	}
+
+	hc.entries[coid] = snap
+	hc.order = append(hc.order, coid)
+
+	if len(hc.order) > historyCacheSize {
+		delete(hc.entries, hc.order[0])
+		hc.order = hc.order[1:]
+	}
+}
+
+// snapshotAt returns a Snapshot of the wiki at the revision rev, which may be
+// a commit oid (possibly abbreviated), a tag or a branch.
+func (wiki *Wiki) snapshotAt(rev string) (*wikidata.Snapshot, error) {
+	coid, err := wiki.config.Repo.ResolveRevision(rev)
+	if err != nil {
+		return nil, err
+	}
+
+	if snap, ok := wiki.history.get(coid); ok {
+		return snap, nil
+	}
+
+	snap, err := wikidata.SnapshotAt(wiki.config.Repo, coid)
+	if err != nil {
+		return nil, err
+	}
+
+	wiki.history.put(coid, snap)
+	return snap, nil
+}
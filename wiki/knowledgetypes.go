@@ -0,0 +1,125 @@
+package wiki
+
+import (
+	"bytes"
+	"html/template"
+	"strings"
+
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+// KnowledgeRenderer renders a knowledge of one type into HTML for its page.
+// The HTML is used as is, so a renderer must escape or sanitize everything it
+// writes.
+type KnowledgeRenderer func(wiki *Wiki, snap *wikidata.Snapshot, k wikidata.Knowledge) (template.HTML, error)
+
+var knowledgeRenderers = map[string]KnowledgeRenderer{
+	wikidata.MarkdownKnowledgeType:    renderMarkdownKnowledge,
+	wikidata.CodeKnowledgeType:        renderCodeKnowledge,
+	wikidata.MathKnowledgeType:        renderMathKnowledge,
+	wikidata.TableKnowledgeType:       renderTableKnowledge,
+	wikidata.ImageKnowledgeType:       renderImageKnowledge,
+	wikidata.DefinitionsKnowledgeType: renderDefinitionsKnowledge,
+}
+
+// RegisterKnowledgeRenderer renders knowledges of the named type with r. It
+// goes together with wikidata.RegisterKnowledgeType, and must likewise be
+// called before any Wiki is created.
+func RegisterKnowledgeRenderer(name string, r KnowledgeRenderer) {
+	knowledgeRenderers[name] = r
+}
+
+func renderMarkdownKnowledge(wiki *Wiki, snap *wikidata.Snapshot, k wikidata.Knowledge) (template.HTML, error) {
+	mk := k.(wikidata.MarkdownKnowledge)
+	return wiki.markdown.Render(snap, mk.Markdown, string(mk.Identifier), mk.Identifier)
+}
+
+func renderCodeKnowledge(wiki *Wiki, snap *wikidata.Snapshot, k wikidata.Knowledge) (template.HTML, error) {
+	ck := k.(wikidata.CodeKnowledge)
+
+	var b bytes.Buffer
+	err := wiki.markdown.code.highlight(&b, ck.Language, ck.Source)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(b.String()), nil
+}
+
+func renderMathKnowledge(wiki *Wiki, snap *wikidata.Snapshot, k wikidata.Knowledge) (template.HTML, error) {
+	mk := k.(wikidata.MathKnowledge)
+
+	var b strings.Builder
+	for _, eq := range mk.Equations {
+		mathml, err := TeXToMathML(eq)
+		if err != nil {
+			b.WriteString(`<pre class="math-error" title="` + template.HTMLEscapeString(err.Error()) + `">` + template.HTMLEscapeString(eq) + "</pre>")
+			continue
+		}
+		b.WriteString(string(mathml))
+	}
+	return template.HTML(b.String()), nil
+}
+
+func renderTableKnowledge(wiki *Wiki, snap *wikidata.Snapshot, k wikidata.Knowledge) (template.HTML, error) {
+	tk := k.(wikidata.TableKnowledge)
+
+	var b strings.Builder
+	b.WriteString(`<table class="knowledge-table">`)
+	if len(tk.Header) > 0 {
+		b.WriteString("<thead><tr>")
+		for _, cell := range tk.Header {
+			b.WriteString("<th>" + template.HTMLEscapeString(cell) + "</th>")
+		}
+		b.WriteString("</tr></thead>")
+	}
+	b.WriteString("<tbody>")
+	for _, row := range tk.Rows {
+		b.WriteString("<tr>")
+		for _, cell := range row {
+			b.WriteString("<td>" + template.HTMLEscapeString(cell) + "</td>")
+		}
+		b.WriteString("</tr>")
+	}
+	b.WriteString("</tbody></table>")
+	return template.HTML(b.String()), nil
+}
+
+func renderImageKnowledge(wiki *Wiki, snap *wikidata.Snapshot, k wikidata.Knowledge) (template.HTML, error) {
+	ik := k.(wikidata.ImageKnowledge)
+
+	var b strings.Builder
+	b.WriteString("<figure>")
+	if ik.File != "" {
+		b.WriteString(`<img src="` + template.HTMLEscapeString(mediaURL(ik.Identifier, ik.File)) + `" alt="` + template.HTMLEscapeString(ik.Caption) + `">`)
+	}
+	if ik.Caption != "" {
+		caption, err := wiki.markdown.Render(snap, ik.Caption, string(ik.Identifier), ik.Identifier)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString("<figcaption>" + string(caption) + "</figcaption>")
+	}
+	b.WriteString("</figure>")
+	return template.HTML(b.String()), nil
+}
+
+func renderDefinitionsKnowledge(wiki *Wiki, snap *wikidata.Snapshot, k wikidata.Knowledge) (template.HTML, error) {
+	dk := k.(wikidata.DefinitionsKnowledge)
+
+	var b strings.Builder
+	b.WriteString("<dl>")
+	for _, d := range dk.Definitions {
+		for _, term := range d.Terms {
+			b.WriteString("<dt>" + template.HTMLEscapeString(term) + "</dt>")
+		}
+		for _, def := range d.Definitions {
+			html, err := wiki.markdown.Render(snap, def, string(dk.Identifier), dk.Identifier)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString("<dd>" + string(html) + "</dd>")
+		}
+	}
+	b.WriteString("</dl>")
+	return template.HTML(b.String()), nil
+}
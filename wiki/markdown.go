@@ -0,0 +1,212 @@
+package wiki
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"regexp"
+
+	"github.com/alecthomas/chroma"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+// highlightStyle must match the stylesheet in static/_static/highlight.css.
+const highlightStyle = "github"
+
+// codeBlockRenderer renders fenced code blocks with syntax highlighting.
+// Highlighted output uses CSS classes rather than inline styles so that it
+// survives sanitization.
+type codeBlockRenderer struct {
+	formatter *chromahtml.Formatter
+	style     *chroma.Style
+}
+
+func newCodeBlockRenderer() *codeBlockRenderer {
+	return &codeBlockRenderer{
+		formatter: chromahtml.New(chromahtml.WithClasses(true)),
+		style:     styles.Get(highlightStyle),
+	}
+}
+
+func (cbr *codeBlockRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindFencedCodeBlock, cbr.renderFencedCodeBlock)
+}
+
+func (cbr *codeBlockRenderer) renderFencedCodeBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+
+	n := node.(*ast.FencedCodeBlock)
+
+	var code bytes.Buffer
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		code.Write(line.Value(source))
+	}
+
+	var lang string
+	if l := n.Language(source); l != nil {
+		lang = string(l)
+	}
+
+	err := cbr.highlight(w, lang, code.String())
+	if err != nil {
+		return ast.WalkStop, err
+	}
+
+	return ast.WalkSkipChildren, nil
+}
+
+// highlight writes code in the named language as highlighted HTML. Unknown
+// languages are written without highlighting.
+func (cbr *codeBlockRenderer) highlight(w io.Writer, lang string, code string) error {
+	var lexer chroma.Lexer
+	if lang != "" {
+		lexer = lexers.Get(lang)
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, code)
+	if err != nil {
+		return err
+	}
+
+	return cbr.formatter.Format(w, cbr.style, iterator)
+}
+
+// prefixedIDs generates heading ids unique to one knowledge, so that several
+// knowledges can be rendered on the same page without colliding anchors.
+type prefixedIDs struct {
+	prefix string
+	inner  parser.IDs
+}
+
+func newPrefixedIDs(prefix string) *prefixedIDs {
+	return &prefixedIDs{
+		prefix: prefix,
+		inner:  parser.NewContext().IDs(),
+	}
+}
+
+func (ids *prefixedIDs) Generate(value []byte, kind ast.NodeKind) []byte {
+	return append([]byte(ids.prefix+"-"), ids.inner.Generate(value, kind)...)
+}
+
+func (ids *prefixedIDs) Put(value []byte) {
+	ids.inner.Put(value)
+}
+
+// idPrefixContextKey holds the prefix of the ids generated for the knowledge
+// being rendered.
+var idPrefixContextKey = parser.NewContextKey()
+
+// footnotePrefixAttribute carries the id prefix from the parser context to
+// the footnote renderer, which only sees the document.
+const footnotePrefixAttribute = "footnote-prefix"
+
+// footnotePrefixTransformer stores the id prefix on the document, so that
+// footnotes of several knowledges on one page get distinct ids too.
+type footnotePrefixTransformer struct{}
+
+func (footnotePrefixTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	if prefix, _ := pc.Get(idPrefixContextKey).(string); prefix != "" {
+		doc.SetAttributeString(footnotePrefixAttribute, []byte(prefix+"-"))
+	}
+}
+
+func footnoteIDPrefix(node ast.Node) []byte {
+	if doc := node.OwnerDocument(); doc != nil {
+		if prefix, ok := doc.AttributeString(footnotePrefixAttribute); ok {
+			return prefix.([]byte)
+		}
+	}
+	return nil
+}
+
+type markdownRenderer struct {
+	md     goldmark.Markdown
+	code   *codeBlockRenderer
+	policy *bluemonday.Policy
+}
+
+func newSanitizationPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+
+	// Heading anchors and footnote references.
+	p.AllowAttrs("id").Matching(regexp.MustCompile(`^[a-zA-Z0-9:\-_.]+$`)).Globally()
+	p.AllowAttrs("role").Matching(regexp.MustCompile(`^doc-[a-z]+$`)).OnElements("a", "div", "section")
+
+	// Syntax highlighting, footnotes and wiki links.
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^[a-zA-Z0-9\- ]+$`)).OnElements("a", "code", "div", "li", "pre", "section", "span", "sup")
+
+	// Broken wiki links and cloze deletions.
+	p.AllowAttrs("title").OnElements("span")
+
+	// Task lists.
+	p.AllowElements("input")
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+
+	return p
+}
+
+func newMarkdownRenderer() *markdownRenderer {
+	code := newCodeBlockRenderer()
+	return &markdownRenderer{
+		md: goldmark.New(
+			goldmark.WithExtensions(
+				extension.GFM,
+				extension.NewFootnote(extension.WithFootnoteIDPrefixFunction(footnoteIDPrefix)),
+				wikiLinkExtension{},
+				clozeExtension{},
+				mediaExtension{},
+			),
+			goldmark.WithParserOptions(
+				parser.WithAutoHeadingID(),
+				parser.WithASTTransformers(util.Prioritized(footnotePrefixTransformer{}, 100)),
+			),
+			goldmark.WithRendererOptions(
+				renderer.WithNodeRenderers(util.Prioritized(code, 200)),
+			),
+		),
+		code:   code,
+		policy: newSanitizationPolicy(),
+	}
+}
+
+// Render converts CommonMark with GitHub Flavored Markdown extensions into
+// sanitized HTML. Heading anchors are prefixed with idPrefix, wiki links are
+// resolved against snap, and stay at its revision if it is historical, and
+// media: links point into the _media tree of the knowledge kid.
+func (mr *markdownRenderer) Render(snap *wikidata.Snapshot, source string, idPrefix string, kid wikidata.KnowledgeId) (template.HTML, error) {
+	ctx := parser.NewContext(parser.WithIDs(newPrefixedIDs(idPrefix)))
+	ctx.Set(snapshotContextKey, snap)
+	if snap != nil && snap.Historical() {
+		ctx.Set(revisionContextKey, snap.Revision().Commit.String())
+	}
+	ctx.Set(idPrefixContextKey, idPrefix)
+	ctx.Set(knowledgeContextKey, kid)
+
+	var b bytes.Buffer
+	err := mr.md.Convert([]byte(source), &b, parser.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(mr.policy.SanitizeBytes(b.Bytes())), nil
+}
@@ -0,0 +1,71 @@
+package wiki
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFootnoteIDs(t *testing.T) {
+	mr := newMarkdownRenderer()
+
+	for _, prefix := range []string{"k1", "k2"} {
+		html, err := mr.Render(nil, "Text[^1]\n\n[^1]: Note", prefix, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{`id="` + prefix + `-fnref:1"`, `href="#` + prefix + `-fn:1"`, `id="` + prefix + `-fn:1"`, `href="#` + prefix + `-fnref:1"`} {
+			if !strings.Contains(string(html), want) {
+				t.Errorf("html = %s, want %s", html, want)
+			}
+		}
+	}
+}
+
+func TestSanitizationPolicy(t *testing.T) {
+	policy := newSanitizationPolicy()
+
+	tests := []struct {
+		in      string
+		want    []string
+		notWant []string
+	}{
+		{`<p>a<script>alert(1)</script>b</p>`, []string{`<p>ab</p>`}, []string{`script`, `alert`}},
+		{`<a href="javascript:alert(1)">x</a>`, []string{`x`}, []string{`javascript`, `href`}},
+		{`<a href="/foo" class="wikilink" onclick="x()">x</a>`, []string{`href="/foo"`, `class="wikilink"`}, []string{`onclick`}},
+		{`<img src="x.png" onerror="x()">`, []string{`src="x.png"`}, []string{`onerror`}},
+		{`<span class="k" onmouseover="x()">func</span>`, []string{`<span class="k">func</span>`}, []string{`onmouseover`}},
+		{`<span title="answer" style="color: red">[...]</span>`, []string{`<span title="answer">[...]</span>`}, []string{`style`}},
+		{`<input type="text" value="x">`, nil, []string{`type`, `value`}},
+	}
+	for _, test := range tests {
+		out := policy.Sanitize(test.in)
+		for _, want := range test.want {
+			if !strings.Contains(out, want) {
+				t.Errorf("Sanitize(%q) = %q, want %q", test.in, out, want)
+			}
+		}
+		for _, notWant := range test.notWant {
+			if strings.Contains(out, notWant) {
+				t.Errorf("Sanitize(%q) = %q, contains %q", test.in, out, notWant)
+			}
+		}
+	}
+}
+
+func TestRenderSanitizes(t *testing.T) {
+	mr := newMarkdownRenderer()
+	html, err := mr.Render(nil, "[x](javascript:alert(1)) <b onclick=\"x()\">b</b>\n\n```go\nfunc f() {}\n```\n", "k1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, notWant := range []string{`javascript`, `onclick`} {
+		if strings.Contains(string(html), notWant) {
+			t.Errorf("html = %s, contains %s", html, notWant)
+		}
+	}
+	for _, want := range []string{`<pre class="chroma">`, `<span class="kd">func</span>`, `<span class="nf">f</span>`} {
+		if !strings.Contains(string(html), want) {
+			t.Errorf("html = %s, want %s", html, want)
+		}
+	}
+}
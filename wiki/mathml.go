@@ -0,0 +1,672 @@
+package wiki
+
+import (
+	"errors"
+	"html"
+	"html/template"
+	"strings"
+	"unicode"
+)
+
+// This file converts the commonly used subset of LaTeX math into MathML, so
+// that equations render without any scripts in the browser. Commands it does
+// not know are shown as errors in place; malformed input such as unbalanced
+// braces fails the whole equation.
+
+var (
+	UnbalancedBracesError      error = errors.New("wiki: unbalanced braces in equation")
+	MissingArgumentError       error = errors.New("wiki: command is missing an argument")
+	DoubleScriptError          error = errors.New("wiki: double superscript or subscript in equation")
+	UnbalancedLeftError        error = errors.New("wiki: \\left without a matching \\right")
+	UnbalancedEnvironmentError error = errors.New("wiki: \\begin without a matching \\end")
+)
+
+type texTokenKind int
+
+const (
+	texEOF texTokenKind = iota
+	texChar
+	texCommand
+	texSpace
+	texOpen
+	texClose
+	texSup
+	texSub
+	texAlign
+	texNewline
+)
+
+type texToken struct {
+	kind texTokenKind
+	text string
+}
+
+func tokenizeTeX(src string) []texToken {
+	var toks []texToken
+	rs := []rune(src)
+
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		switch {
+		case r == '%':
+			for i < len(rs) && rs[i] != '\n' {
+				i++
+			}
+		case unicode.IsSpace(r):
+			for i+1 < len(rs) && unicode.IsSpace(rs[i+1]) {
+				i++
+			}
+			toks = append(toks, texToken{texSpace, " "})
+		case r == '{':
+			toks = append(toks, texToken{texOpen, "{"})
+		case r == '}':
+			toks = append(toks, texToken{texClose, "}"})
+		case r == '^':
+			toks = append(toks, texToken{texSup, "^"})
+		case r == '_':
+			toks = append(toks, texToken{texSub, "_"})
+		case r == '&':
+			toks = append(toks, texToken{texAlign, "&"})
+		case r == '\\' && i+1 < len(rs) && rs[i+1] == '\\':
+			i++
+			toks = append(toks, texToken{texNewline, `\\`})
+		case r == '\\' && i+1 < len(rs) && isASCIILetter(rs[i+1]):
+			j := i + 1
+			for j < len(rs) && isASCIILetter(rs[j]) {
+				j++
+			}
+			toks = append(toks, texToken{texCommand, string(rs[i+1 : j])})
+			i = j - 1
+		case r == '\\' && i+1 < len(rs):
+			i++
+			toks = append(toks, texToken{texCommand, string(rs[i])})
+		default:
+			toks = append(toks, texToken{texChar, string(r)})
+		}
+	}
+
+	return toks
+}
+
+func isASCIILetter(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+var texIdentifiers = map[string]string{
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ϵ",
+	"varepsilon": "ε", "zeta": "ζ", "eta": "η", "theta": "θ", "vartheta": "ϑ",
+	"iota": "ι", "kappa": "κ", "lambda": "λ", "mu": "μ", "nu": "ν", "xi": "ξ",
+	"pi": "π", "varpi": "ϖ", "rho": "ρ", "varrho": "ϱ", "sigma": "σ",
+	"varsigma": "ς", "tau": "τ", "upsilon": "υ", "phi": "ϕ", "varphi": "φ",
+	"chi": "χ", "psi": "ψ", "omega": "ω",
+	"Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ",
+	"Pi": "Π", "Sigma": "Σ", "Upsilon": "Υ", "Phi": "Φ", "Psi": "Ψ",
+	"Omega": "Ω",
+	"infty": "∞", "ell": "ℓ", "hbar": "ℏ", "partial": "∂", "nabla": "∇",
+	"emptyset": "∅", "varnothing": "∅", "aleph": "ℵ", "Re": "ℜ", "Im": "ℑ",
+}
+
+var texOperators = map[string]string{
+	"cdot": "⋅", "times": "×", "div": "÷", "pm": "±", "mp": "∓",
+	"leq": "≤", "le": "≤", "geq": "≥", "ge": "≥", "neq": "≠", "ne": "≠",
+	"approx": "≈", "equiv": "≡", "sim": "∼", "simeq": "≃", "cong": "≅",
+	"propto": "∝", "ll": "≪", "gg": "≫",
+	"to": "→", "rightarrow": "→", "leftarrow": "←", "gets": "←",
+	"Rightarrow": "⇒", "Leftarrow": "⇐", "leftrightarrow": "↔",
+	"Leftrightarrow": "⇔", "implies": "⟹", "iff": "⟺", "mapsto": "↦",
+	"in": "∈", "notin": "∉", "ni": "∋", "subset": "⊂", "subseteq": "⊆",
+	"supset": "⊃", "supseteq": "⊇", "cup": "∪", "cap": "∩", "setminus": "∖",
+	"wedge": "∧", "land": "∧", "vee": "∨", "lor": "∨", "neg": "¬", "lnot": "¬",
+	"forall": "∀", "exists": "∃", "circ": "∘", "bullet": "∙", "ast": "∗",
+	"star": "⋆", "oplus": "⊕", "otimes": "⊗", "perp": "⊥", "parallel": "∥",
+	"mid": "∣", "ldots": "…", "dots": "…", "cdots": "⋯", "vdots": "⋮",
+	"ddots": "⋱", "langle": "⟨", "rangle": "⟩", "lfloor": "⌊", "rfloor": "⌋",
+	"lceil": "⌈", "rceil": "⌉", "vert": "|", "Vert": "‖", "|": "‖",
+	"{": "{", "}": "}", "colon": ":", "prime": "′",
+}
+
+// texLargeOperators take their scripts above and below when limits is set.
+var texLargeOperators = map[string]struct {
+	op     string
+	limits bool
+}{
+	"sum":       {"∑", true},
+	"prod":      {"∏", true},
+	"coprod":    {"∐", true},
+	"bigcup":    {"⋃", true},
+	"bigcap":    {"⋂", true},
+	"bigoplus":  {"⨁", true},
+	"bigotimes": {"⨂", true},
+	"int":       {"∫", false},
+	"iint":      {"∬", false},
+	"iiint":     {"∭", false},
+	"oint":      {"∮", false},
+}
+
+var texFunctions = map[string]bool{
+	"sin": false, "cos": false, "tan": false, "cot": false, "sec": false,
+	"csc": false, "arcsin": false, "arccos": false, "arctan": false,
+	"sinh": false, "cosh": false, "tanh": false, "log": false, "ln": false,
+	"lg": false, "exp": false, "det": false, "dim": false, "ker": false,
+	"deg": false, "gcd": false, "arg": false,
+	"lim": true, "max": true, "min": true, "sup": true, "inf": true,
+	"limsup": true, "liminf": true,
+}
+
+var texSpaces = map[string]string{
+	",": "0.1667em", ":": "0.2222em", ">": "0.2222em", ";": "0.2778em",
+	" ": "0.25em", "quad": "1em", "qquad": "2em", "!": "-0.1667em",
+}
+
+var texAccents = map[string]struct {
+	mark  string
+	under bool
+}{
+	"hat": {"^", false}, "widehat": {"^", false}, "bar": {"¯", false},
+	"overline": {"‾", false}, "vec": {"→", false}, "dot": {"˙", false},
+	"ddot": {"¨", false}, "tilde": {"~", false}, "widetilde": {"~", false},
+	"underline": {"_", true},
+}
+
+var texVariants = map[string]string{
+	"mathbb": "double-struck", "mathbf": "bold", "boldsymbol": "bold-italic",
+	"mathcal": "script", "mathfrak": "fraktur", "mathsf": "sans-serif",
+	"mathit": "italic", "mathrm": "normal",
+}
+
+// texEnvironments gives the delimiters around each matrix-like environment.
+var texEnvironments = map[string][2]string{
+	"matrix": {"", ""}, "pmatrix": {"(", ")"}, "bmatrix": {"[", "]"},
+	"Bmatrix": {"{", "}"}, "vmatrix": {"|", "|"}, "Vmatrix": {"‖", "‖"},
+	"cases": {"{", ""}, "aligned": {"", ""}, "gathered": {"", ""},
+}
+
+type texParser struct {
+	toks    []texToken
+	pos     int
+	variant string
+}
+
+func (p *texParser) peek() texToken {
+	for p.pos < len(p.toks) && p.toks[p.pos].kind == texSpace {
+		p.pos++
+	}
+	if p.pos >= len(p.toks) {
+		return texToken{kind: texEOF}
+	}
+	return p.toks[p.pos]
+}
+
+func (p *texParser) next() texToken {
+	t := p.peek()
+	if t.kind != texEOF {
+		p.pos++
+	}
+	return t
+}
+
+func mrow(items []string) string {
+	if len(items) == 1 {
+		return items[0]
+	}
+	return "<mrow>" + strings.Join(items, "") + "</mrow>"
+}
+
+func mo(op string) string {
+	return "<mo>" + html.EscapeString(op) + "</mo>"
+}
+
+func mfence(op string) string {
+	if op == "" {
+		return ""
+	}
+	return `<mo fence="true" stretchy="true">` + html.EscapeString(op) + "</mo>"
+}
+
+func mspace(width string) string {
+	return `<mspace width="` + width + `"></mspace>`
+}
+
+func merror(text string) string {
+	return "<merror><mtext>" + html.EscapeString(text) + "</mtext></merror>"
+}
+
+// parseExpr parses items up to the end of the current group, which is a
+// closing brace, an alignment point, a new row, \right, \end or the
+// character stop.
+func (p *texParser) parseExpr(stop string) ([]string, error) {
+	var items []string
+
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == texEOF, t.kind == texClose, t.kind == texAlign, t.kind == texNewline:
+			return items, nil
+		case t.kind == texCommand && (t.text == "right" || t.text == "end"):
+			return items, nil
+		case t.kind == texChar && stop != "" && t.text == stop:
+			return items, nil
+		}
+
+		item, err := p.parseScripted()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+}
+
+// parseScripted parses an atom with any superscript and subscript.
+func (p *texParser) parseScripted() (string, error) {
+	base, limits, err := p.parseAtom()
+	if err != nil {
+		return "", err
+	}
+
+	var sub, sup string
+	for {
+		t := p.peek()
+		if t.kind == texCommand && (t.text == "limits" || t.text == "nolimits") {
+			p.next()
+			limits = t.text == "limits"
+			continue
+		}
+		if t.kind == texChar && t.text == "'" {
+			p.next()
+			sup += mo("′")
+			continue
+		}
+		if t.kind != texSup && t.kind != texSub {
+			break
+		}
+		p.next()
+
+		arg, err := p.parseArg()
+		if err != nil {
+			return "", err
+		}
+		if t.kind == texSup {
+			if sup != "" {
+				return "", DoubleScriptError
+			}
+			sup = arg
+		} else {
+			if sub != "" {
+				return "", DoubleScriptError
+			}
+			sub = arg
+		}
+	}
+
+	under, over, both := "msub", "msup", "msubsup"
+	if limits {
+		under, over, both = "munder", "mover", "munderover"
+	}
+	switch {
+	case sub != "" && sup != "":
+		return "<" + both + ">" + base + sub + sup + "</" + both + ">", nil
+	case sub != "":
+		return "<" + under + ">" + base + sub + "</" + under + ">", nil
+	case sup != "":
+		return "<" + over + ">" + base + sup + "</" + over + ">", nil
+	}
+	return base, nil
+}
+
+// parseArg parses the argument of a command or script: a group in braces or
+// a single atom.
+func (p *texParser) parseArg() (string, error) {
+	t := p.peek()
+	switch t.kind {
+	case texOpen:
+		p.next()
+		items, err := p.parseExpr("")
+		if err != nil {
+			return "", err
+		}
+		if p.next().kind != texClose {
+			return "", UnbalancedBracesError
+		}
+		return mrow(items), nil
+	case texEOF, texClose, texAlign, texNewline, texSup, texSub:
+		return "", MissingArgumentError
+	}
+
+	arg, _, err := p.parseAtom()
+	return arg, err
+}
+
+// parseRawArg returns the text of a group in braces, for commands such as
+// \text whose argument is not math.
+func (p *texParser) parseRawArg() (string, error) {
+	if p.next().kind != texOpen {
+		return "", MissingArgumentError
+	}
+
+	var b strings.Builder
+	depth := 0
+	for ; p.pos < len(p.toks); p.pos++ {
+		t := p.toks[p.pos]
+		switch t.kind {
+		case texOpen:
+			depth++
+		case texClose:
+			if depth == 0 {
+				p.pos++
+				return b.String(), nil
+			}
+			depth--
+		case texCommand:
+			if width, ok := texSpaces[t.text]; ok && width[0] != '-' {
+				b.WriteString(" ")
+				continue
+			}
+			if len(t.text) == 1 {
+				b.WriteString(t.text)
+				continue
+			}
+		}
+		b.WriteString(t.text)
+	}
+	return "", UnbalancedBracesError
+}
+
+// parseDelimiter parses the delimiter after \left or \right. "." is no
+// delimiter at all.
+func (p *texParser) parseDelimiter() (string, error) {
+	t := p.next()
+	switch t.kind {
+	case texChar:
+		if t.text == "." {
+			return "", nil
+		}
+		return t.text, nil
+	case texCommand:
+		if op, ok := texOperators[t.text]; ok {
+			return op, nil
+		}
+	}
+	return "", MissingArgumentError
+}
+
+// parseAtom parses a single character, group or command. limits reports
+// whether scripts on it go above and below rather than to the side.
+func (p *texParser) parseAtom() (string, bool, error) {
+	t := p.next()
+
+	switch t.kind {
+	case texOpen:
+		items, err := p.parseExpr("")
+		if err != nil {
+			return "", false, err
+		}
+		if p.next().kind != texClose {
+			return "", false, UnbalancedBracesError
+		}
+		return mrow(items), false, nil
+
+	case texClose:
+		return "", false, UnbalancedBracesError
+
+	case texSup, texSub:
+		// A script with no base, as in {}^{14}C.
+		p.pos--
+		return "<mrow></mrow>", false, nil
+
+	case texChar:
+		return p.parseChar(t.text), false, nil
+
+	case texCommand:
+		return p.parseCommand(t.text)
+	}
+
+	return "", false, MissingArgumentError
+}
+
+func (p *texParser) mi(c string) string {
+	if p.variant != "" {
+		return `<mi mathvariant="` + p.variant + `">` + html.EscapeString(c) + "</mi>"
+	}
+	return "<mi>" + html.EscapeString(c) + "</mi>"
+}
+
+func (p *texParser) parseChar(c string) string {
+	r := []rune(c)[0]
+
+	switch {
+	case unicode.IsDigit(r):
+		number := c
+		for {
+			t := p.peek()
+			if t.kind != texChar || !(unicode.IsDigit([]rune(t.text)[0]) || t.text == ".") {
+				break
+			}
+			p.next()
+			number += t.text
+		}
+		return "<mn>" + number + "</mn>"
+
+	case unicode.IsLetter(r):
+		return p.mi(c)
+
+	case c == "-":
+		return mo("−")
+	case c == "*":
+		return mo("∗")
+	case c == "'":
+		return mo("′")
+	case c == "~":
+		return mspace(texSpaces[" "])
+	}
+
+	return mo(c)
+}
+
+func (p *texParser) parseCommand(name string) (string, bool, error) {
+	if c, ok := texIdentifiers[name]; ok {
+		return p.mi(c), false, nil
+	}
+	if op, ok := texOperators[name]; ok {
+		return mo(op), false, nil
+	}
+	if op, ok := texLargeOperators[name]; ok {
+		return `<mo largeop="true">` + op.op + "</mo>", op.limits, nil
+	}
+	if limits, ok := texFunctions[name]; ok {
+		return "<mi>" + name + "</mi>", limits, nil
+	}
+	if width, ok := texSpaces[name]; ok {
+		return mspace(width), false, nil
+	}
+
+	if accent, ok := texAccents[name]; ok {
+		arg, err := p.parseArg()
+		if err != nil {
+			return "", false, err
+		}
+		if accent.under {
+			return `<munder accentunder="true">` + arg + `<mo stretchy="true">` + accent.mark + "</mo></munder>", false, nil
+		}
+		return `<mover accent="true">` + arg + `<mo stretchy="true">` + accent.mark + "</mo></mover>", false, nil
+	}
+
+	if variant, ok := texVariants[name]; ok {
+		outer := p.variant
+		p.variant = variant
+		arg, err := p.parseArg()
+		p.variant = outer
+		return arg, false, err
+	}
+
+	switch name {
+	case "frac", "dfrac", "tfrac", "binom":
+		num, err := p.parseArg()
+		if err != nil {
+			return "", false, err
+		}
+		den, err := p.parseArg()
+		if err != nil {
+			return "", false, err
+		}
+		if name == "binom" {
+			return "<mrow>" + mo("(") + `<mfrac linethickness="0">` + num + den + "</mfrac>" + mo(")") + "</mrow>", false, nil
+		}
+		return "<mfrac>" + num + den + "</mfrac>", false, nil
+
+	case "sqrt":
+		if t := p.peek(); t.kind == texChar && t.text == "[" {
+			p.next()
+			index, err := p.parseExpr("]")
+			if err != nil {
+				return "", false, err
+			}
+			if t := p.next(); t.kind != texChar || t.text != "]" {
+				return "", false, UnbalancedBracesError
+			}
+			arg, err := p.parseArg()
+			if err != nil {
+				return "", false, err
+			}
+			return "<mroot>" + arg + mrow(index) + "</mroot>", false, nil
+		}
+		arg, err := p.parseArg()
+		if err != nil {
+			return "", false, err
+		}
+		return "<msqrt>" + arg + "</msqrt>", false, nil
+
+	case "text", "textrm", "mbox":
+		text, err := p.parseRawArg()
+		if err != nil {
+			return "", false, err
+		}
+		return "<mtext>" + html.EscapeString(text) + "</mtext>", false, nil
+
+	case "operatorname":
+		text, err := p.parseRawArg()
+		if err != nil {
+			return "", false, err
+		}
+		return "<mi>" + html.EscapeString(text) + "</mi>", false, nil
+
+	case "left":
+		open, err := p.parseDelimiter()
+		if err != nil {
+			return "", false, err
+		}
+		items, err := p.parseExpr("")
+		if err != nil {
+			return "", false, err
+		}
+		if t := p.next(); t.kind != texCommand || t.text != "right" {
+			return "", false, UnbalancedLeftError
+		}
+		close, err := p.parseDelimiter()
+		if err != nil {
+			return "", false, err
+		}
+		return "<mrow>" + mfence(open) + strings.Join(items, "") + mfence(close) + "</mrow>", false, nil
+
+	case "begin":
+		env, err := p.parseRawArg()
+		if err != nil {
+			return "", false, err
+		}
+		delims, ok := texEnvironments[env]
+		if !ok {
+			return merror(`\begin{` + env + `}`), false, nil
+		}
+		rows, err := p.parseRows()
+		if err != nil {
+			return "", false, err
+		}
+		if t := p.next(); t.kind != texCommand || t.text != "end" {
+			return "", false, UnbalancedEnvironmentError
+		}
+		if end, err := p.parseRawArg(); err != nil || end != env {
+			return "", false, UnbalancedEnvironmentError
+		}
+		return "<mrow>" + mfence(delims[0]) + mtable(env, rows) + mfence(delims[1]) + "</mrow>", false, nil
+	}
+
+	return merror(`\` + name), false, nil
+}
+
+// parseRows parses rows separated by \\ of cells separated by &.
+func (p *texParser) parseRows() ([][]string, error) {
+	var rows [][]string
+	var row []string
+
+	for {
+		items, err := p.parseExpr("")
+		if err != nil {
+			return nil, err
+		}
+		row = append(row, mrow(items))
+
+		t := p.peek()
+		if t.kind == texAlign {
+			p.next()
+			continue
+		}
+		rows = append(rows, row)
+		row = nil
+		if t.kind != texNewline {
+			break
+		}
+		p.next()
+	}
+
+	// A trailing \\ leaves an empty last row.
+	if last := rows[len(rows)-1]; len(rows) > 1 && len(last) == 1 && last[0] == "<mrow></mrow>" {
+		rows = rows[:len(rows)-1]
+	}
+	return rows, nil
+}
+
+func mtable(env string, rows [][]string) string {
+	attrs := ""
+	switch env {
+	case "aligned":
+		attrs = ` columnalign="right left" columnspacing="0"`
+	case "cases":
+		attrs = ` columnalign="left left"`
+	}
+
+	var b strings.Builder
+	b.WriteString("<mtable" + attrs + ">")
+	for _, row := range rows {
+		b.WriteString("<mtr>")
+		for _, cell := range row {
+			b.WriteString("<mtd>" + cell + "</mtd>")
+		}
+		b.WriteString("</mtr>")
+	}
+	b.WriteString("</mtable>")
+	return b.String()
+}
+
+// TeXToMathML converts a LaTeX equation into a MathML block. Several lines
+// separated by \\, optionally aligned at &, are laid out as in the aligned
+// environment.
+func TeXToMathML(src string) (template.HTML, error) {
+	p := &texParser{toks: tokenizeTeX(src)}
+
+	rows, err := p.parseRows()
+	if err != nil {
+		return "", err
+	}
+	if p.peek().kind != texEOF {
+		// Only a stray closing brace, \right or \end ends the rows early.
+		return "", UnbalancedBracesError
+	}
+
+	body := mtable("aligned", rows)
+	if len(rows) == 1 && len(rows[0]) == 1 {
+		body = rows[0][0]
+	}
+
+	return template.HTML(`<math xmlns="http://www.w3.org/1998/Math/MathML" display="block"><semantics>` +
+		body +
+		`<annotation encoding="application/x-tex">` + html.EscapeString(src) + "</annotation></semantics></math>"), nil
+}
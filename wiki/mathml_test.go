@@ -0,0 +1,42 @@
+package wiki
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTeXToMathML(t *testing.T) {
+	for _, c := range []struct {
+		tex  string
+		want string
+	}{
+		{`x^2`, `<msup><mi>x</mi><mn>2</mn></msup>`},
+		{`a_{ij}^{2}`, `<msubsup><mi>a</mi><mrow><mi>i</mi><mi>j</mi></mrow><mn>2</mn></msubsup>`},
+		{`\frac{1}{2} < 3.14`, `<mrow><mfrac><mn>1</mn><mn>2</mn></mfrac><mo>&lt;</mo><mn>3.14</mn></mrow>`},
+		{`\sqrt[3]{x}`, `<mroot><mi>x</mi><mn>3</mn></mroot>`},
+		{`\sum_{n=1}^\infty`, `<munderover><mo largeop="true">∑</mo><mrow><mi>n</mi><mo>=</mo><mn>1</mn></mrow><mi>∞</mi></munderover>`},
+		{`\sin\theta`, `<mrow><mi>sin</mi><mi>θ</mi></mrow>`},
+		{`\mathbb{R}`, `<mi mathvariant="double-struck">R</mi>`},
+		{`\text{if } x`, `<mrow><mtext>if </mtext><mi>x</mi></mrow>`},
+		{`\left( a \right.`, `<mrow><mo fence="true" stretchy="true">(</mo><mi>a</mi></mrow>`},
+		{`\begin{pmatrix}1&0\\0&1\end{pmatrix}`, `<mrow><mo fence="true" stretchy="true">(</mo><mtable><mtr><mtd><mn>1</mn></mtd><mtd><mn>0</mn></mtd></mtr><mtr><mtd><mn>0</mn></mtd><mtd><mn>1</mn></mtd></mtr></mtable><mo fence="true" stretchy="true">)</mo></mrow>`},
+		{`a &= b \\ &= c`, `<mtable columnalign="right left" columnspacing="0"><mtr><mtd><mi>a</mi></mtd><mtd><mrow><mo>=</mo><mi>b</mi></mrow></mtd></mtr><mtr><mtd><mrow></mrow></mtd><mtd><mrow><mo>=</mo><mi>c</mi></mrow></mtd></mtr></mtable>`},
+		{`\foo`, `<merror><mtext>\foo</mtext></merror>`},
+	} {
+		got, err := TeXToMathML(c.tex)
+		if err != nil {
+			t.Errorf("TeXToMathML(%q): %v", c.tex, err)
+			continue
+		}
+		prefix := `<math xmlns="http://www.w3.org/1998/Math/MathML" display="block"><semantics>`
+		if !strings.HasPrefix(string(got), prefix+c.want+`<annotation`) {
+			t.Errorf("TeXToMathML(%q) = %s", c.tex, got)
+		}
+	}
+
+	for _, tex := range []string{`{x`, `x}`, `\frac{1}`, `x^2^3`, `\left( x`, `\begin{matrix} x`} {
+		if got, err := TeXToMathML(tex); err == nil {
+			t.Errorf("TeXToMathML(%q) = %s, want an error", tex, got)
+		}
+	}
+}
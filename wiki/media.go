@@ -0,0 +1,227 @@
+package wiki
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+
+	"github.com/MerryMage/libellus/objstore/commit"
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+// maxMediaUpload is the largest file which can be uploaded into _media.
+const maxMediaUpload = 64 << 20
+
+var (
+	KnowledgeNotFoundError error = errors.New("wiki: knowledge not found")
+	InvalidMediaNameError  error = errors.New("wiki: invalid media file name")
+)
+
+// knowledgeContextKey holds the wikidata.KnowledgeId media: links are
+// resolved against.
+var knowledgeContextKey = parser.NewContextKey()
+
+// mediaURL is where a file in the _media directory of a knowledge is served.
+func mediaURL(kid wikidata.KnowledgeId, name string) string {
+	return "/_media/" + url.PathEscape(string(kid)) + "/" + url.PathEscape(name)
+}
+
+// mediaTransformer points links and images to media:name at the file name in
+// the _media tree of the knowledge being rendered.
+type mediaTransformer struct{}
+
+func (mediaTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	kid, _ := pc.Get(knowledgeContextKey).(wikidata.KnowledgeId)
+	if kid == "" {
+		return
+	}
+
+	resolve := func(dest []byte) []byte {
+		if !bytes.HasPrefix(dest, []byte("media:")) {
+			return dest
+		}
+		name := string(dest[len("media:"):])
+		if unescaped, err := url.PathUnescape(name); err == nil {
+			name = unescaped
+		}
+		return []byte(mediaURL(kid, name))
+	}
+
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.Image:
+			n.Destination = resolve(n.Destination)
+		case *ast.Link:
+			n.Destination = resolve(n.Destination)
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+// mediaExtension adds ![](media:name) references to files in _media to
+// goldmark.
+type mediaExtension struct{}
+
+func (mediaExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithASTTransformers(util.Prioritized(mediaTransformer{}, 100)))
+}
+
+// serveMediaFile serves /_media/<kid>/<name>. The ETag is the oid of the
+// blob, so clients revalidate cheaply when the file is replaced.
+func (wiki *Wiki) serveMediaFile(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/_media/"), "/", 2)
+	if len(parts) != 2 {
+		wiki.invalidPathResponse(w, r)
+		return
+	}
+
+	snap := wiki.config.WikiData.Snapshot()
+	oid, ok := snap.LookupKnowledgeMedia(wikidata.KnowledgeId(parts[0]), parts[1])
+	if !ok {
+		wiki.invalidPathResponse(w, r)
+		return
+	}
+
+	raw, err := wiki.config.Repo.ReadBlob(oid)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("could not read media"))
+		return
+	}
+
+	w.Header().Set("ETag", `"`+oid.String()+`"`)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// Uploaded HTML or SVG must not run scripts on the wiki's origin.
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	http.ServeContent(w, r, parts[1], time.Time{}, bytes.NewReader(raw))
+}
+
+// uploadMedia commits data as the file name in the _media tree of the
+// knowledge kid, replacing any file of that name.
+func (wiki *Wiki) uploadMedia(kid wikidata.KnowledgeId, name string, data []byte, sig commit.Signature) error {
+	repo := wiki.config.Repo
+	wd := wiki.config.WikiData
+
+	if !wikidata.ValidMediaName(name) {
+		return InvalidMediaNameError
+	}
+	km, ok := wd.Snapshot().LookupKnowledgeMeta(kid)
+	if !ok {
+		return KnowledgeNotFoundError
+	}
+
+	trans, err := repo.StartTransaction(wd.Ref())
+	if err != nil {
+		return err
+	}
+
+	err = trans.AddOrReplace(wikidata.PageTreePath(km.ParentPath)+"/"+string(kid)+"/_media/"+name, data)
+	if err != nil {
+		return err
+	}
+
+	return trans.Store(commit.Commit{
+		Author:    sig,
+		Committer: sig,
+		Message:   "Upload " + name + " to " + string(kid) + "\n",
+	})
+}
+
+type RenderedMediaFile struct {
+	Name string
+	URL  string
+}
+
+type RenderedMedia struct {
+	Knowledge string
+	PagePath  string
+	Files     []RenderedMediaFile
+	CSRFToken string
+	Error     string
+}
+
+// serveMedia lists the media of a knowledge and takes uploads of new files.
+func (wiki *Wiki) serveMedia(w http.ResponseWriter, r *http.Request) {
+	if !wiki.config.Authentication.IsAuthenticated(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return
+	}
+
+	var uploadErr error
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, maxMediaUpload)
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("ParseMultipartForm failure"))
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+		if !wiki.checkCSRF(w, r) {
+			return
+		}
+
+		f, header, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("no file uploaded"))
+			return
+		}
+		defer f.Close()
+
+		name := r.FormValue("name")
+		if name == "" {
+			name = path.Base(header.Filename)
+		}
+
+		data, err := ioutil.ReadAll(f)
+		if err == nil {
+			err = wiki.uploadMedia(wikidata.KnowledgeId(r.FormValue("kid")), name, data, wiki.signature(r))
+		}
+		if err == nil {
+			http.Redirect(w, r, "/_media?kid="+url.QueryEscape(r.FormValue("kid")), http.StatusSeeOther)
+			return
+		}
+		uploadErr = err
+	}
+
+	kid := wikidata.KnowledgeId(r.FormValue("kid"))
+	snap := wiki.config.WikiData.Snapshot()
+	km, ok := snap.LookupKnowledgeMeta(kid)
+	if !ok {
+		wiki.invalidPathResponse(w, r)
+		return
+	}
+
+	rendered := RenderedMedia{
+		Knowledge: string(kid),
+		PagePath:  km.ParentPath,
+		CSRFToken: wiki.config.Authentication.CSRFToken(r),
+	}
+	for _, f := range snap.KnowledgeMedia(kid) {
+		rendered.Files = append(rendered.Files, RenderedMediaFile{
+			Name: f.Name,
+			URL:  mediaURL(kid, f.Name),
+		})
+	}
+	if uploadErr != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		rendered.Error = uploadErr.Error()
+	}
+	wiki.mediaTemplate.Execute(w, rendered)
+}
@@ -0,0 +1,154 @@
+package wiki
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMediaLinks(t *testing.T) {
+	mr := newMarkdownRenderer()
+
+	html, err := mr.Render(nil, "![cat](media:cat.png) [notes](media:my%20notes.pdf) [web](https://example.com/media:x)", "k1", "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`<img src="/_media/k1/cat.png" alt="cat">`, `href="/_media/k1/my%20notes.pdf"`, `href="https://example.com/media:x"`} {
+		if !strings.Contains(string(html), want) {
+			t.Errorf("html = %s, want %s", html, want)
+		}
+	}
+
+	html, err = mr.Render(nil, "![cat](media:cat.png)", "front", "")
+	if err != nil || strings.Contains(string(html), "media") {
+		t.Errorf("html = %s, err = %v", html, err)
+	}
+}
+
+func TestServeMediaFile(t *testing.T) {
+	dir, wiki := tempWiki(t, map[string]string{
+		"_wiki/_page/_info":                `{"Title": "Root"}`,
+		"_wiki/_page/k1/_info":             `{"Type": "markdown"}`,
+		"_wiki/_page/k1/_data.md":          "text",
+		"_wiki/_page/k1/_media/cat.png":    "\x89PNG\r\n\x1a\n",
+		"_wiki/_page/k1/_media/digits.txt": "0123456789",
+	})
+	defer os.RemoveAll(dir)
+	oid, _ := wiki.config.WikiData.Snapshot().LookupKnowledgeMedia("k1", "digits.txt")
+	etag := `"` + oid.String() + `"`
+
+	w := serve(wiki, nil, http.MethodGet, "/_media/k1/cat.png", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" || w.Body.String() != "\x89PNG\r\n\x1a\n" {
+		t.Errorf("code = %d, Content-Type = %q, body = %q", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+
+	w = serve(wiki, nil, http.MethodGet, "/_media/k1/digits.txt", nil)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != etag || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("code = %d, header = %#v", w.Code, w.Header())
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/_media/k1/digits.txt", nil)
+	r.Header.Set("Range", "bytes=2-4")
+	w = httptest.NewRecorder()
+	wiki.ServeHTTP(w, r)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" || w.Header().Get("Content-Range") != "bytes 2-4/10" {
+		t.Errorf("Range: code = %d, body = %q, header = %#v", w.Code, w.Body, w.Header())
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/_media/k1/digits.txt", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	wiki.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("If-None-Match: code = %d, body = %q", w.Code, w.Body)
+	}
+
+	for _, target := range []string{"/_media/k1/missing.png", "/_media/k2/cat.png", "/_media/k1/_info", "/_media/k1"} {
+		if w := serve(wiki, nil, http.MethodGet, target, nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s: code = %d", target, w.Code)
+		}
+	}
+}
+
+func TestUploadMedia(t *testing.T) {
+	dir, wiki := tempWiki(t, map[string]string{
+		"_wiki/_page/_info":       `{"Title": "Root"}`,
+		"_wiki/_page/k1/_info":    `{"Type": "markdown"}`,
+		"_wiki/_page/k1/_data.md": "text",
+	})
+	defer os.RemoveAll(dir)
+
+	for _, data := range []string{"first", "second"} {
+		err := wiki.uploadMedia("k1", "notes.txt", []byte(data), testSignature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		oid, ok := wiki.config.WikiData.Snapshot().LookupKnowledgeMedia("k1", "notes.txt")
+		if !ok {
+			t.Fatalf("notes.txt not found")
+		}
+		if raw, err := wiki.config.Repo.ReadBlob(oid); err != nil || string(raw) != data {
+			t.Errorf("raw = %q, err = %v", raw, err)
+		}
+	}
+
+	for _, name := range []string{"", "_info", ".hidden", "a/b", "..\\x", "nul\x00"} {
+		if err := wiki.uploadMedia("k1", name, []byte("x"), testSignature); err != InvalidMediaNameError {
+			t.Errorf("%q: err = %v", name, err)
+		}
+	}
+	if err := wiki.uploadMedia("k9", "x.txt", []byte("x"), testSignature); err != KnowledgeNotFoundError {
+		t.Errorf("err = %v", err)
+	}
+	if media := wiki.config.WikiData.Snapshot().KnowledgeMedia("k1"); len(media) != 1 {
+		t.Errorf("media = %#v", media)
+	}
+}
+
+func TestServeMediaUpload(t *testing.T) {
+	dir, wiki := tempWiki(t, map[string]string{
+		"_wiki/_page/_info":       `{"Title": "Root"}`,
+		"_wiki/_page/k1/_info":    `{"Type": "markdown"}`,
+		"_wiki/_page/k1/_data.md": "text",
+	})
+	defer os.RemoveAll(dir)
+	cookie := login(t, wiki)
+
+	upload := func(name string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/_media", nil)
+		r.AddCookie(cookie)
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		mw.WriteField("csrf", wiki.config.Authentication.CSRFToken(r))
+		mw.WriteField("kid", "k1")
+		mw.WriteField("name", name)
+		fw, _ := mw.CreateFormFile("file", "upload.bin")
+		fw.Write([]byte("data"))
+		mw.Close()
+
+		r = httptest.NewRequest(http.MethodPost, "/_media", &b)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		wiki.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := upload("notes.txt"); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/_media?kid=k1" {
+		t.Errorf("code = %d, body = %s", w.Code, w.Body)
+	}
+	if _, ok := wiki.config.WikiData.Snapshot().LookupKnowledgeMedia("k1", "notes.txt"); !ok {
+		t.Errorf("notes.txt not found")
+	}
+
+	if w := upload("_info"); w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), InvalidMediaNameError.Error()) {
+		t.Errorf("code = %d, body = %s", w.Code, w.Body)
+	}
+	if media := wiki.config.WikiData.Snapshot().KnowledgeMedia("k1"); len(media) != 1 || media[0].Name != "notes.txt" {
+		t.Errorf("media = %#v", media)
+	}
+}
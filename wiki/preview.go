@@ -0,0 +1,53 @@
+package wiki
+
+import (
+	"net/http"
+
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+// maxPreviewSource is the largest markdown source servePreview renders.
+const maxPreviewSource = 1 << 20
+
+// servePreview renders the posted markdown source as the knowledge kid would
+// be rendered on its page, against the current snapshot, without committing
+// anything. Only the HTML fragment of the knowledge is returned.
+func (wiki *Wiki) servePreview(w http.ResponseWriter, r *http.Request) {
+	if !wiki.config.Authentication.IsAuthenticated(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("invalid method"))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxPreviewSource)
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("ParseForm failure"))
+		return
+	}
+
+	// The knowledge is optional; without one media: links are left alone.
+	snap := wiki.config.WikiData.Snapshot()
+	kid := wikidata.KnowledgeId(r.Form.Get("kid"))
+	if _, ok := snap.LookupKnowledgeMeta(kid); kid != "" && !ok {
+		wiki.invalidPathResponse(w, r)
+		return
+	}
+
+	html, err := wiki.markdown.Render(snap, normalizeNewlines(r.Form.Get("source")), string(kid), kid)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte("could not render markdown: " + err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(html))
+}
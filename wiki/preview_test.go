@@ -0,0 +1,51 @@
+package wiki
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestServePreview(t *testing.T) {
+	dir, wiki := tempWiki(t, map[string]string{
+		"_wiki/_page/_info":       `{"Title": "Root"}`,
+		"_wiki/_page/k1/_info":    `{"Type": "markdown"}`,
+		"_wiki/_page/k1/_data.md": "text",
+		"_wiki/foo/_page/_info":   `{"Title": "Foo"}`,
+	})
+	defer os.RemoveAll(dir)
+	source := "[[/foo]] [[/missing]] {{c1::Paris::city}} ![cat](media:cat.png)\r\n# Head"
+
+	if w := serve(wiki, nil, http.MethodPost, "/_preview", url.Values{"kid": {"k1"}, "source": {source}}); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous: code = %d", w.Code)
+	}
+
+	cookie := login(t, wiki)
+	w := serve(wiki, cookie, http.MethodPost, "/_preview", url.Values{"kid": {"k1"}, "source": {source}})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("code = %d, header = %#v", w.Code, w.Header())
+	}
+	for _, want := range []string{
+		`<a class="wikilink" href="/foo" rel="nofollow">Foo</a>`,
+		`<span class="wikilink broken-link" title="broken link to [[/missing]]">/missing</span>`,
+		`<span class="cloze" title="c1: city">Paris</span>`,
+		`<img src="/_media/k1/cat.png" alt="cat">`,
+		`<h1 id="k1-head">Head</h1>`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("body = %s, want %s", w.Body, want)
+		}
+	}
+	if strings.Contains(w.Body.String(), "<html") {
+		t.Errorf("body is not a fragment: %s", w.Body)
+	}
+
+	if w := serve(wiki, cookie, http.MethodPost, "/_preview", url.Values{"kid": {"k9"}, "source": {source}}); w.Code != http.StatusNotFound {
+		t.Errorf("unknown kid: code = %d", w.Code)
+	}
+	if w := serve(wiki, cookie, http.MethodGet, "/_preview?kid=k1", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: code = %d", w.Code)
+	}
+}
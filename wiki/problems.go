@@ -0,0 +1,50 @@
+package wiki
+
+import (
+	"net/http"
+)
+
+type RenderedProblem struct {
+	Path     string
+	Severity string
+	Kind     string
+	Message  string
+}
+
+// RenderedProblems also lists the review items whose card no longer exists,
+// for example because it was renamed and edited at once.
+type RenderedProblems struct {
+	Commit   string
+	Problems []RenderedProblem
+	Orphans  []string
+}
+
+func (wiki *Wiki) serveProblems(w http.ResponseWriter, r *http.Request) {
+	if !wiki.config.Authentication.IsAuthenticated(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return
+	}
+
+	snap := wiki.config.WikiData.Snapshot()
+	rendered := RenderedProblems{
+		Commit: snap.Revision().Commit.String(),
+	}
+
+	for _, p := range snap.Problems() {
+		rendered.Problems = append(rendered.Problems, RenderedProblem{
+			Path:     p.Path,
+			Severity: p.Severity.String(),
+			Kind:     string(p.Kind),
+			Message:  p.Err.Error(),
+		})
+	}
+
+	if wiki.config.Srs != nil {
+		for _, cid := range wiki.config.Srs.Orphans(snap.CardIds()) {
+			rendered.Orphans = append(rendered.Orphans, string(cid))
+		}
+	}
+
+	wiki.problemsTemplate.Execute(w, rendered)
+}
@@ -0,0 +1,66 @@
+package wiki
+
+import (
+	"log"
+
+	"github.com/MerryMage/libellus/objstore/objid"
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+// reconcileCards moves the review state of the cards renamed between old and
+// new, and records that the state matches new. Cards renamed while the
+// server was down are caught by comparing against the last reconciled
+// commit on startup.
+func (wiki *Wiki) reconcileCards(old *wikidata.Snapshot, new *wikidata.Snapshot) {
+	wiki.reconcileLock.Lock()
+	defer wiki.reconcileLock.Unlock()
+
+	for _, rename := range wikidata.CardRenames(old, new) {
+		err := wiki.config.Srs.RenameCard(rename.From, rename.To)
+		if err != nil {
+			log.Println("reconcile", rename.From, "->", rename.To, "-", err)
+			return
+		}
+	}
+
+	err := wiki.config.Srs.SetReconciled(new.Revision().Commit.String())
+	if err != nil {
+		log.Println("reconcile -", err)
+	}
+}
+
+func (wiki *Wiki) startReconciling() {
+	if wiki.config.Srs == nil {
+		return
+	}
+
+	wiki.config.WikiData.OnRefresh(wiki.reconcileCards)
+
+	current := wiki.config.WikiData.Snapshot()
+	rev, err := wiki.config.Srs.Reconciled()
+	if err != nil {
+		log.Println("reconcile -", err)
+		return
+	}
+	if rev == "" {
+		wiki.reconcileCards(current, current)
+		return
+	}
+
+	coid, err := objid.FromString(rev)
+	if err == nil && coid.Equals(current.Revision().Commit) {
+		return
+	}
+	var old *wikidata.Snapshot
+	if err == nil {
+		old, err = wikidata.SnapshotAt(wiki.config.Repo, coid)
+	}
+	if err != nil {
+		// The commit may have been lost to a rewrite of the branch; any
+		// state which could not be carried over shows up as orphaned.
+		log.Println("reconcile", rev, "-", err)
+		wiki.reconcileCards(current, current)
+		return
+	}
+	wiki.reconcileCards(old, current)
+}
@@ -3,6 +3,7 @@ package wiki
 import (
 	"html/template"
 	"strings"
+	"time"
 
 	"github.com/MerryMage/libellus/wikidata"
 )
@@ -17,13 +18,25 @@ func (rp RenderedPath) Partial(i int) string {
 	return "/" + strings.Join(rp[:i+1], "/")
 }
 
+func (rp RenderedPath) Full() string {
+	return "/" + strings.Join(rp, "/")
+}
+
 func (rp RenderedPath) NotRoot() bool {
 	return !(len(rp) == 1 && rp[0] == "")
 }
 
 type RenderedSubpage struct {
-	Path  string
-	Title string
+	Path           string
+	Title          string
+	LastModified   time.Time
+	LastModifiedBy string
+}
+
+type RenderedBacklink struct {
+	Path      string
+	Title     string
+	Knowledge string
 }
 
 type RenderedKnowledge struct {
@@ -32,32 +45,58 @@ type RenderedKnowledge struct {
 	CardCount    int
 }
 
+// RenderedRevision describes the past revision a page is being viewed at.
+type RenderedRevision struct {
+	Query  string
+	Commit string
+	Author string
+	Time   time.Time
+}
+
 type RenderedPage struct {
 	Authorized bool
+	CSRFToken  string
+	Historical *RenderedRevision
 
-	Title      string
-	Path       RenderedPath
-	Subpages   []RenderedSubpage
-	Knowledges []RenderedKnowledge
+	Title          string
+	Path           RenderedPath
+	Subpages       []RenderedSubpage
+	Knowledges     []RenderedKnowledge
+	Backlinks      []RenderedBacklink
+	LastModified   time.Time
+	LastModifiedBy string
+
+	// SortedByRecency lists the most recently edited subpages first
+	// instead of by name.
+	SortedByRecency bool
 }
 
-func (wiki *Wiki) RenderKnowledge(kid wikidata.KnowledgeId) RenderedKnowledge {
-	km, k := wiki.config.WikiData.LookupKnowledge(kid)
+func (wiki *Wiki) RenderKnowledge(snap *wikidata.Snapshot, kid wikidata.KnowledgeId) RenderedKnowledge {
+	km, k := snap.LookupKnowledge(kid)
 
 	var rendered RenderedKnowledge
 	rendered.CardCount = len(km.Cards)
+	if cm, ok := snap.LookupCardMeta(wikidata.VirtualCardId(kid)); ok && cm.Virtual {
+		rendered.CardCount++
+	}
+
+	rendered.Identifier = string(k.GetInfo().Identifier)
+	if ek, ok := k.(wikidata.ErrorKnowledge); ok {
+		rendered.RenderedHTML = template.HTML(template.HTMLEscapeString(ek.Message))
+		return rendered
+	}
+
+	render, ok := knowledgeRenderers[k.GetInfo().Type]
+	if !ok {
+		rendered.RenderedHTML = template.HTML(template.HTMLEscapeString("no renderer for knowledge type " + k.GetInfo().Type))
+		return rendered
+	}
 
-	switch k := k.(type) {
-	case wikidata.ErrorKnowledge:
-		rendered.Identifier = string(k.Identifier)
-		rendered.RenderedHTML = template.HTML(k.Message)
-	case wikidata.MarkdownKnowledge:
-		rendered.Identifier = string(k.Identifier)
-		rendered.RenderedHTML = template.HTML(k.Markdown)
-	default:
-		rendered.Identifier = "invalid"
-		rendered.RenderedHTML = template.HTML("no idea what's going on")
+	html, err := render(wiki, snap, k)
+	if err != nil {
+		html = template.HTML(template.HTMLEscapeString("could not render " + k.GetInfo().Type + ": " + err.Error()))
 	}
+	rendered.RenderedHTML = html
 
 	return rendered
 }
@@ -0,0 +1,126 @@
+package wiki
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/MerryMage/libellus/objstore/commit"
+	"github.com/MerryMage/libellus/objstore/filemode"
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+var (
+	PageDidNotExistError   error = errors.New("wiki: page did not exist at that revision")
+	KnowledgeConflictError error = errors.New("wiki: a restored knowledge now lives on another page")
+)
+
+func (wiki *Wiki) signature(r *http.Request) commit.Signature {
+	now := time.Now()
+	return commit.Signature{
+		Name:      wiki.config.Authentication.Username,
+		Email:     wiki.config.Authentication.Username + "@" + wiki.config.CanonicalDomain,
+		Timestamp: now.Unix(),
+		Timezone:  now.Format("-0700"),
+	}
+}
+
+// restorePage creates a new commit in which the _page tree of the page at
+// path is as it was at the revision rev. The rest of the wiki is untouched.
+func (wiki *Wiki) restorePage(path string, rev string, sig commit.Signature) error {
+	repo := wiki.config.Repo
+	wd := wiki.config.WikiData
+
+	coid, err := repo.ResolveRevision(rev)
+	if err != nil {
+		return err
+	}
+
+	c, err := repo.Commit(coid)
+	if err != nil {
+		return err
+	}
+
+	treepath := wikidata.PageTreePath(path)
+	oldTree, err := repo.LookupOid(c.Tree, treepath)
+	if err != nil {
+		return err
+	}
+	if oldTree.IsZero() {
+		return PageDidNotExistError
+	}
+
+	trans, err := repo.StartTransaction(wd.Ref())
+	if err != nil {
+		return err
+	}
+
+	// The knowledges have to be checked against the tree the restore is
+	// committed on top of, which the cached snapshot may lag behind.
+	snap := wd.Snapshot()
+	if !snap.Revision().Commit.Equals(trans.Parent()) {
+		snap, err = wikidata.SnapshotAt(repo, trans.Parent())
+		if err != nil {
+			return err
+		}
+	}
+
+	t, err := repo.Tree(oldTree)
+	if err != nil {
+		return err
+	}
+	for _, e := range t.Entries {
+		if e.Name[0] == '_' || e.Mode != filemode.Dir {
+			continue
+		}
+		km, ok := snap.LookupKnowledgeMeta(wikidata.KnowledgeId(e.Name))
+		if ok && km.ParentPath != path {
+			return KnowledgeConflictError
+		}
+	}
+
+	err = trans.ReplaceTree(treepath, oldTree)
+	if err != nil {
+		return err
+	}
+
+	return storeEdit(trans, "Restore "+path+" to "+coid.String()+"\n", sig)
+}
+
+func (wiki *Wiki) serveRestore(w http.ResponseWriter, r *http.Request) {
+	if !wiki.config.Authentication.IsAuthenticated(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("invalid method"))
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("ParseForm failure"))
+		return
+	}
+	if !wiki.checkCSRF(w, r) {
+		return
+	}
+
+	path := r.Form.Get("path")
+	if path == "" || !validatePath(&path) {
+		wiki.invalidPathResponse(w, r)
+		return
+	}
+
+	err := wiki.restorePage(path, r.Form.Get("at"), wiki.signature(r))
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("restore failed: " + err.Error()))
+		return
+	}
+
+	http.Redirect(w, r, path, http.StatusSeeOther)
+}
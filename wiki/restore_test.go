@@ -0,0 +1,86 @@
+package wiki
+
+import (
+	"os"
+	"testing"
+
+	"github.com/MerryMage/libellus/objstore"
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+func TestRestorePage(t *testing.T) {
+	dir, wiki := tempWiki(t, map[string]string{
+		"_wiki/_page/_info":           `{"Title": "Root"}`,
+		"_wiki/foo/_page/_info":       `{"Title": "Foo", "Knowledges": ["k1"]}`,
+		"_wiki/foo/_page/k1/_info":    `{"Type": "markdown"}`,
+		"_wiki/foo/_page/k1/_data.md": "old",
+	})
+	defer os.RemoveAll(dir)
+	repo := wiki.config.Repo
+	rev, err := repo.RefOid("master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commitFiles(t, repo, map[string]string{
+		"_wiki/foo/_page/_info":       `{"Title": "Foo", "Knowledges": ["k1", "k2"]}`,
+		"_wiki/foo/_page/k1/_data.md": "new",
+		"_wiki/foo/_page/k2/_info":    `{"Type": "markdown"}`,
+		"_wiki/foo/_page/k2/_data.md": "text",
+	})
+
+	err = wiki.restorePage("/foo", rev.String(), testSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := wiki.config.WikiData.Snapshot()
+	if _, k := snap.LookupKnowledge("k1"); k.(wikidata.MarkdownKnowledge).Markdown != "old" {
+		t.Errorf("k1 = %#v", k)
+	}
+	if _, ok := snap.LookupKnowledgeMeta("k2"); ok {
+		t.Errorf("k2 still exists")
+	}
+
+	if err := wiki.restorePage("/bar", rev.String(), testSignature); err != PageDidNotExistError {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestRestoreMovedKnowledge(t *testing.T) {
+	dir, wiki := tempWiki(t, map[string]string{
+		"_wiki/_page/_info":           `{"Title": "Root"}`,
+		"_wiki/foo/_page/_info":       `{"Title": "Foo", "Knowledges": ["k1"]}`,
+		"_wiki/foo/_page/k1/_info":    `{"Type": "markdown"}`,
+		"_wiki/foo/_page/k1/_data.md": "text",
+		"_wiki/bar/_page/_info":       `{"Title": "Bar"}`,
+	})
+	defer os.RemoveAll(dir)
+	repo := wiki.config.Repo
+	rev, err := repo.RefOid("master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wiki.moveKnowledge("k1", "/bar", testSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wiki.restorePage("/foo", rev.String(), testSignature); err != KnowledgeConflictError {
+		t.Errorf("err = %v", err)
+	}
+
+	// The knowledge reappears in a commit the wiki has not loaded yet.
+	err = wiki.deletePage("/bar", testSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offline := objstore.NewRepository(dir)
+	commitFiles(t, offline, map[string]string{
+		"_wiki/baz/_page/_info":       `{"Title": "Baz", "Knowledges": ["k1"]}`,
+		"_wiki/baz/_page/k1/_info":    `{"Type": "markdown"}`,
+		"_wiki/baz/_page/k1/_data.md": "text",
+	})
+	if err := wiki.restorePage("/foo", rev.String(), testSignature); err != KnowledgeConflictError {
+		t.Errorf("err = %v", err)
+	}
+}
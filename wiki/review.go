@@ -0,0 +1,296 @@
+package wiki
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MerryMage/libellus/srs"
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+const (
+	// newCardsPerDay limits how many cards which have never been reviewed
+	// are introduced each day.
+	newCardsPerDay = 20
+
+	// maxAnswerTime caps the time recorded for a review, so that walking
+	// away from a card does not skew the statistics.
+	maxAnswerTime = time.Minute
+)
+
+// reviewItem is one prompt to be reviewed. A card yields one item, except
+// that a reversible card also yields its reverse and a cloze card yields one
+// item per cloze index. Id keys the item's state in the scheduler.
+type reviewItem struct {
+	Id    wikidata.CardId
+	Meta  wikidata.CardMeta
+	Front string
+	Back  string
+}
+
+// clozeSides returns the front and back of the cloze item for index. The
+// deletions for index are blanked on the front and emphasized on the back;
+// other deletions are shown as plain text.
+func clozeSides(text string, index int) (string, string) {
+	front := wikidata.ReplaceCloze(text, func(d wikidata.ClozeDeletion) string {
+		if d.Index != index {
+			return d.Answer
+		}
+		if d.Hint != "" {
+			return "**[" + d.Hint + "]**"
+		}
+		return "**[…]**"
+	})
+	back := wikidata.ReplaceCloze(text, func(d wikidata.ClozeDeletion) string {
+		if d.Index != index {
+			return d.Answer
+		}
+		return "**" + d.Answer + "**"
+	})
+	return front, back
+}
+
+func reviewItems(meta wikidata.CardMeta, c wikidata.Card) []reviewItem {
+	cid := meta.Identifier
+
+	switch c := c.(type) {
+	case wikidata.BasicCard:
+		items := []reviewItem{{Id: cid, Meta: meta, Front: c.Front, Back: c.Back}}
+		if c.Reversible {
+			items = append(items, reviewItem{Id: cid + "/reverse", Meta: meta, Front: c.Back, Back: c.Front})
+		}
+		return items
+
+	case wikidata.ClozeCard:
+		var items []reviewItem
+		for _, index := range c.Indices() {
+			front, back := clozeSides(c.Text, index)
+			items = append(items, reviewItem{
+				Id:    cid + wikidata.CardId("/c"+strconv.Itoa(index)),
+				Meta:  meta,
+				Front: front,
+				Back:  back,
+			})
+		}
+		return items
+	}
+
+	return nil
+}
+
+// subtreeReviewItems returns every review item of the cards on the page at
+// path and its subpages.
+func subtreeReviewItems(snap *wikidata.Snapshot, path string) []reviewItem {
+	var items []reviewItem
+	for _, meta := range snap.Cards(path) {
+		_, c := snap.LookupCard(meta.Identifier)
+		items = append(items, reviewItems(meta, c)...)
+	}
+	return items
+}
+
+func sameDay(a time.Time, b time.Time) bool {
+	return a.Year() == b.Year() && a.YearDay() == b.YearDay()
+}
+
+// reviewQueue returns the items under path which are due at now, most
+// overdue first, followed by as many new items as today's allowance permits.
+func (wiki *Wiki) reviewQueue(snap *wikidata.Snapshot, path string, now time.Time) ([]reviewItem, int, int) {
+	states := wiki.config.Srs.States()
+
+	introduced := 0
+	for _, state := range states {
+		if len(state.Log) > 0 && sameDay(state.Log[0].Time, now) {
+			introduced++
+		}
+	}
+
+	var due, fresh []reviewItem
+	for _, item := range subtreeReviewItems(snap, path) {
+		state, ok := states[item.Id]
+		if !ok {
+			if introduced+len(fresh) < newCardsPerDay {
+				fresh = append(fresh, item)
+			}
+			continue
+		}
+		if state.IsDue(now) {
+			due = append(due, item)
+		}
+	}
+
+	sort.SliceStable(due, func(i, j int) bool {
+		return states[due[i].Id].Due.Before(states[due[j].Id].Due)
+	})
+
+	return append(due, fresh...), len(due), len(fresh)
+}
+
+type RenderedReviewCard struct {
+	Id        string
+	Front     template.HTML
+	Back      template.HTML
+	Show      bool
+	Shown     int64
+	PagePath  string
+	Knowledge string
+	New       bool
+	Reps      int
+	Lapses    int
+}
+
+type RenderedReview struct {
+	Path      string
+	Card      *RenderedReviewCard
+	DueCount  int
+	NewCount  int
+	CSRFToken string
+}
+
+func (rr RenderedReview) Grades() []srs.Grade {
+	return []srs.Grade{srs.Again, srs.Hard, srs.Good, srs.Easy}
+}
+
+func (wiki *Wiki) serveReview(w http.ResponseWriter, r *http.Request) {
+	if !wiki.config.Authentication.IsAuthenticated(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("ParseForm failure"))
+		return
+	}
+
+	path := r.Form.Get("path")
+	if path == "" {
+		path = "/"
+	}
+	if !validatePath(&path) {
+		wiki.invalidPathResponse(w, r)
+		return
+	}
+
+	snap := wiki.config.WikiData.Snapshot()
+
+	if r.Method == http.MethodPost {
+		if wiki.checkCSRF(w, r) {
+			wiki.serveReviewGrade(w, r, snap, path)
+		}
+		return
+	}
+
+	now := time.Now()
+	queue, dueCount, newCount := wiki.reviewQueue(snap, path, now)
+	rendered := RenderedReview{
+		Path:      path,
+		DueCount:  dueCount,
+		NewCount:  newCount,
+		CSRFToken: wiki.config.Authentication.CSRFToken(r),
+	}
+
+	var item *reviewItem
+	if id := r.Form.Get("card"); id != "" {
+		for _, i := range subtreeReviewItems(snap, path) {
+			if string(i.Id) == id {
+				item = &i
+				break
+			}
+		}
+		if item == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("card not found"))
+			return
+		}
+	} else if len(queue) > 0 {
+		item = &queue[0]
+	}
+
+	if item != nil {
+		state, reviewed := wiki.config.Srs.State(item.Id)
+		card := &RenderedReviewCard{
+			Id:        string(item.Id),
+			Show:      r.Form.Get("show") != "",
+			Shown:     now.UnixNano() / int64(time.Millisecond),
+			PagePath:  item.Meta.ParentParentPath,
+			Knowledge: string(item.Meta.ParentIdentifier),
+			New:       !reviewed,
+			Reps:      state.Reps,
+			Lapses:    state.Lapses,
+		}
+
+		var err error
+		card.Front, err = wiki.markdown.Render(snap, item.Front, "front", item.Meta.ParentIdentifier)
+		if err == nil {
+			card.Back, err = wiki.markdown.Render(snap, item.Back, "back", item.Meta.ParentIdentifier)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("could not render card: " + err.Error()))
+			return
+		}
+
+		// The answer is timed from when the front was first shown.
+		if shown, err := strconv.ParseInt(r.Form.Get("shown"), 10, 64); err == nil {
+			card.Shown = shown
+		}
+		rendered.Card = card
+	}
+
+	wiki.reviewTemplate.Execute(w, rendered)
+}
+
+func (wiki *Wiki) serveReviewGrade(w http.ResponseWriter, r *http.Request, snap *wikidata.Snapshot, path string) {
+	id := wikidata.CardId(r.Form.Get("card"))
+	cid := wikidata.CardId(strings.SplitN(string(id), "/", 2)[0])
+
+	// Only items the card actually yields may be graded, or a made-up id
+	// would get a scheduler state of its own.
+	meta, c := snap.LookupCard(cid)
+	found := false
+	for _, item := range reviewItems(meta, c) {
+		if item.Id == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("card not found"))
+		return
+	}
+
+	grade, err := strconv.Atoi(r.Form.Get("grade"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid grade"))
+		return
+	}
+
+	now := time.Now()
+	var took time.Duration
+	if shown, err := strconv.ParseInt(r.Form.Get("shown"), 10, 64); err == nil {
+		took = now.Sub(time.Unix(0, shown*int64(time.Millisecond)))
+		if took < 0 {
+			took = 0
+		} else if took > maxAnswerTime {
+			took = maxAnswerTime
+		}
+	}
+
+	_, err = wiki.config.Srs.Review(id, meta.ParentParentPath, srs.Grade(grade), now, took)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("review failed: " + err.Error()))
+		return
+	}
+
+	http.Redirect(w, r, "/_review?path="+url.QueryEscape(path), http.StatusSeeOther)
+}
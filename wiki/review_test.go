@@ -0,0 +1,97 @@
+package wiki
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+func TestServeReview(t *testing.T) {
+	dir, wiki := tempWiki(t, map[string]string{
+		"_wiki/_page/_info":          `{"Title": "Root"}`,
+		"_wiki/a/_page/_info":        `{"Title": "A"}`,
+		"_wiki/a/_page/k1/_info":     `{"Type": "markdown"}`,
+		"_wiki/a/_page/k1/_data.md":  "text",
+		"_wiki/a/_page/k1/_cards/c1": "Type: reversible\nQuestion\n---\nAnswer\n",
+		"_wiki/a/_page/k1/_cards/c2": "Type: cloze\n\n{{c1::Paris}} is in France.",
+		"_wiki/b/_page/_info":        `{"Title": "B"}`,
+		"_wiki/b/_page/k2/_info":     `{"Type": "markdown"}`,
+		"_wiki/b/_page/k2/_data.md":  "text",
+		"_wiki/b/_page/k2/_cards/c3": "Elsewhere\n---\nBack\n",
+	})
+	defer os.RemoveAll(dir)
+
+	if w := serve(wiki, nil, http.MethodGet, "/_review", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous: code = %d", w.Code)
+	}
+
+	cookie := login(t, wiki)
+	w := serve(wiki, cookie, http.MethodGet, "/_review?path=/a", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "3 new") || strings.Contains(w.Body.String(), "Elsewhere") {
+		t.Errorf("code = %d, body = %s", w.Code, w.Body)
+	}
+
+	w = serve(wiki, cookie, http.MethodGet, "/_review?path=/a&card=c1/reverse&show=1", nil)
+	body := w.Body.String()
+	front := body[strings.Index(body, `class="review-front"`):strings.Index(body, `class="review-back"`)]
+	if w.Code != http.StatusOK || !strings.Contains(front, "Answer") || !strings.Contains(body, `name="csrf" value="`) {
+		t.Errorf("code = %d, body = %s", w.Code, body)
+	}
+
+	if w := serve(wiki, cookie, http.MethodGet, "/_review?path=/a&card=c3", nil); w.Code != http.StatusNotFound {
+		t.Errorf("card outside path: code = %d", w.Code)
+	}
+}
+
+func TestServeReviewGrade(t *testing.T) {
+	dir, wiki := tempWiki(t, map[string]string{
+		"_wiki/_page/_info":        `{"Title": "Root"}`,
+		"_wiki/_page/k1/_info":     `{"Type": "markdown"}`,
+		"_wiki/_page/k1/_data.md":  "text",
+		"_wiki/_page/k1/_cards/c1": "Type: reversible\nQuestion\n---\nAnswer\n",
+		"_wiki/_page/k1/_cards/c2": "Type: cloze\n\n{{c1::Paris}} is in France.",
+		"_wiki/_page/k1/_cards/c3": "Question\n---\nAnswer\n",
+	})
+	defer os.RemoveAll(dir)
+	cookie := login(t, wiki)
+	store := wiki.config.Srs
+
+	if w := serve(wiki, nil, http.MethodPost, "/_review", url.Values{"card": {"c1"}, "grade": {"3"}}); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous: code = %d", w.Code)
+	}
+
+	for _, id := range []string{"c1", "c1/reverse", "c2/c1"} {
+		w := serve(wiki, cookie, http.MethodPost, "/_review", url.Values{"path": {"/"}, "card": {id}, "grade": {"3"}})
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/_review?path=%2F" {
+			t.Errorf("%s: code = %d, Location = %q", id, w.Code, w.Header().Get("Location"))
+		}
+		if state, ok := store.State(wikidata.CardId(id)); !ok || state.Reps != 1 {
+			t.Errorf("%s: state = %#v, %v", id, state, ok)
+		}
+	}
+
+	// Items the card does not yield must not get a state of their own.
+	for _, id := range []string{"c3/reverse", "c2/c2", "c1/c1", "c9", ""} {
+		w := serve(wiki, cookie, http.MethodPost, "/_review", url.Values{"card": {id}, "grade": {"3"}})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%q: code = %d", id, w.Code)
+		}
+		if state, ok := store.State(wikidata.CardId(id)); ok {
+			t.Errorf("%q: state = %#v", id, state)
+		}
+	}
+
+	for _, grade := range []string{"", "x", "0", "5"} {
+		w := serve(wiki, cookie, http.MethodPost, "/_review", url.Values{"card": {"c3"}, "grade": {grade}})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("grade %q: code = %d", grade, w.Code)
+		}
+	}
+	if state, ok := store.State("c3"); ok {
+		t.Errorf("c3: state = %#v", state)
+	}
+}
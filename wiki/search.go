@@ -0,0 +1,26 @@
+package wiki
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/MerryMage/libellus/search"
+)
+
+const searchResultLimit = 50
+
+type RenderedSearch struct {
+	Query   string
+	Results []search.Result
+}
+
+func (wiki *Wiki) serveSearch(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	rendered := RenderedSearch{Query: query}
+	if query != "" {
+		rendered.Results = wiki.config.WikiData.Snapshot().Search(query, searchResultLimit)
+	}
+
+	wiki.searchTemplate.Execute(w, rendered)
+}
@@ -0,0 +1,45 @@
+package wiki
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/MerryMage/libellus/srs"
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+type RenderedStats struct {
+	srs.Statistics
+}
+
+// Percent formats a rate between 0 and 1 as a percentage.
+func (rs RenderedStats) Percent(rate float64) int {
+	return int(rate*100 + 0.5)
+}
+
+func (wiki *Wiki) statistics() srs.Statistics {
+	pages := make(map[wikidata.CardId]string)
+	for _, item := range subtreeReviewItems(wiki.config.WikiData.Snapshot(), "/") {
+		pages[item.Id] = item.Meta.ParentParentPath
+	}
+	return wiki.config.Srs.Statistics(time.Now(), pages)
+}
+
+func (wiki *Wiki) serveStats(w http.ResponseWriter, r *http.Request, asJSON bool) {
+	if !wiki.config.Authentication.IsAuthenticated(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return
+	}
+
+	stats := wiki.statistics()
+
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+		return
+	}
+
+	wiki.statsTemplate.Execute(w, RenderedStats{stats})
+}
@@ -0,0 +1,469 @@
+package wiki
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/MerryMage/libellus/objstore"
+	"github.com/MerryMage/libellus/objstore/commit"
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+var (
+	PageExistsError   error = errors.New("wiki: a page already exists there")
+	MoveIntoSelfError error = errors.New("wiki: a page cannot be moved below itself")
+	RootPageError     error = errors.New("wiki: the root page cannot be moved or deleted")
+	SameLocationError error = errors.New("wiki: already there")
+	NotConfirmedError error = errors.New("wiki: deletion was not confirmed")
+)
+
+// newKnowledgeFiles are the files a new knowledge of each built-in type
+// starts with besides its _info.
+var newKnowledgeFiles = map[string]string{
+	wikidata.MarkdownKnowledgeType:    "_data.md",
+	wikidata.CodeKnowledgeType:        "_data.txt",
+	wikidata.MathKnowledgeType:        "_data.tex",
+	wikidata.TableKnowledgeType:       "_data.csv",
+	wikidata.DefinitionsKnowledgeType: "_data.txt",
+}
+
+// knowledgeDir is the location of the tree of the knowledge kid on the page
+// at path.
+func knowledgeDir(path string, kid wikidata.KnowledgeId) string {
+	return wikidata.PageTreePath(path) + "/" + string(kid)
+}
+
+// pageExists reports whether there is a page with an _info at path.
+func pageExists(snap *wikidata.Snapshot, path string) bool {
+	page, ok := snap.LookupPage(path)
+	return ok && !page.NoInfo
+}
+
+// createPage creates an empty page titled title at path.
+func (wiki *Wiki) createPage(path string, title string, sig commit.Signature) error {
+	repo := wiki.config.Repo
+	wd := wiki.config.WikiData
+
+	if pageExists(wd.Snapshot(), path) {
+		return PageExistsError
+	}
+	if strings.TrimSpace(title) == "" {
+		return EmptyTitleError
+	}
+
+	trans, err := repo.StartTransaction(wd.Ref())
+	if err != nil {
+		return err
+	}
+
+	err = updatePageInfo(repo, trans, path, func(info *pageInfoFields) {
+		info.Title = strings.TrimSpace(title)
+	})
+	if err != nil {
+		return err
+	}
+
+	return storeEdit(trans, "Create "+path+"\n", sig)
+}
+
+// createKnowledge adds an empty knowledge of type typ to the end of the page
+// at path and returns its generated id.
+func (wiki *Wiki) createKnowledge(path string, typ string, sig commit.Signature) (wikidata.KnowledgeId, error) {
+	repo := wiki.config.Repo
+	wd := wiki.config.WikiData
+
+	snap := wd.Snapshot()
+	if !pageExists(snap, path) {
+		return "", PageNotFoundError
+	}
+	if !wikidata.KnownKnowledgeType(typ) {
+		return "", UnknownKnowledgeTypeError
+	}
+
+	kid, err := snap.NewKnowledgeId()
+	if err != nil {
+		return "", err
+	}
+
+	trans, err := repo.StartTransaction(wd.Ref())
+	if err != nil {
+		return "", err
+	}
+
+	info, err := json.Marshal(wikidata.KnowledgeInfo{Type: typ})
+	if err != nil {
+		return "", err
+	}
+	err = trans.Add(knowledgeDir(path, kid)+"/_info", append(info, '\n'))
+	if err != nil {
+		return "", err
+	}
+	if name, ok := newKnowledgeFiles[typ]; ok {
+		err = trans.Add(knowledgeDir(path, kid)+"/"+name, nil)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = updatePageInfo(repo, trans, path, func(info *pageInfoFields) {
+		if len(info.Knowledges) > 0 {
+			info.Knowledges = append(info.Knowledges, kid)
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return kid, storeEdit(trans, "Create "+string(kid)+" on "+path+"\n", sig)
+}
+
+// removeFromOrder drops kid from the knowledge order of the page at path.
+func removeFromOrder(repo *objstore.Repository, trans *objstore.Transaction, path string, kid wikidata.KnowledgeId) error {
+	return updatePageInfo(repo, trans, path, func(info *pageInfoFields) {
+		var order []wikidata.KnowledgeId
+		for _, k := range info.Knowledges {
+			if k != kid {
+				order = append(order, k)
+			}
+		}
+		info.Knowledges = order
+	})
+}
+
+// moveKnowledge moves the knowledge kid, with its cards and media, to the end
+// of the page at dest. Links to it keep working, since they name its id.
+func (wiki *Wiki) moveKnowledge(kid wikidata.KnowledgeId, dest string, sig commit.Signature) error {
+	repo := wiki.config.Repo
+	wd := wiki.config.WikiData
+
+	snap := wd.Snapshot()
+	km, ok := snap.LookupKnowledgeMeta(kid)
+	if !ok {
+		return KnowledgeNotFoundError
+	}
+	if !pageExists(snap, dest) {
+		return PageNotFoundError
+	}
+	if km.ParentPath == dest {
+		return SameLocationError
+	}
+
+	trans, err := repo.StartTransaction(wd.Ref())
+	if err != nil {
+		return err
+	}
+
+	err = trans.MoveTree(knowledgeDir(km.ParentPath, kid), knowledgeDir(dest, kid))
+	if err != nil {
+		return err
+	}
+	err = removeFromOrder(repo, trans, km.ParentPath, kid)
+	if err != nil {
+		return err
+	}
+	err = updatePageInfo(repo, trans, dest, func(info *pageInfoFields) {
+		if len(info.Knowledges) > 0 {
+			info.Knowledges = append(info.Knowledges, kid)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return storeEdit(trans, "Move "+string(kid)+" from "+km.ParentPath+" to "+dest+"\n", sig)
+}
+
+// deleteKnowledge deletes the knowledge kid with its cards and media.
+func (wiki *Wiki) deleteKnowledge(kid wikidata.KnowledgeId, sig commit.Signature) error {
+	repo := wiki.config.Repo
+	wd := wiki.config.WikiData
+
+	km, ok := wd.Snapshot().LookupKnowledgeMeta(kid)
+	if !ok {
+		return KnowledgeNotFoundError
+	}
+
+	trans, err := repo.StartTransaction(wd.Ref())
+	if err != nil {
+		return err
+	}
+
+	err = trans.DeleteTree(knowledgeDir(km.ParentPath, kid))
+	if err != nil {
+		return err
+	}
+	err = removeFromOrder(repo, trans, km.ParentPath, kid)
+	if err != nil {
+		return err
+	}
+
+	return storeEdit(trans, "Delete "+string(kid)+" from "+km.ParentPath+"\n", sig)
+}
+
+// movePage moves the page at src and all of its subpages to dest, and
+// rewrites every wiki link to them to point to their new location.
+func (wiki *Wiki) movePage(src string, dest string, sig commit.Signature) error {
+	repo := wiki.config.Repo
+	wd := wiki.config.WikiData
+
+	if src == "/" {
+		return RootPageError
+	}
+	if src == dest {
+		return SameLocationError
+	}
+	if wikidata.InSubtree(dest, src) {
+		return MoveIntoSelfError
+	}
+	snap := wd.Snapshot()
+	if _, ok := snap.LookupPage(src); !ok {
+		return PageNotFoundError
+	}
+
+	// The links to rewrite are found in snap.
+	trans, err := wiki.startEdit(snap)
+	if err != nil {
+		return err
+	}
+
+	err = trans.MoveTree(wikidata.PageDirPath(src), wikidata.PageDirPath(dest))
+	if err == objstore.PathAlreadyExistsError {
+		return PageExistsError
+	} else if err != nil {
+		return err
+	}
+
+	moved := func(path string) string {
+		if wikidata.InSubtree(path, src) {
+			return dest + path[len(src):]
+		}
+		return path
+	}
+
+	kids := snap.KnowledgesLinkingTo(src)
+	sort.Slice(kids, func(i, j int) bool {
+		return kids[i] < kids[j]
+	})
+	for _, kid := range kids {
+		km, _ := snap.LookupKnowledgeMeta(kid)
+		dir := knowledgeDir(moved(km.ParentPath), kid)
+
+		for _, name := range knowledgeFiles(repo, snap, km) {
+			oid, ok := trans.Lookup(dir + "/" + name)
+			if !ok {
+				continue
+			}
+			raw, err := repo.ReadBlob(oid)
+			if err != nil {
+				return err
+			}
+
+			text := string(raw)
+			rewritten := wikidata.RewriteLinks(text, func(l wikidata.Link) (string, bool) {
+				if l.Kind != wikidata.PageLink || !wikidata.InSubtree(l.Target, src) {
+					return "", false
+				}
+				return moved(l.Target), true
+			})
+			if rewritten == text {
+				continue
+			}
+
+			err = trans.AddOrReplace(dir+"/"+name, []byte(rewritten))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return storeEdit(trans, "Move "+src+" to "+dest+"\n", sig)
+}
+
+// deletePage deletes the page at path with all of its subpages.
+func (wiki *Wiki) deletePage(path string, sig commit.Signature) error {
+	repo := wiki.config.Repo
+	wd := wiki.config.WikiData
+
+	if path == "/" {
+		return RootPageError
+	}
+	if _, ok := wd.Snapshot().LookupPage(path); !ok {
+		return PageNotFoundError
+	}
+
+	trans, err := repo.StartTransaction(wd.Ref())
+	if err != nil {
+		return err
+	}
+
+	err = trans.DeleteTree(wikidata.PageDirPath(path))
+	if err != nil {
+		return err
+	}
+
+	return storeEdit(trans, "Delete "+path+"\n", sig)
+}
+
+type RenderedManagedKnowledge struct {
+	Identifier string
+	Type       string
+	CardCount  int
+}
+
+type RenderedManage struct {
+	Path           string
+	Title          string
+	Subpages       []string
+	Knowledges     []RenderedManagedKnowledge
+	KnowledgeTypes []string
+	CSRFToken      string
+}
+
+// subtreePages returns the paths of the subpages of the page at path, at any
+// depth.
+func subtreePages(snap *wikidata.Snapshot, path string) []string {
+	var pages []string
+	page, ok := snap.LookupPage(path)
+	if !ok {
+		return nil
+	}
+	for _, child := range page.Children {
+		pages = append(pages, child)
+		pages = append(pages, subtreePages(snap, child)...)
+	}
+	return pages
+}
+
+// serveManage shows the forms which restructure the wiki around the page at
+// path.
+func (wiki *Wiki) serveManage(w http.ResponseWriter, r *http.Request) {
+	if !wiki.config.Authentication.IsAuthenticated(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" || !validatePath(&path) {
+		wiki.invalidPathResponse(w, r)
+		return
+	}
+
+	snap := wiki.config.WikiData.Snapshot()
+	page, ok := snap.LookupPage(path)
+	if !ok {
+		wiki.invalidPathResponse(w, r)
+		return
+	}
+
+	rendered := RenderedManage{
+		Path:      path,
+		Title:     page.Title,
+		Subpages:  subtreePages(snap, path),
+		CSRFToken: wiki.config.Authentication.CSRFToken(r),
+	}
+	for _, kid := range page.ActualKnowledges {
+		km, k := snap.LookupKnowledge(kid)
+		rendered.Knowledges = append(rendered.Knowledges, RenderedManagedKnowledge{
+			Identifier: string(kid),
+			Type:       k.GetInfo().Type,
+			CardCount:  len(km.Cards),
+		})
+	}
+	for typ := range knowledgeRenderers {
+		if wikidata.KnownKnowledgeType(typ) {
+			rendered.KnowledgeTypes = append(rendered.KnowledgeTypes, typ)
+		}
+	}
+	sort.Strings(rendered.KnowledgeTypes)
+
+	wiki.manageTemplate.Execute(w, rendered)
+}
+
+// serveStructure performs the restructuring operations posted from the
+// forms of serveManage.
+func (wiki *Wiki) serveStructure(w http.ResponseWriter, r *http.Request) {
+	if !wiki.config.Authentication.IsAuthenticated(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("invalid method"))
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("ParseForm failure"))
+		return
+	}
+	if !wiki.checkCSRF(w, r) {
+		return
+	}
+
+	// Every operation names a page, either to act on or as a destination.
+	path := r.Form.Get("path")
+	if path == "" || !validatePath(&path) {
+		wiki.invalidPathResponse(w, r)
+		return
+	}
+	kid := wikidata.KnowledgeId(r.Form.Get("kid"))
+	confirmed := r.Form.Get("confirm") != ""
+	sig := wiki.signature(r)
+
+	var err error
+	redirect := path
+	switch r.URL.Path {
+	case "/_pages/create":
+		err = wiki.createPage(path, r.Form.Get("title"), sig)
+
+	case "/_pages/move":
+		dest := r.Form.Get("to")
+		if dest == "" || !validatePath(&dest) {
+			wiki.invalidPathResponse(w, r)
+			return
+		}
+		err = wiki.movePage(path, dest, sig)
+		redirect = dest
+
+	case "/_pages/delete":
+		err = NotConfirmedError
+		if confirmed {
+			err = wiki.deletePage(path, sig)
+		}
+		redirect = "/"
+
+	case "/_knowledges/create":
+		kid, err = wiki.createKnowledge(path, r.Form.Get("type"), sig)
+		redirect = "/_edit?kid=" + url.QueryEscape(string(kid))
+
+	case "/_knowledges/move":
+		err = wiki.moveKnowledge(kid, path, sig)
+		redirect = path + "#" + url.PathEscape(string(kid))
+
+	case "/_knowledges/delete":
+		err = NotConfirmedError
+		if confirmed {
+			err = wiki.deleteKnowledge(kid, sig)
+		}
+
+	default:
+		wiki.invalidPathResponse(w, r)
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/_") + " failed: " + err.Error()))
+		return
+	}
+
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
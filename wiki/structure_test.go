@@ -0,0 +1,227 @@
+package wiki
+
+import (
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/MerryMage/libellus/objstore"
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+func TestCreatePage(t *testing.T) {
+	dir, wiki := tempWiki(t, map[string]string{
+		"_wiki/_page/_info": `{"Title": "Root"}`,
+	})
+	defer os.RemoveAll(dir)
+
+	err := wiki.createPage("/foo/bar", " Bar ", testSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page, ok := wiki.config.WikiData.Snapshot().LookupPage("/foo/bar"); !ok || page.Title != "Bar" || page.NoInfo {
+		t.Errorf("page = %#v", page)
+	}
+
+	if err := wiki.createPage("/foo/bar", "Again", testSignature); err != PageExistsError {
+		t.Errorf("err = %v", err)
+	}
+	if err := wiki.createPage("/baz", " ", testSignature); err != EmptyTitleError {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestCreateKnowledge(t *testing.T) {
+	dir, wiki := tempWiki(t, map[string]string{
+		"_wiki/_page/_info":       `{"Title": "Root", "Knowledges": ["k1"]}`,
+		"_wiki/_page/k1/_info":    `{"Type": "markdown"}`,
+		"_wiki/_page/k1/_data.md": "text",
+	})
+	defer os.RemoveAll(dir)
+
+	kid, err := wiki.createKnowledge("/", wikidata.MarkdownKnowledgeType, testSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := wiki.config.WikiData.Snapshot()
+	if km, k := snap.LookupKnowledge(kid); km.ParentPath != "/" || k.GetInfo().Type != wikidata.MarkdownKnowledgeType {
+		t.Errorf("km = %#v, k = %#v", km, k)
+	}
+	if page, _ := snap.LookupPage("/"); !reflect.DeepEqual(page.Knowledges, []wikidata.KnowledgeId{"k1", kid}) {
+		t.Errorf("page.Knowledges = %#v", page.Knowledges)
+	}
+
+	if _, err := wiki.createKnowledge("/", "nonsense", testSignature); err != UnknownKnowledgeTypeError {
+		t.Errorf("err = %v", err)
+	}
+	if _, err := wiki.createKnowledge("/missing", wikidata.MarkdownKnowledgeType, testSignature); err != PageNotFoundError {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestMoveKnowledge(t *testing.T) {
+	dir, wiki := tempWiki(t, map[string]string{
+		"_wiki/_page/_info":           `{"Title": "Root", "Knowledges": ["k1", "k2"]}`,
+		"_wiki/_page/k1/_info":        `{"Type": "markdown"}`,
+		"_wiki/_page/k1/_data.md":     "text",
+		"_wiki/_page/k1/_cards/c1":    "Front\n---\nBack\n",
+		"_wiki/_page/k2/_info":        `{"Type": "markdown"}`,
+		"_wiki/_page/k2/_data.md":     "text",
+		"_wiki/foo/_page/_info":       `{"Title": "Foo", "Knowledges": ["k3"]}`,
+		"_wiki/foo/_page/k3/_info":    `{"Type": "markdown"}`,
+		"_wiki/foo/_page/k3/_data.md": "text",
+	})
+	defer os.RemoveAll(dir)
+
+	err := wiki.moveKnowledge("k1", "/foo", testSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := wiki.config.WikiData.Snapshot()
+	if km, _ := snap.LookupKnowledgeMeta("k1"); km.ParentPath != "/foo" {
+		t.Errorf("km = %#v", km)
+	}
+	if cm, _ := snap.LookupCardMeta("c1"); cm.ParentParentPath != "/foo" {
+		t.Errorf("cm = %#v", cm)
+	}
+	if page, _ := snap.LookupPage("/"); !reflect.DeepEqual(page.Knowledges, []wikidata.KnowledgeId{"k2"}) {
+		t.Errorf("/ Knowledges = %#v", page.Knowledges)
+	}
+	if page, _ := snap.LookupPage("/foo"); !reflect.DeepEqual(page.Knowledges, []wikidata.KnowledgeId{"k3", "k1"}) {
+		t.Errorf("/foo Knowledges = %#v", page.Knowledges)
+	}
+
+	if err := wiki.moveKnowledge("k1", "/foo", testSignature); err != SameLocationError {
+		t.Errorf("err = %v", err)
+	}
+	if err := wiki.moveKnowledge("k2", "/missing", testSignature); err != PageNotFoundError {
+		t.Errorf("err = %v", err)
+	}
+	if err := wiki.moveKnowledge("k9", "/foo", testSignature); err != KnowledgeNotFoundError {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestMovePage(t *testing.T) {
+	dir, wiki := tempWiki(t, map[string]string{
+		"_wiki/_page/_info":         `{"Title": "Root"}`,
+		"_wiki/_page/k1/_info":      `{"Type": "markdown"}`,
+		"_wiki/_page/k1/_data.md":   "[[/foo/bar]], [[/foo|Foo]], [[/foobar]] and `[[/foo]]`",
+		"_wiki/foo/_page/_info":     `{"Title": "Foo"}`,
+		"_wiki/foo/bar/_page/_info": `{"Title": "Bar"}`,
+		"_wiki/foobar/_page/_info":  `{"Title": "Foobar"}`,
+	})
+	defer os.RemoveAll(dir)
+
+	err := wiki.movePage("/foo", "/baz", testSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := wiki.config.WikiData.Snapshot()
+	for path, want := range map[string]bool{"/foo": false, "/foo/bar": false, "/baz": true, "/baz/bar": true, "/foobar": true} {
+		if _, ok := snap.LookupPage(path); ok != want {
+			t.Errorf("LookupPage(%q) = %v", path, ok)
+		}
+	}
+	_, k := snap.LookupKnowledge("k1")
+	if md := k.(wikidata.MarkdownKnowledge).Markdown; md != "[[/baz/bar]], [[/baz|Foo]], [[/foobar]] and `[[/foo]]`" {
+		t.Errorf("Markdown = %q", md)
+	}
+
+	for _, test := range []struct {
+		src, dest string
+		err       error
+	}{
+		{"/baz", "/baz/x", MoveIntoSelfError},
+		{"/baz", "/baz", SameLocationError},
+		{"/", "/x", RootPageError},
+		{"/baz", "/foobar", PageExistsError},
+		{"/missing", "/x", PageNotFoundError},
+	} {
+		if err := wiki.movePage(test.src, test.dest, testSignature); err != test.err {
+			t.Errorf("movePage(%q, %q) = %v, want %v", test.src, test.dest, err, test.err)
+		}
+	}
+
+	// A link added in a commit the wiki has not loaded yet would be missed.
+	offline := objstore.NewRepository(dir)
+	commitFiles(t, offline, map[string]string{
+		"_wiki/_page/k2/_info":    `{"Type": "markdown"}`,
+		"_wiki/_page/k2/_data.md": "[[/baz]]",
+	})
+	if err := wiki.movePage("/baz", "/qux", testSignature); err != EditConflictError {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestDeletePage(t *testing.T) {
+	dir, wiki := tempWiki(t, map[string]string{
+		"_wiki/_page/_info":               `{"Title": "Root"}`,
+		"_wiki/foo/_page/_info":           `{"Title": "Foo"}`,
+		"_wiki/foo/_page/k1/_info":        `{"Type": "markdown"}`,
+		"_wiki/foo/_page/k1/_data.md":     "text",
+		"_wiki/foo/_page/k1/_cards/c1":    "Front\n---\nBack\n",
+		"_wiki/foo/bar/_page/_info":       `{"Title": "Bar"}`,
+		"_wiki/foo/bar/_page/k2/_info":    `{"Type": "markdown"}`,
+		"_wiki/foo/bar/_page/k2/_data.md": "text",
+	})
+	defer os.RemoveAll(dir)
+
+	err := wiki.deletePage("/foo", testSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := wiki.config.WikiData.Snapshot()
+	if _, ok := snap.LookupPage("/foo"); ok {
+		t.Errorf("/foo still exists")
+	}
+	if _, ok := snap.LookupPage("/foo/bar"); ok {
+		t.Errorf("/foo/bar still exists")
+	}
+	if _, ok := snap.LookupKnowledgeMeta("k2"); ok {
+		t.Errorf("k2 still exists")
+	}
+	if _, ok := snap.LookupCardMeta("c1"); ok {
+		t.Errorf("c1 still exists")
+	}
+
+	if err := wiki.deletePage("/", testSignature); err != RootPageError {
+		t.Errorf("err = %v", err)
+	}
+	if err := wiki.deletePage("/foo", testSignature); err != PageNotFoundError {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestCreateEachKnowledgeType(t *testing.T) {
+	dir, wiki := tempWiki(t, map[string]string{
+		"_wiki/_page/_info": `{"Title": "Root"}`,
+	})
+	defer os.RemoveAll(dir)
+	cookie := login(t, wiki)
+
+	w := serve(wiki, cookie, http.MethodGet, "/_manage?path=/", nil)
+	var types []string
+	for _, m := range regexp.MustCompile(`<option value="([a-z]+)"`).FindAllStringSubmatch(w.Body.String(), -1) {
+		types = append(types, m[1])
+	}
+	if len(types) == 0 {
+		t.Fatalf("no knowledge types offered: %s", w.Body)
+	}
+
+	for _, typ := range types {
+		kid, err := wiki.createKnowledge("/", typ, testSignature)
+		if err != nil {
+			t.Fatalf("%s: %v", typ, err)
+		}
+		_, k := wiki.config.WikiData.Snapshot().LookupKnowledge(kid)
+		if _, broken := k.(wikidata.ErrorKnowledge); broken || k.GetInfo().Type != typ {
+			t.Errorf("%s: k = %#v", typ, k)
+		}
+		if w := serve(wiki, cookie, http.MethodGet, "/", nil); w.Code != http.StatusOK {
+			t.Errorf("%s: code = %d", typ, w.Code)
+		}
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"html/template"
 	"net/http"
 	"path"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/MerryMage/libellus/common"
 )
@@ -12,14 +14,40 @@ import (
 type Wiki struct {
 	config *common.Config
 
-	pageTemplate *template.Template
+	pageTemplate        *template.Template
+	brokenLinksTemplate *template.Template
+	searchTemplate      *template.Template
+	problemsTemplate    *template.Template
+	reviewTemplate      *template.Template
+	statsTemplate       *template.Template
+	ankiTemplate        *template.Template
+	mediaTemplate       *template.Template
+	editTemplate        *template.Template
+	manageTemplate      *template.Template
+	history             *historyCache
+	markdown            *markdownRenderer
+
+	reconcileLock sync.Mutex
 }
 
 func NewWiki(config *common.Config) *Wiki {
-	return &Wiki{
-		config:       config,
-		pageTemplate: template.Must(template.New("pageTemplate").Parse(config.StaticData.String("wiki/page_template.html"))),
+	wiki := &Wiki{
+		config:              config,
+		pageTemplate:        template.Must(template.New("pageTemplate").Parse(config.StaticData.String("wiki/page_template.html"))),
+		brokenLinksTemplate: template.Must(template.New("brokenLinksTemplate").Parse(config.StaticData.String("wiki/broken_links_template.html"))),
+		searchTemplate:      template.Must(template.New("searchTemplate").Parse(config.StaticData.String("wiki/search_template.html"))),
+		problemsTemplate:    template.Must(template.New("problemsTemplate").Parse(config.StaticData.String("wiki/problems_template.html"))),
+		reviewTemplate:      template.Must(template.New("reviewTemplate").Parse(config.StaticData.String("wiki/review_template.html"))),
+		statsTemplate:       template.Must(template.New("statsTemplate").Parse(config.StaticData.String("wiki/stats_template.html"))),
+		ankiTemplate:        template.Must(template.New("ankiTemplate").Parse(config.StaticData.String("wiki/anki_template.html"))),
+		mediaTemplate:       template.Must(template.New("mediaTemplate").Parse(config.StaticData.String("wiki/media_template.html"))),
+		editTemplate:        template.Must(template.New("editTemplate").Parse(config.StaticData.String("wiki/edit_template.html"))),
+		manageTemplate:      template.Must(template.New("manageTemplate").Parse(config.StaticData.String("wiki/manage_template.html"))),
+		history:             newHistoryCache(),
+		markdown:            newMarkdownRenderer(),
 	}
+	wiki.startReconciling()
+	return wiki
 }
 
 func (wiki *Wiki) invalidPathResponse(w http.ResponseWriter, r *http.Request) {
@@ -27,6 +55,23 @@ func (wiki *Wiki) invalidPathResponse(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("404"))
 }
 
+func (wiki *Wiki) invalidRevisionResponse(w http.ResponseWriter, r *http.Request, err error) {
+	w.WriteHeader(404)
+	w.Write([]byte("invalid revision: " + err.Error()))
+}
+
+// checkCSRF reports whether the posted form of r, which must already be
+// parsed, carries the CSRF token of the session, and answers 403 Forbidden if
+// it does not.
+func (wiki *Wiki) checkCSRF(w http.ResponseWriter, r *http.Request) bool {
+	if wiki.config.Authentication.ValidCSRFToken(r) {
+		return true
+	}
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte("invalid form, reload the page and try again"))
+	return false
+}
+
 func validatePath(p *string) bool {
 	*p = path.Clean(*p)
 
@@ -43,7 +88,56 @@ func validatePath(p *string) bool {
 	return true
 }
 
+func (wiki *Wiki) serveSpecial(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/_media/") {
+		wiki.serveMediaFile(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, apiPrefix) {
+		wiki.serveAPI(w, r)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/_restore":
+		wiki.serveRestore(w, r)
+	case "/_search":
+		wiki.serveSearch(w, r)
+	case "/_review":
+		wiki.serveReview(w, r)
+	case "/_stats":
+		wiki.serveStats(w, r, false)
+	case "/_stats.json":
+		wiki.serveStats(w, r, true)
+	case "/_anki":
+		wiki.serveAnki(w, r)
+	case "/_anki/export":
+		wiki.serveAnkiExport(w, r)
+	case "/_media":
+		wiki.serveMedia(w, r)
+	case "/_edit":
+		wiki.serveEdit(w, r)
+	case "/_preview":
+		wiki.servePreview(w, r)
+	case "/_manage":
+		wiki.serveManage(w, r)
+	case "/_pages/create", "/_pages/move", "/_pages/delete", "/_knowledges/create", "/_knowledges/move", "/_knowledges/delete":
+		wiki.serveStructure(w, r)
+	case "/_maintenance/broken-links":
+		wiki.brokenLinksTemplate.Execute(w, wiki.config.WikiData.Snapshot().BrokenLinks())
+	case "/_admin/problems":
+		wiki.serveProblems(w, r)
+	default:
+		wiki.invalidPathResponse(w, r)
+	}
+}
+
 func (wiki *Wiki) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/_") {
+		wiki.serveSpecial(w, r)
+		return
+	}
+
 	path := r.URL.Path
 	if !validatePath(&path) {
 		wiki.invalidPathResponse(w, r)
@@ -56,29 +150,82 @@ func (wiki *Wiki) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	page, ok := wiki.config.WikiData.LookupPage(path)
+	snap := wiki.config.WikiData.Snapshot()
+	var historical *RenderedRevision
+
+	if at := r.URL.Query().Get("at"); at != "" {
+		var err error
+		snap, err = wiki.snapshotAt(at)
+		if err != nil {
+			wiki.invalidRevisionResponse(w, r, err)
+			return
+		}
+
+		rev := snap.Revision()
+		historical = &RenderedRevision{
+			Query:  at,
+			Commit: rev.Commit.String(),
+			Author: rev.Author.Name,
+			Time:   rev.Time(),
+		}
+	}
+
+	page, ok := snap.LookupPage(path)
 	if !ok {
 		w.Write([]byte("!ok"))
 		return
 	}
 
 	rendered := RenderedPage{
-		Authorized: wiki.config.Authentication.IsAuthenticated(r),
-		Title:      page.Title,
-		Path:       RenderedPath(strings.Split(path[1:], "/")),
+		Authorized:     wiki.config.Authentication.IsAuthenticated(r),
+		CSRFToken:      wiki.config.Authentication.CSRFToken(r),
+		Title:          page.Title,
+		Path:           RenderedPath(strings.Split(path[1:], "/")),
+		LastModified:   page.History.LastModified.Time(),
+		LastModifiedBy: page.History.LastModified.Author.Name,
+		Historical:     historical,
+
+		SortedByRecency: r.URL.Query().Get("sort") == "recent",
 	}
 
 	for _, v := range page.Children {
-		rendered.Subpages = append(rendered.Subpages, RenderedSubpage{
+		subpage := RenderedSubpage{
 			Path:  v,
 			Title: v,
+		}
+		if child, ok := snap.LookupPage(v); ok {
+			if child.Title != "" {
+				subpage.Title = child.Title
+			}
+			if child.History.LastModified.Valid() {
+				subpage.LastModified = child.History.LastModified.Time()
+				subpage.LastModifiedBy = child.History.LastModified.Author.Name
+			}
+		}
+		rendered.Subpages = append(rendered.Subpages, subpage)
+	}
+	if rendered.SortedByRecency {
+		sort.SliceStable(rendered.Subpages, func(i, j int) bool {
+			return rendered.Subpages[i].LastModified.After(rendered.Subpages[j].LastModified)
 		})
 	}
 
 	for _, kid := range page.ActualKnowledges {
-		k := wiki.RenderKnowledge(kid)
+		k := wiki.RenderKnowledge(snap, kid)
 		rendered.Knowledges = append(rendered.Knowledges, k)
 	}
 
+	for _, bl := range snap.Backlinks(page.Path) {
+		title := bl.SourcePath
+		if source, ok := snap.LookupPage(bl.SourcePath); ok && source.Title != "" {
+			title = source.Title
+		}
+		rendered.Backlinks = append(rendered.Backlinks, RenderedBacklink{
+			Path:      bl.SourcePath,
+			Title:     title,
+			Knowledge: string(bl.Source),
+		})
+	}
+
 	wiki.pageTemplate.Execute(w, rendered)
 }
@@ -0,0 +1,186 @@
+package wiki
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gobuffalo/packr"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/MerryMage/libellus/auth"
+	"github.com/MerryMage/libellus/common"
+	"github.com/MerryMage/libellus/objstore"
+	"github.com/MerryMage/libellus/objstore/commit"
+	"github.com/MerryMage/libellus/objstore/objtype"
+	"github.com/MerryMage/libellus/srs"
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+var testSignature = commit.Signature{Name: "Test", Email: "test@example.com", Timestamp: 1500000000, Timezone: "+0000"}
+
+const (
+	testUsername = "alice"
+	testPassword = "secret"
+)
+
+// tempWiki creates a repository with files, keyed by path, on its master
+// branch and a Wiki following it, which testUsername can log in to.
+func tempWiki(t *testing.T, files map[string]string) (string, *Wiki) {
+	dir, err := ioutil.TempDir("", "wiki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(dir, "refs", "heads"), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := objstore.NewRepository(dir)
+	treeoid, err := repo.Store(objtype.Tree, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	commit.Commit{Author: testSignature, Committer: testSignature, Message: "Initial\n", Tree: treeoid}.Write(&b)
+	coid, err := repo.Store(objtype.Commit, b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "refs", "heads", "master"), []byte(coid.String()+"\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitFiles(t, repo, files)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, _ := json.Marshal(map[string]string{"Username": testUsername, "Password": string(hash)})
+	err = ioutil.WriteFile(filepath.Join(dir, "account.json"), account, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := srs.Open(filepath.Join(dir, "srs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, NewWiki(&common.Config{
+		HttpOnly:       true,
+		Repo:           repo,
+		Authentication: auth.NewAuth(filepath.Join(dir, "account.json"), true),
+		StaticData:     packr.NewBox("../static"),
+		WikiData:       wikidata.New(repo, "master", filepath.Join(dir, "private")),
+		Srs:            store,
+	})
+}
+
+// commitFiles commits files, keyed by path, on top of master.
+func commitFiles(t *testing.T, repo *objstore.Repository, files map[string]string) {
+	trans, err := repo.StartTransaction("master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range files {
+		if err := trans.AddOrReplace(path, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = trans.Store(commit.Commit{Author: testSignature, Committer: testSignature, Message: "Add files\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// login returns the session cookie of testUsername.
+func login(t *testing.T, wiki *Wiki) *http.Cookie {
+	form := url.Values{"username": {testUsername}, "password": {testPassword}}
+	r := httptest.NewRequest(http.MethodPost, "/_auth/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	wiki.config.Authentication.ServeHTTP(w, r)
+
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "libellus" {
+			return c
+		}
+	}
+	t.Fatalf("login failed: %d %s", w.Code, w.Body)
+	return nil
+}
+
+// serve sends a request for target to wiki in the session of cookie, or
+// anonymously if it is nil. A POST sends form along with the CSRF token of
+// the session.
+func serve(wiki *Wiki, cookie *http.Cookie, method string, target string, form url.Values) *httptest.ResponseRecorder {
+	var r *http.Request
+	if method == http.MethodPost {
+		r = httptest.NewRequest(method, target, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		posted := url.Values{"csrf": {wiki.config.Authentication.CSRFToken(r)}}
+		for name, values := range form {
+			posted[name] = values
+		}
+		r = httptest.NewRequest(method, target, strings.NewReader(posted.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		r = httptest.NewRequest(method, target, nil)
+	}
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	wiki.ServeHTTP(w, r)
+	return w
+}
+
+func TestCSRF(t *testing.T) {
+	dir, wiki := tempWiki(t, map[string]string{
+		"_wiki/_page/_info":     `{"Title": "Root"}`,
+		"_wiki/foo/_page/_info": `{"Title": "Foo"}`,
+	})
+	defer os.RemoveAll(dir)
+	cookie := login(t, wiki)
+	if cookie.SameSite != http.SameSiteStrictMode {
+		t.Errorf("cookie.SameSite = %v", cookie.SameSite)
+	}
+
+	for _, token := range []string{"", "forged"} {
+		w := serve(wiki, cookie, http.MethodPost, "/_pages/delete", url.Values{"path": {"/foo"}, "confirm": {"1"}, "csrf": {token}})
+		if w.Code != http.StatusForbidden {
+			t.Errorf("csrf %q: code = %d", token, w.Code)
+		}
+	}
+	if _, ok := wiki.config.WikiData.Snapshot().LookupPage("/foo"); !ok {
+		t.Fatalf("/foo was deleted")
+	}
+
+	w := serve(wiki, cookie, http.MethodGet, "/_manage?path=/foo", nil)
+	if token := wiki.config.Authentication.CSRFToken(httptest.NewRequest(http.MethodGet, "/", nil)); token != "" {
+		t.Errorf("anonymous token = %q", token)
+	}
+	if !strings.Contains(w.Body.String(), `name="csrf" value="`) {
+		t.Errorf("manage form has no token: %s", w.Body)
+	}
+
+	w = serve(wiki, cookie, http.MethodPost, "/_pages/delete", url.Values{"path": {"/foo"}, "confirm": {"1"}})
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("code = %d, body = %s", w.Code, w.Body)
+	}
+	if _, ok := wiki.config.WikiData.Snapshot().LookupPage("/foo"); ok {
+		t.Errorf("/foo was not deleted")
+	}
+}
@@ -0,0 +1,106 @@
+package wiki
+
+import (
+	"html"
+	"net/url"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+
+	"github.com/MerryMage/libellus/wikidata"
+)
+
+// snapshotContextKey holds the *wikidata.Snapshot links are resolved against.
+var snapshotContextKey = parser.NewContextKey()
+
+// revisionContextKey holds the commit a historical view is at, which links
+// carry along so that they stay in that revision.
+var revisionContextKey = parser.NewContextKey()
+
+var KindWikiLink = ast.NewNodeKind("WikiLink")
+
+type wikiLinkNode struct {
+	ast.BaseInline
+
+	Link  wikidata.Link
+	Href  string
+	Label string
+	Ok    bool
+}
+
+func (n *wikiLinkNode) Kind() ast.NodeKind {
+	return KindWikiLink
+}
+
+func (n *wikiLinkNode) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Target": n.Link.Target}, nil)
+}
+
+type wikiLinkParser struct{}
+
+func (wikiLinkParser) Trigger() []byte {
+	return []byte{'['}
+}
+
+func (wikiLinkParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	link, width, ok := wikidata.ScanLink(line)
+	if !ok {
+		return nil
+	}
+	block.Advance(width)
+
+	n := &wikiLinkNode{Link: link, Label: link.Target}
+	if snap, _ := pc.Get(snapshotContextKey).(*wikidata.Snapshot); snap != nil {
+		n.Href, n.Label, n.Ok = snap.ResolveLink(link)
+	}
+	if at, _ := pc.Get(revisionContextKey).(string); at != "" && n.Ok {
+		n.Href = atRevision(n.Href, at)
+	}
+	if link.Label != "" {
+		n.Label = link.Label
+	}
+	return n
+}
+
+// atRevision adds ?at=rev to the page URL href, before any fragment.
+func atRevision(href string, rev string) string {
+	fragment := ""
+	if i := strings.IndexByte(href, '#'); i >= 0 {
+		href, fragment = href[:i], href[i:]
+	}
+	return href + "?at=" + url.QueryEscape(rev) + fragment
+}
+
+type wikiLinkRenderer struct{}
+
+func (wikiLinkRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindWikiLink, renderWikiLink)
+}
+
+func renderWikiLink(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+
+	n := node.(*wikiLinkNode)
+	if n.Ok {
+		w.WriteString(`<a class="wikilink" href="` + html.EscapeString(n.Href) + `">` + html.EscapeString(n.Label) + `</a>`)
+	} else {
+		w.WriteString(`<span class="wikilink broken-link" title="broken link to ` + html.EscapeString(n.Link.String()) + `">` + html.EscapeString(n.Label) + `</span>`)
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+// wikiLinkExtension adds [[/path]] and [[kid:id]] links to goldmark.
+type wikiLinkExtension struct{}
+
+func (wikiLinkExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithInlineParsers(util.Prioritized(wikiLinkParser{}, 199)))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(wikiLinkRenderer{}, 199)))
+}
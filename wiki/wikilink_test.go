@@ -0,0 +1,19 @@
+package wiki
+
+import "testing"
+
+func TestAtRevision(t *testing.T) {
+	tests := []struct {
+		href string
+		want string
+	}{
+		{"/foo", "/foo?at=abc"},
+		{"/foo#k1", "/foo?at=abc#k1"},
+		{"/", "/?at=abc"},
+	}
+	for _, test := range tests {
+		if got := atRevision(test.href, "abc"); got != test.want {
+			t.Errorf("atRevision(%q) = %q, want %q", test.href, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package wikidata
+
+import (
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/MerryMage/libellus/objstore/objid"
+	"github.com/MerryMage/libellus/objstore/tree"
+	"github.com/MerryMage/libellus/search"
+)
+
+// knowledgeCacheVersion must be bumped whenever the analysis of a knowledge
+// or the persisted history changes, so that stale entries on disk are
+// discarded.
+const knowledgeCacheVersion = 6
+
+// knowledgeCacheEntry is everything derived from the contents of a knowledge
+// tree. It depends only on the tree, so it is keyed by the tree's oid and
+// survives the knowledge being moved.
+type knowledgeCacheEntry struct {
+	// Indexed is set if the knowledge has text to search, which Analysis
+	// then holds.
+	Indexed  bool
+	Links    []Link
+	Analysis search.Analysis
+	// Cloze is set if the markdown has cloze deletions; DataOid is then
+	// the oid of the _data.md blob.
+	Cloze   bool
+	DataOid objid.Oid
+}
+
+type persistedKnowledgeCache struct {
+	Version int
+	Entries map[string]knowledgeCacheEntry
+	History *historyBase
+	// Search is the index built for the _wiki tree SearchTree.
+	Search     *search.Index
+	SearchTree objid.Oid
+}
+
+// knowledgeCache persists knowledgeCacheEntries under the private wiki
+// directory, along with the History and the search index of the wiki at the
+// last refresh, so that a restart with an unchanged repository need not
+// walk the history or index anything again. An empty path keeps the cache in
+// memory only.
+type knowledgeCache struct {
+	path    string
+	entries map[objid.Oid]knowledgeCacheEntry
+	history *historyBase
+
+	search     *search.Index
+	searchTree objid.Oid
+
+	dirty bool
+}
+
+func loadKnowledgeCache(dir string) (*knowledgeCache, error) {
+	kc := &knowledgeCache{
+		entries: make(map[objid.Oid]knowledgeCacheEntry),
+	}
+	if dir == "" {
+		return kc, nil
+	}
+	kc.path = filepath.Join(dir, "knowledge_cache.gob")
+
+	f, err := os.Open(kc.path)
+	if os.IsNotExist(err) {
+		return kc, nil
+	} else if err != nil {
+		return kc, err
+	}
+	defer f.Close()
+
+	var persisted persistedKnowledgeCache
+	err = gob.NewDecoder(f).Decode(&persisted)
+	if err != nil || persisted.Version != knowledgeCacheVersion {
+		return kc, err
+	}
+
+	kc.history = persisted.History
+	kc.search = persisted.Search
+	kc.searchTree = persisted.SearchTree
+	for k, v := range persisted.Entries {
+		oid, err := objid.FromString(k)
+		if err != nil {
+			continue
+		}
+		kc.entries[oid] = v
+	}
+
+	return kc, nil
+}
+
+func (kc *knowledgeCache) save() error {
+	if kc.path == "" || !kc.dirty {
+		return nil
+	}
+
+	persisted := persistedKnowledgeCache{
+		Version:    knowledgeCacheVersion,
+		Entries:    make(map[string]knowledgeCacheEntry),
+		History:    kc.history,
+		Search:     kc.search,
+		SearchTree: kc.searchTree,
+	}
+	for k, v := range kc.entries {
+		persisted.Entries[k.String()] = v
+	}
+
+	err := os.MkdirAll(filepath.Dir(kc.path), 0777)
+	if err != nil {
+		return err
+	}
+
+	tmppath := kc.path + ".tmp"
+	f, err := os.Create(tmppath)
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(f).Encode(&persisted)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmppath)
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		os.Remove(tmppath)
+		return err
+	}
+
+	err = os.Rename(tmppath, kc.path)
+	if err != nil {
+		return err
+	}
+
+	kc.dirty = false
+	return nil
+}
+
+// refreshKnowledgeCache analyzes every knowledge whose tree is not already in
+// the cache and drops entries for trees no longer in the wiki.
+func (wd *WikiData) refreshKnowledgeCache(st *Snapshot) {
+	live := make(map[objid.Oid]bool)
+
+	for _, km := range st.knowledges {
+		live[km.TreeOid] = true
+		if _, ok := wd.cache.entries[km.TreeOid]; ok {
+			continue
+		}
+
+		var entry knowledgeCacheEntry
+		k := st.parseKnowledge(km)
+		if tk, ok := k.(TextKnowledge); ok {
+			entry.Indexed = true
+			entry.Analysis = search.Analyze(tk.Text())
+		}
+
+		switch k := k.(type) {
+		case ImageKnowledge:
+			entry.Links = ExtractLinks(k.Caption)
+
+		case DefinitionsKnowledge:
+			for _, d := range k.Definitions {
+				for _, def := range d.Definitions {
+					entry.Links = append(entry.Links, ExtractLinks(def)...)
+				}
+			}
+
+		case MarkdownKnowledge:
+			entry.Links = ExtractLinks(k.Markdown)
+			entry.Analysis = search.Analyze(ReplaceCloze(k.Markdown, func(d ClozeDeletion) string {
+				return d.Answer
+			}))
+
+			entry.DataOid, entry.Cloze = st.clozeData(km, k)
+		}
+
+		wd.cache.entries[km.TreeOid] = entry
+		wd.cache.dirty = true
+	}
+
+	for _, km := range st.knowledges {
+		entry := wd.cache.entries[km.TreeOid]
+		if !entry.Cloze {
+			continue
+		}
+
+		st.addClozeCard(km, entry.DataOid)
+	}
+
+	for oid := range wd.cache.entries {
+		if !live[oid] {
+			delete(wd.cache.entries, oid)
+			wd.cache.dirty = true
+		}
+	}
+}
+
+// clozeData returns the oid of the markdown of k if it has cloze deletions.
+func (st *Snapshot) clozeData(km KnowledgeMeta, k MarkdownKnowledge) (objid.Oid, bool) {
+	if len(ParseCloze(k.Markdown)) == 0 {
+		return objid.Oid{}, false
+	}
+	dataEntry, err := tree.Lookup(st.repo, km.TreeOid, "_data.md")
+	if err != nil {
+		return objid.Oid{}, false
+	}
+	return dataEntry.Oid, true
+}
+
+// addClozeCard adds the virtual card of the cloze knowledge km, unless a card
+// in the wiki already has its id.
+func (st *Snapshot) addClozeCard(km KnowledgeMeta, dataOid objid.Oid) {
+	cid := VirtualCardId(km.Identifier)
+	if other, ok := st.cards[cid]; ok {
+		path := strings.TrimSuffix(km.ParentPath, "/") + "/_page/" + string(km.Identifier)
+		st.clozeProblems = append(st.clozeProblems, RefreshStateErrorInfo{
+			Path:     path,
+			Severity: Error,
+			Kind:     DuplicateCardErrorKind,
+			Err:      errors.New("wikidata/addClozeCard: card id " + strconv.Quote(string(cid)) + " is already used on " + other.ParentParentPath + ", not generating cloze card"),
+		})
+		return
+	}
+	st.cards[cid] = CardMeta{
+		ParentParentPath: km.ParentPath,
+		ParentIdentifier: km.Identifier,
+		Identifier:       cid,
+		BlobOid:          dataOid,
+		Virtual:          true,
+	}
+}
+
+// saveCache persists the cache once a refresh has updated all of it.
+func (wd *WikiData) saveCache() {
+	err := wd.cache.save()
+	if err != nil {
+		wd.addError("/", err)
+	}
+}
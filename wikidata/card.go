@@ -0,0 +1,348 @@
+package wikidata
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ErrorCardType      string = "error"
+	BasicCardType      string = "basic"
+	ReversibleCardType string = "reversible"
+	ClozeCardType      string = "cloze"
+)
+
+// A card blob under _cards is an optional header followed by a body:
+//
+//	ID: capital-of-france
+//	Type: reversible
+//	Tags: geography capitals
+//
+//	What is the capital of France?
+//	---
+//	Paris
+//
+// Header lines are "Key: value" with a known key; the header ends at the
+// first line which is not one. Basic and reversible cards have a front and a
+// back separated by a line containing only "---". Cloze cards have a single
+// text containing deletions such as {{c1::Paris}} or {{c1::Paris::city}}.
+// Media is referenced from the text as media:name.
+//
+// The ID header gives the card an identity which survives renaming its blob
+// or moving its knowledge; without one, a card is identified by its filename.
+type Card interface {
+	cardTag()
+	GetInfo() CardInfo
+}
+
+type CardInfo struct {
+	Identifier CardId
+	Type       string
+	Tags       []string
+	Media      []string
+}
+
+type ErrorCard struct {
+	CardInfo
+	Message string
+}
+
+func (ErrorCard) cardTag() {}
+func (c ErrorCard) GetInfo() CardInfo {
+	return c.CardInfo
+}
+
+func NewErrorCard(msg string) ErrorCard {
+	return ErrorCard{
+		CardInfo: CardInfo{Type: ErrorCardType},
+		Message:  msg,
+	}
+}
+
+// BasicCard asks for Back given Front and, if it is Reversible, also for
+// Front given Back.
+type BasicCard struct {
+	CardInfo
+	Front      string
+	Back       string
+	Reversible bool
+}
+
+func (BasicCard) cardTag() {}
+func (c BasicCard) GetInfo() CardInfo {
+	return c.CardInfo
+}
+
+type ClozeDeletion struct {
+	Index  int
+	Answer string
+	Hint   string
+}
+
+type ClozeCard struct {
+	CardInfo
+	Text      string
+	Deletions []ClozeDeletion
+}
+
+func (ClozeCard) cardTag() {}
+func (c ClozeCard) GetInfo() CardInfo {
+	return c.CardInfo
+}
+
+// Indices returns the distinct cloze indices of c in increasing order.
+func (c ClozeCard) Indices() []int {
+	var indices []int
+	seen := make(map[int]bool)
+	for _, d := range c.Deletions {
+		if !seen[d.Index] {
+			seen[d.Index] = true
+			indices = append(indices, d.Index)
+		}
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+var (
+	clozeRegexp = regexp.MustCompile(`\{\{c([0-9]+)::(.+?)(?:::(.+?))?\}\}`)
+	mediaRegexp = regexp.MustCompile(`media:([^\s()<>"'\[\]]+)`)
+)
+
+func parseClozeMatch(m []string) (ClozeDeletion, bool) {
+	index, err := strconv.Atoi(m[1])
+	if err != nil || index == 0 {
+		return ClozeDeletion{}, false
+	}
+	return ClozeDeletion{
+		Index:  index,
+		Answer: m[2],
+		Hint:   m[3],
+	}, true
+}
+
+// ParseCloze returns every cloze deletion in text, in order of appearance.
+func ParseCloze(text string) []ClozeDeletion {
+	var deletions []ClozeDeletion
+	for _, m := range clozeRegexp.FindAllStringSubmatch(text, -1) {
+		if d, ok := parseClozeMatch(m); ok {
+			deletions = append(deletions, d)
+		}
+	}
+	return deletions
+}
+
+// ReplaceCloze returns text with every cloze deletion replaced by f of it.
+func ReplaceCloze(text string, f func(ClozeDeletion) string) string {
+	return clozeRegexp.ReplaceAllStringFunc(text, func(match string) string {
+		d, ok := parseClozeMatch(clozeRegexp.FindStringSubmatch(match))
+		if !ok {
+			return match
+		}
+		return f(d)
+	})
+}
+
+func extractMedia(texts ...string) []string {
+	var media []string
+	seen := make(map[string]bool)
+	for _, text := range texts {
+		for _, m := range mediaRegexp.FindAllStringSubmatch(text, -1) {
+			if !seen[m[1]] {
+				seen[m[1]] = true
+				media = append(media, m[1])
+			}
+		}
+	}
+	return media
+}
+
+// parseCardHeader splits raw into its header fields and body. Keys are
+// lowercased.
+func parseCardHeader(raw string) (map[string]string, string) {
+	header := make(map[string]string)
+
+	for {
+		line := raw
+		rest := ""
+		if i := strings.IndexByte(raw, '\n'); i != -1 {
+			line, rest = raw[:i], raw[i+1:]
+		}
+
+		colon := strings.IndexByte(line, ':')
+		if colon == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:colon]))
+		if key != "id" && key != "type" && key != "tags" {
+			break
+		}
+
+		header[key] = strings.TrimSpace(line[colon+1:])
+		raw = rest
+	}
+
+	return header, strings.TrimLeft(raw, "\r\n")
+}
+
+// cardHeaderId returns the ID header of the card blob raw, if it has one.
+func cardHeaderId(raw []byte) (CardId, bool) {
+	header, _ := parseCardHeader(string(raw))
+	id, ok := header["id"]
+	return CardId(id), ok
+}
+
+// validCardId reports whether id can identify a card. A slash is reserved
+// for separating a card from the items reviewed from it, such as its reverse.
+func validCardId(id CardId) bool {
+	if id == "" || id[0] == '_' {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// splitCardSides splits body at its first line containing only "---".
+func splitCardSides(body string) (string, string, bool) {
+	lines := strings.SplitAfter(body, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "---" {
+			front := strings.Join(lines[:i], "")
+			back := strings.Join(lines[i+1:], "")
+			return strings.TrimSpace(front), strings.TrimSpace(back), true
+		}
+	}
+	return "", "", false
+}
+
+// ParseCard parses the contents of the card blob cid.
+func ParseCard(cid CardId, raw []byte) Card {
+	header, body := parseCardHeader(string(raw))
+
+	info := CardInfo{
+		Identifier: cid,
+		Type:       strings.ToLower(header["type"]),
+		Tags:       strings.Fields(strings.Replace(header["tags"], ",", " ", -1)),
+	}
+	if info.Type == "" {
+		info.Type = BasicCardType
+	}
+
+	switch info.Type {
+	case BasicCardType, ReversibleCardType:
+		front, back, ok := splitCardSides(body)
+		if !ok {
+			return ErrorCard{CardInfo: info, Message: "card " + string(cid) + " has no --- line between its front and back"}
+		}
+		if front == "" || back == "" {
+			return ErrorCard{CardInfo: info, Message: "card " + string(cid) + " has an empty side"}
+		}
+		info.Media = extractMedia(front, back)
+		return BasicCard{
+			CardInfo:   info,
+			Front:      front,
+			Back:       back,
+			Reversible: info.Type == ReversibleCardType,
+		}
+
+	case ClozeCardType:
+		text := strings.TrimSpace(body)
+		deletions := ParseCloze(text)
+		if len(deletions) == 0 {
+			return ErrorCard{CardInfo: info, Message: "cloze card " + string(cid) + " has no deletions"}
+		}
+		info.Media = extractMedia(text)
+		return ClozeCard{
+			CardInfo:  info,
+			Text:      text,
+			Deletions: deletions,
+		}
+
+	case ErrorCardType:
+		return ErrorCard{CardInfo: info, Message: "wild ErrorCardType found in card " + string(cid)}
+	}
+
+	return ErrorCard{CardInfo: info, Message: "unknown card type " + strconv.Quote(info.Type) + " in card " + string(cid)}
+}
+
+// VirtualCardId is the id of the card generated from the cloze deletions in
+// the markdown of the knowledge kid.
+func VirtualCardId(kid KnowledgeId) CardId {
+	return CardId(kid) + ".cloze"
+}
+
+// MatchCloze parses the cloze deletion at the start of text, returning it
+// and its length in bytes.
+func MatchCloze(text string) (ClozeDeletion, int, bool) {
+	loc := clozeRegexp.FindStringSubmatchIndex(text)
+	if loc == nil || loc[0] != 0 {
+		return ClozeDeletion{}, 0, false
+	}
+
+	m := make([]string, 4)
+	for i := range m {
+		if loc[2*i] >= 0 {
+			m[i] = text[loc[2*i]:loc[2*i+1]]
+		}
+	}
+	d, ok := parseClozeMatch(m)
+	return d, loc[1], ok
+}
+
+func (s *Snapshot) parseCard(cid CardId) (CardMeta, Card) {
+	meta, ok := s.cards[cid]
+	if !ok {
+		return CardMeta{
+			ParentParentPath: "/_error",
+			Identifier:       cid,
+		}, NewErrorCard("cid \"" + string(cid) + "\" not found")
+	}
+
+	raw, err := s.repo.ReadBlob(meta.BlobOid)
+	if err != nil {
+		return meta, ErrorCard{
+			CardInfo: CardInfo{Identifier: cid, Type: ErrorCardType},
+			Message:  "could not read card " + string(cid) + ": " + err.Error(),
+		}
+	}
+
+	if meta.Virtual {
+		text := string(raw)
+		return meta, ClozeCard{
+			CardInfo: CardInfo{
+				Identifier: cid,
+				Type:       ClozeCardType,
+				Media:      extractMedia(text),
+			},
+			Text:      text,
+			Deletions: ParseCloze(text),
+		}
+	}
+
+	return meta, ParseCard(cid, raw)
+}
+
+// Cards returns the cards of every knowledge on the page at path and its
+// subpages, sorted by page and then by identifier.
+func (s *Snapshot) Cards(path string) []CardMeta {
+	var cards []CardMeta
+	for _, cm := range s.cards {
+		if InSubtree(cm.ParentParentPath, path) {
+			cards = append(cards, cm)
+		}
+	}
+
+	sort.Slice(cards, func(i, j int) bool {
+		if cards[i].ParentParentPath != cards[j].ParentParentPath {
+			return cards[i].ParentParentPath < cards[j].ParentParentPath
+		}
+		return cards[i].Identifier < cards[j].Identifier
+	})
+	return cards
+}
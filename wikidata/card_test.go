@@ -0,0 +1,117 @@
+package wikidata
+
+import (
+	"testing"
+
+	"github.com/MerryMage/libellus/objstore/objid"
+)
+
+func TestParseBasicCard(t *testing.T) {
+	c := ParseCard("c1", []byte("Tags: geo, capitals\n\nWhat is the capital of France?\n---\nParis ![](media:paris.jpg)\n"))
+
+	bc, ok := c.(BasicCard)
+	if !ok {
+		t.Fatalf("c = %#v", c)
+	}
+	if bc.Front != "What is the capital of France?" || bc.Back != "Paris ![](media:paris.jpg)" || bc.Reversible {
+		t.Errorf("bc = %#v", bc)
+	}
+	if len(bc.Tags) != 2 || bc.Tags[0] != "geo" || bc.Tags[1] != "capitals" {
+		t.Errorf("bc.Tags = %#v", bc.Tags)
+	}
+	if len(bc.Media) != 1 || bc.Media[0] != "paris.jpg" {
+		t.Errorf("bc.Media = %#v", bc.Media)
+	}
+}
+
+func TestParseReversibleCard(t *testing.T) {
+	c := ParseCard("c2", []byte("Type: reversible\nQ: front\n---\nback"))
+
+	bc, ok := c.(BasicCard)
+	if !ok || !bc.Reversible || bc.Type != ReversibleCardType || bc.Front != "Q: front" || bc.Back != "back" {
+		t.Errorf("c = %#v", c)
+	}
+}
+
+func TestParseClozeCard(t *testing.T) {
+	c := ParseCard("c3", []byte("Type: cloze\n\n{{c2::Paris::city}} is the capital of {{c1::France}}, as is {{c2::Paris}}."))
+
+	cc, ok := c.(ClozeCard)
+	if !ok {
+		t.Fatalf("c = %#v", c)
+	}
+	if len(cc.Deletions) != 3 || cc.Deletions[0] != (ClozeDeletion{Index: 2, Answer: "Paris", Hint: "city"}) || cc.Deletions[1] != (ClozeDeletion{Index: 1, Answer: "France"}) {
+		t.Errorf("cc.Deletions = %#v", cc.Deletions)
+	}
+	if indices := cc.Indices(); len(indices) != 2 || indices[0] != 1 || indices[1] != 2 {
+		t.Errorf("cc.Indices() = %#v", indices)
+	}
+}
+
+func TestParseBadCards(t *testing.T) {
+	for _, raw := range []string{
+		"no separator",
+		"front\n---\n",
+		"Type: cloze\nno deletions",
+		"Type: nonsense\na\n---\nb",
+	} {
+		if c, ok := ParseCard("bad", []byte(raw)).(ErrorCard); !ok || c.Message == "" {
+			t.Errorf("ParseCard(%q) = %#v", raw, c)
+		}
+	}
+}
+
+func TestCardHeaderId(t *testing.T) {
+	id, ok := cardHeaderId([]byte("ID: capital-of-france\nType: reversible\nfront\n---\nback"))
+	if !ok || id != "capital-of-france" || !validCardId(id) {
+		t.Errorf("id = %#v", id)
+	}
+	if id, ok := cardHeaderId([]byte("front: with colon\n---\nback")); ok {
+		t.Errorf("id = %#v", id)
+	}
+	for _, id := range []CardId{"", "a/b", "_x", "a b"} {
+		if validCardId(id) {
+			t.Errorf("validCardId(%q) = true", id)
+		}
+	}
+}
+
+func TestCardRenames(t *testing.T) {
+	oid := func(b byte) objid.Oid {
+		var o objid.Oid
+		o.Bytes[0] = b
+		return o
+	}
+
+	old := newSnapshot(nil)
+	old.cards["kept"] = CardMeta{ParentIdentifier: "k1", Identifier: "kept", Name: "kept", BlobOid: oid(1)}
+	old.cards["c1"] = CardMeta{ParentIdentifier: "k1", Identifier: "c1", Name: "c1", BlobOid: oid(2)}
+	old.cards["c2"] = CardMeta{ParentIdentifier: "k1", Identifier: "c2", Name: "c2", BlobOid: oid(3)}
+	old.cards["c3"] = CardMeta{ParentIdentifier: "k1", Identifier: "c3", Name: "c3", BlobOid: oid(4)}
+
+	new := newSnapshot(nil)
+	new.cards["kept"] = CardMeta{ParentParentPath: "/moved", ParentIdentifier: "k1", Identifier: "kept", Name: "kept", BlobOid: oid(1)}
+	// c1 gained an ID header.
+	new.cards["stable"] = CardMeta{ParentIdentifier: "k1", Identifier: "stable", Name: "c1", BlobOid: oid(5)}
+	// c2 was renamed and moved to another knowledge.
+	new.cards["c2-renamed"] = CardMeta{ParentIdentifier: "k2", Identifier: "c2-renamed", Name: "c2-renamed", BlobOid: oid(3)}
+	// c3 was deleted and an unrelated card added.
+	new.cards["c4"] = CardMeta{ParentIdentifier: "k1", Identifier: "c4", Name: "c4", BlobOid: oid(6)}
+
+	renames := CardRenames(old, new)
+	if len(renames) != 2 || renames[0] != (CardRename{From: "c1", To: "stable"}) || renames[1] != (CardRename{From: "c2", To: "c2-renamed"}) {
+		t.Errorf("renames = %#v", renames)
+	}
+}
+
+func TestMatchCloze(t *testing.T) {
+	d, n, ok := MatchCloze("{{c2::Paris::city}} is nice")
+	if !ok || n != len("{{c2::Paris::city}}") || d != (ClozeDeletion{Index: 2, Answer: "Paris", Hint: "city"}) {
+		t.Errorf("d, n, ok = %#v, %d, %v", d, n, ok)
+	}
+	for _, s := range []string{"x {{c1::a}}", "{{c0::a}}", "{{c1::}}", "{c1::a}"} {
+		if d, _, ok := MatchCloze(s); ok {
+			t.Errorf("MatchCloze(%q) = %#v", s, d)
+		}
+	}
+}
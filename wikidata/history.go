@@ -0,0 +1,348 @@
+package wikidata
+
+import (
+	"time"
+
+	"github.com/MerryMage/libellus/objstore/commit"
+	"github.com/MerryMage/libellus/objstore/filemode"
+	"github.com/MerryMage/libellus/objstore/objid"
+	"github.com/MerryMage/libellus/objstore/tree"
+)
+
+type Revision struct {
+	Commit objid.Oid
+	Author commit.Signature
+}
+
+func (r Revision) Valid() bool {
+	return !r.Commit.IsZero()
+}
+
+func (r Revision) Time() time.Time {
+	return time.Unix(r.Author.Timestamp, 0)
+}
+
+type History struct {
+	Created      Revision
+	LastModified Revision
+}
+
+// historyState is the part of a wiki tree that differs from another wiki tree.
+// Pages map to the oid of their _page tree (the zero oid if they have none),
+// and knowledges map to the oid of their tree.
+type historyState struct {
+	pages      map[string]objid.Oid
+	knowledges map[KnowledgeId]objid.Oid
+}
+
+func newHistoryState() historyState {
+	return historyState{
+		pages:      make(map[string]objid.Oid),
+		knowledges: make(map[KnowledgeId]objid.Oid),
+	}
+}
+
+func (wd *WikiData) treeOrEmpty(oid objid.Oid) (tree.Tree, error) {
+	if oid.IsZero() {
+		return tree.Tree{}, nil
+	}
+	return wd.repo.Tree(oid)
+}
+
+func entryOid(t tree.Tree, name string) objid.Oid {
+	if e := t.Find(name); e != nil {
+		return e.Oid
+	}
+	return objid.Oid{}
+}
+
+func (wd *WikiData) diffKnowledges(a objid.Oid, b objid.Oid, as historyState, bs historyState) error {
+	if a == b {
+		return nil
+	}
+
+	ta, err := wd.treeOrEmpty(a)
+	if err != nil {
+		return err
+	}
+	tb, err := wd.treeOrEmpty(b)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range ta.Entries {
+		if e.Name[0] != '_' && e.Mode == filemode.Dir && entryOid(tb, e.Name) != e.Oid {
+			as.knowledges[KnowledgeId(e.Name)] = e.Oid
+		}
+	}
+	for _, e := range tb.Entries {
+		if e.Name[0] != '_' && e.Mode == filemode.Dir && entryOid(ta, e.Name) != e.Oid {
+			bs.knowledges[KnowledgeId(e.Name)] = e.Oid
+		}
+	}
+
+	return nil
+}
+
+// diffPages records into as and bs the pages and knowledges that differ
+// between the wiki trees a and b, skipping identical subtrees.
+func (wd *WikiData) diffPages(path string, a objid.Oid, b objid.Oid, as historyState, bs historyState) error {
+	if a == b {
+		return nil
+	}
+
+	ta, err := wd.treeOrEmpty(a)
+	if err != nil {
+		return err
+	}
+	tb, err := wd.treeOrEmpty(b)
+	if err != nil {
+		return err
+	}
+
+	key := path
+	if key == "" {
+		key = "/"
+	}
+	if !a.IsZero() {
+		as.pages[key] = entryOid(ta, "_page")
+	}
+	if !b.IsZero() {
+		bs.pages[key] = entryOid(tb, "_page")
+	}
+
+	err = wd.diffKnowledges(entryOid(ta, "_page"), entryOid(tb, "_page"), as, bs)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range ta.Entries {
+		if e.Name[0] == '_' || e.Mode != filemode.Dir {
+			continue
+		}
+		err = wd.diffPages(path+"/"+e.Name, e.Oid, entryOid(tb, e.Name), as, bs)
+		if err != nil {
+			return err
+		}
+	}
+	for _, e := range tb.Entries {
+		if e.Name[0] == '_' || e.Mode != filemode.Dir || ta.Find(e.Name) != nil {
+			continue
+		}
+		err = wd.diffPages(path+"/"+e.Name, objid.Oid{}, e.Oid, as, bs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// maxHistoryWalk bounds how many commits refreshHistory looks at when it has
+// no base to stop at, as when viewing a past revision. Pages and knowledges
+// which were last changed before that are left with an unknown History.
+const maxHistoryWalk = 1000
+
+// historyBase is the History of every page and knowledge at Commit, which
+// lets refreshHistory stop its walk there.
+type historyBase struct {
+	Commit     objid.Oid
+	Pages      map[string]History
+	Knowledges map[KnowledgeId]History
+}
+
+func snapshotHistory(s *Snapshot) historyBase {
+	base := historyBase{
+		Commit:     s.revision.Commit,
+		Pages:      make(map[string]History),
+		Knowledges: make(map[KnowledgeId]History),
+	}
+	for path, page := range s.pages {
+		base.Pages[path] = page.History
+	}
+	for kid, km := range s.knowledges {
+		base.Knowledges[kid] = km.History
+	}
+	return base
+}
+
+// refreshHistory walks the first-parent history from st.revision and records
+// for every page and knowledge in st the commit which created it and the
+// commit which last modified it. The walk stops early on reaching the
+// revision old was built from, since old already knows the rest. Failing
+// that, it stops at the revision whose History was persisted in the cache,
+// or after maxHistoryWalk commits if there is neither.
+func (wd *WikiData) refreshHistory(st *Snapshot, old *Snapshot) {
+	base := snapshotHistory(old)
+	limit := 0
+	if base.Commit.IsZero() {
+		if wd.cache.history != nil {
+			base = *wd.cache.history
+		} else if wd.ref == "" {
+			// Snapshots of past revisions have nowhere to keep the
+			// result of a full walk.
+			limit = maxHistoryWalk
+		}
+	}
+
+	pendingPages := make(map[string]*History)
+	for path := range st.pages {
+		pendingPages[path] = &History{}
+	}
+	pendingKnowledges := make(map[KnowledgeId]*History)
+	for kid := range st.knowledges {
+		pendingKnowledges[kid] = &History{}
+	}
+
+	pageHistory := make(map[string]History)
+	knowledgeHistory := make(map[KnowledgeId]History)
+
+	coid := st.revision.Commit
+	c, err := wd.repo.Commit(coid)
+	if err != nil {
+		wd.addError("/", err)
+		return
+	}
+
+	for walked := 0; len(pendingPages) > 0 || len(pendingKnowledges) > 0; walked++ {
+		if !base.Commit.IsZero() && coid == base.Commit {
+			for path, h := range pendingPages {
+				if bh, ok := base.Pages[path]; ok {
+					if !h.LastModified.Valid() {
+						h.LastModified = bh.LastModified
+					}
+					h.Created = bh.Created
+				}
+			}
+			for kid, h := range pendingKnowledges {
+				if bh, ok := base.Knowledges[kid]; ok {
+					if !h.LastModified.Valid() {
+						h.LastModified = bh.LastModified
+					}
+					h.Created = bh.Created
+				}
+			}
+			break
+		}
+		if limit > 0 && walked == limit {
+			break
+		}
+
+		current, err := wd.repo.LookupOid(c.Tree, "_wiki")
+		if err != nil {
+			wd.addError("/", err)
+			return
+		}
+
+		var parentOid, previous objid.Oid
+		var parent commit.Commit
+		if len(c.Parents) > 0 {
+			parentOid = c.Parents[0]
+			parent, err = wd.repo.Commit(parentOid)
+			if err != nil {
+				wd.addError("/", err)
+				return
+			}
+			previous, err = wd.repo.LookupOid(parent.Tree, "_wiki")
+			if err != nil {
+				wd.addError("/", err)
+				return
+			}
+		}
+
+		as, bs := newHistoryState(), newHistoryState()
+		err = wd.diffPages("", current, previous, as, bs)
+		if err != nil {
+			wd.addError("/", err)
+			return
+		}
+
+		rev := Revision{
+			Commit: coid,
+			Author: c.Author,
+		}
+
+		for path, oid := range as.pages {
+			h, ok := pendingPages[path]
+			if !ok {
+				continue
+			}
+			prev, existed := bs.pages[path]
+			if existed && prev == oid {
+				continue
+			}
+			if !h.LastModified.Valid() {
+				h.LastModified = rev
+			}
+			if !existed {
+				h.Created = rev
+				pageHistory[path] = *h
+				delete(pendingPages, path)
+			}
+		}
+
+		for kid, oid := range as.knowledges {
+			h, ok := pendingKnowledges[kid]
+			if !ok {
+				continue
+			}
+			prev, existed := bs.knowledges[kid]
+			if existed && prev == oid {
+				continue
+			}
+			if !h.LastModified.Valid() {
+				h.LastModified = rev
+			}
+			if !existed {
+				h.Created = rev
+				knowledgeHistory[kid] = *h
+				delete(pendingKnowledges, kid)
+			}
+		}
+
+		if len(c.Parents) == 0 {
+			break
+		}
+		coid, c = parentOid, parent
+	}
+
+	for path, h := range pendingPages {
+		pageHistory[path] = *h
+	}
+	for kid, h := range pendingKnowledges {
+		knowledgeHistory[kid] = *h
+	}
+
+	for path, h := range pageHistory {
+		page := st.pages[path]
+		page.History = h
+		st.pages[path] = page
+	}
+	for kid, h := range knowledgeHistory {
+		km := st.knowledges[kid]
+		km.History = h
+		st.knowledges[kid] = km
+	}
+
+	persisted := snapshotHistory(st)
+	wd.cache.history = &persisted
+	wd.cache.dirty = true
+}
+
+// PageLog returns the revisions which changed the page at path itself,
+// ignoring changes to its subpages, newest first.
+func (s *Snapshot) PageLog(path string) ([]Revision, error) {
+	log, err := s.repo.PathLog(s.revision.Commit, PageTreePath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []Revision
+	for _, le := range log {
+		ret = append(ret, Revision{
+			Commit: le.Oid,
+			Author: le.Commit.Author,
+		})
+	}
+	return ret, nil
+}
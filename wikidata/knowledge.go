@@ -2,11 +2,20 @@ package wikidata
 
 import (
 	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/MerryMage/libellus/objstore/tree"
 )
 
 const (
-	ErrorKnowledgeType    string = "error"
-	MarkdownKnowledgeType string = "markdown"
+	ErrorKnowledgeType       string = "error"
+	MarkdownKnowledgeType    string = "markdown"
+	CodeKnowledgeType        string = "code"
+	MathKnowledgeType        string = "math"
+	TableKnowledgeType       string = "table"
+	ImageKnowledgeType       string = "image"
+	DefinitionsKnowledgeType string = "definitions"
 )
 
 type Knowledge interface {
@@ -46,49 +55,114 @@ func (k MarkdownKnowledge) GetInfo() KnowledgeInfo {
 	return k.KnowledgeInfo
 }
 
-func (wd *WikiData) parseKnowledge(meta KnowledgeMeta) Knowledge {
-	path := meta.ParentPath + "/_page/" + string(meta.Identifier)
+// TextKnowledge is a Knowledge with text worth indexing for search.
+type TextKnowledge interface {
+	Knowledge
+	Text() string
+}
+
+func (k MarkdownKnowledge) Text() string {
+	return k.Markdown
+}
+
+// KnowledgeSource gives a KnowledgeParser access to the tree of a knowledge.
+// Info is the contents of its _info, Read returns the contents of another
+// file in the tree and Has reports whether there is a file at a path.
+type KnowledgeSource struct {
+	Info []byte
+	Read func(name string) ([]byte, error)
+	Has  func(name string) bool
+}
 
-	ki, err := wd.parseKnowledgeInfo(meta)
+// KnowledgeParser builds a Knowledge of one type from its tree. An error is
+// shown in place of the knowledge.
+type KnowledgeParser func(ki KnowledgeInfo, src KnowledgeSource) (Knowledge, error)
+
+var knowledgeParsers = map[string]KnowledgeParser{
+	MarkdownKnowledgeType:    parseMarkdownKnowledge,
+	CodeKnowledgeType:        parseCodeKnowledge,
+	MathKnowledgeType:        parseMathKnowledge,
+	TableKnowledgeType:       parseTableKnowledge,
+	ImageKnowledgeType:       parseImageKnowledge,
+	DefinitionsKnowledgeType: parseDefinitionsKnowledge,
+}
+
+// RegisterKnowledgeType makes knowledges whose _info has the Type name parse
+// with p. It must be called before any WikiData is created. Types defined
+// outside this package implement Knowledge by embedding KnowledgeInfo.
+func RegisterKnowledgeType(name string, p KnowledgeParser) {
+	knowledgeParsers[name] = p
+}
+
+// KnownKnowledgeType reports whether knowledges of the named type can be
+// parsed.
+func KnownKnowledgeType(name string) bool {
+	_, ok := knowledgeParsers[name]
+	return ok
+}
+
+func (KnowledgeInfo) knowledgeTag() {}
+func (ki KnowledgeInfo) GetInfo() KnowledgeInfo {
+	return ki
+}
+
+func (s *Snapshot) parseKnowledge(meta KnowledgeMeta) Knowledge {
+	path := strings.TrimSuffix(meta.ParentPath, "/") + "/_page/" + string(meta.Identifier)
+
+	infoRaw, ki, err := s.parseKnowledgeInfo(meta)
 
 	if err != nil {
 		return ErrorKnowledge{KnowledgeInfo: ki, Message: path + ": while parsing info: " + err.Error()}
 	}
 
-	switch ki.Type {
-	case MarkdownKnowledgeType:
-		return wd.parseMarkdownKnowledge(path, ki, meta)
-
-	case ErrorKnowledgeType:
+	if ki.Type == ErrorKnowledgeType {
 		return ErrorKnowledge{KnowledgeInfo: ki, Message: "wild ErrorKnowledgeType found at " + path}
 	}
 
-	return ErrorKnowledge{KnowledgeInfo: ki, Message: "unknown knowledge type found at " + path}
+	parse, ok := knowledgeParsers[ki.Type]
+	if !ok {
+		return ErrorKnowledge{KnowledgeInfo: ki, Message: "unknown knowledge type found at " + path}
+	}
+
+	k, err := parse(ki, KnowledgeSource{
+		Info: infoRaw,
+		Read: func(name string) ([]byte, error) {
+			return s.repo.ReadBlobFromTreeOid(meta.TreeOid, name)
+		},
+		Has: func(name string) bool {
+			_, err := tree.Lookup(s.repo, meta.TreeOid, name)
+			return err == nil
+		},
+	})
+	if err != nil {
+		return ErrorKnowledge{KnowledgeInfo: ki, Message: path + ": " + err.Error()}
+	}
+	return k
 }
 
-func (wd *WikiData) parseKnowledgeInfo(meta KnowledgeMeta) (KnowledgeInfo, error) {
-	infoRaw, err := wd.repo.ReadBlobFromTreeOid(meta.TreeOid, "_info")
+func (s *Snapshot) parseKnowledgeInfo(meta KnowledgeMeta) ([]byte, KnowledgeInfo, error) {
+	infoRaw, err := s.repo.ReadBlobFromTreeOid(meta.TreeOid, "_info")
 	if err != nil {
-		return KnowledgeInfo{}, err
+		return nil, KnowledgeInfo{}, err
 	}
 
 	var kid KnowledgeInfo
 	err = json.Unmarshal(infoRaw, &kid)
 	if err != nil {
-		return KnowledgeInfo{}, err
+		return nil, KnowledgeInfo{}, err
 	}
 	kid.Identifier = meta.Identifier
 
-	return kid, nil
+	return infoRaw, kid, nil
 }
 
-func (wd *WikiData) parseMarkdownKnowledge(path string, ki KnowledgeInfo, meta KnowledgeMeta) Knowledge {
-	raw, err := wd.repo.ReadBlobFromTreeOid(meta.TreeOid, "_data.md")
+func parseMarkdownKnowledge(ki KnowledgeInfo, src KnowledgeSource) (Knowledge, error) {
+	raw, err := src.Read("_data.md")
 	if err != nil {
-		return ErrorKnowledge{KnowledgeInfo: ki, Message: "could not read _data.md at " + path}
+		return nil, errors.New("could not read _data.md")
 	}
 	return MarkdownKnowledge{
 		KnowledgeInfo: ki,
 		Markdown:      string(raw),
-	}
+	}, nil
 }
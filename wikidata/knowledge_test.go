@@ -0,0 +1,103 @@
+package wikidata
+
+import (
+	"errors"
+	"testing"
+)
+
+func memorySource(info string, files map[string]string) KnowledgeSource {
+	return KnowledgeSource{
+		Info: []byte(info),
+		Read: func(name string) ([]byte, error) {
+			data, ok := files[name]
+			if !ok {
+				return nil, errors.New("no such file")
+			}
+			return []byte(data), nil
+		},
+		Has: func(name string) bool {
+			_, ok := files[name]
+			return ok
+		},
+	}
+}
+
+func TestParseCodeKnowledge(t *testing.T) {
+	k, err := parseCodeKnowledge(KnowledgeInfo{Type: CodeKnowledgeType}, memorySource(`{"Type":"code","Language":"go"}`, map[string]string{"_data.txt": "package main\n"}))
+	ck, ok := k.(CodeKnowledge)
+	if err != nil || !ok || ck.Language != "go" || ck.Source != "package main\n" {
+		t.Errorf("k = %#v, err = %v", k, err)
+	}
+}
+
+func TestParseMathKnowledge(t *testing.T) {
+	k, err := parseMathKnowledge(KnowledgeInfo{}, memorySource(`{}`, map[string]string{"_data.tex": "e^{i\\pi} + 1 = 0\n\n\n  \na^2 + b^2\n= c^2\n"}))
+	mk, ok := k.(MathKnowledge)
+	if err != nil || !ok || len(mk.Equations) != 2 || mk.Equations[1] != "a^2 + b^2\n= c^2" {
+		t.Errorf("k = %#v, err = %v", k, err)
+	}
+
+	k, err = parseMathKnowledge(KnowledgeInfo{}, memorySource(`{}`, map[string]string{"_data.tex": "\n \n"}))
+	if mk, ok := k.(MathKnowledge); err != nil || !ok || len(mk.Equations) != 0 {
+		t.Errorf("k = %#v, err = %v", k, err)
+	}
+}
+
+func TestParseTableKnowledge(t *testing.T) {
+	files := map[string]string{"_data.csv": "Element, Symbol\nIron, Fe\n\"Lead, metallic\", Pb, extra\n"}
+
+	k, err := parseTableKnowledge(KnowledgeInfo{}, memorySource(`{}`, files))
+	tk, ok := k.(TableKnowledge)
+	if err != nil || !ok || len(tk.Header) != 2 || tk.Header[1] != "Symbol" || len(tk.Rows) != 2 || tk.Rows[1][0] != "Lead, metallic" || len(tk.Rows[1]) != 3 {
+		t.Errorf("k = %#v, err = %v", k, err)
+	}
+
+	k, err = parseTableKnowledge(KnowledgeInfo{}, memorySource(`{"NoHeader":true}`, files))
+	if tk, ok := k.(TableKnowledge); err != nil || !ok || tk.Header != nil || len(tk.Rows) != 3 {
+		t.Errorf("k = %#v, err = %v", k, err)
+	}
+}
+
+func TestParseImageKnowledge(t *testing.T) {
+	files := map[string]string{"_media/cell.png": "png"}
+
+	k, err := parseImageKnowledge(KnowledgeInfo{}, memorySource(`{"File":"cell.png","Caption":"A *cell*"}`, files))
+	if ik, ok := k.(ImageKnowledge); err != nil || !ok || ik.File != "cell.png" || ik.Caption != "A *cell*" {
+		t.Errorf("k = %#v, err = %v", k, err)
+	}
+
+	if _, err := parseImageKnowledge(KnowledgeInfo{}, memorySource(`{"File":"dog.png"}`, files)); err == nil {
+		t.Errorf("missing image was accepted")
+	}
+	k, err = parseImageKnowledge(KnowledgeInfo{}, memorySource(`{}`, files))
+	if ik, ok := k.(ImageKnowledge); err != nil || !ok || ik.File != "" {
+		t.Errorf("k = %#v, err = %v", k, err)
+	}
+}
+
+func TestParseDefinitions(t *testing.T) {
+	defs, err := parseDefinitions("Mitochondrion\nMitochondria\n: The organelle which\n  produces energy.\n: A [[cell]] part.\n\nRibosome\n: Makes proteins.\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 2 || len(defs[0].Terms) != 2 || defs[0].Terms[1] != "Mitochondria" || len(defs[0].Definitions) != 2 || defs[0].Definitions[0] != "The organelle which\nproduces energy." {
+		t.Errorf("defs = %#v", defs)
+	}
+	if defs[1].Terms[0] != "Ribosome" || defs[1].Definitions[0] != "Makes proteins." {
+		t.Errorf("defs[1] = %#v", defs[1])
+	}
+
+	if _, err := parseDefinitions("Term without definition\n"); err == nil {
+		t.Errorf("term without a definition was accepted")
+	}
+	if _, err := parseDefinitions(": definition without term\n"); err == nil {
+		t.Errorf("definition without a term was accepted")
+	}
+}
+
+func TestOrderKnowledges(t *testing.T) {
+	ordered := orderKnowledges([]KnowledgeId{"a", "b", "c", "d"}, []KnowledgeId{"c", "gone", "a", "c"})
+	if len(ordered) != 4 || ordered[0] != "c" || ordered[1] != "a" || ordered[2] != "b" || ordered[3] != "d" {
+		t.Errorf("ordered = %#v", ordered)
+	}
+}
@@ -0,0 +1,264 @@
+package wikidata
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// The built-in knowledge types besides markdown. Each keeps its data in
+// _data.<format>, with any settings in _info next to Type:
+//
+//	code         _data.txt, the source; "Language" names it for highlighting
+//	math         _data.tex, LaTeX equations separated by blank lines
+//	table        _data.csv; the first row is the header unless "NoHeader"
+//	image        "File" names the image in _media; "Caption" is markdown
+//	definitions  _data.txt, described at DefinitionsKnowledge
+
+type CodeKnowledge struct {
+	KnowledgeInfo
+	Language string
+	Source   string
+}
+
+func (CodeKnowledge) knowledgeTag() {}
+func (k CodeKnowledge) GetInfo() KnowledgeInfo {
+	return k.KnowledgeInfo
+}
+func (k CodeKnowledge) Text() string {
+	return k.Source
+}
+
+func parseCodeKnowledge(ki KnowledgeInfo, src KnowledgeSource) (Knowledge, error) {
+	var info struct {
+		Language string
+	}
+	if err := json.Unmarshal(src.Info, &info); err != nil {
+		return nil, err
+	}
+
+	raw, err := src.Read("_data.txt")
+	if err != nil {
+		return nil, errors.New("could not read _data.txt")
+	}
+
+	return CodeKnowledge{
+		KnowledgeInfo: ki,
+		Language:      info.Language,
+		Source:        string(raw),
+	}, nil
+}
+
+// MathKnowledge holds LaTeX equations, each shown on its own line.
+type MathKnowledge struct {
+	KnowledgeInfo
+	Equations []string
+}
+
+func (MathKnowledge) knowledgeTag() {}
+func (k MathKnowledge) GetInfo() KnowledgeInfo {
+	return k.KnowledgeInfo
+}
+func (k MathKnowledge) Text() string {
+	return strings.Join(k.Equations, "\n\n")
+}
+
+// splitParagraphs splits text at blank lines, dropping empty paragraphs.
+func splitParagraphs(text string) []string {
+	var paragraphs []string
+	var current []string
+	flush := func() {
+		if len(current) > 0 {
+			paragraphs = append(paragraphs, strings.Join(current, "\n"))
+			current = nil
+		}
+	}
+
+	for _, line := range strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n") {
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		current = append(current, line)
+	}
+	flush()
+
+	return paragraphs
+}
+
+func parseMathKnowledge(ki KnowledgeInfo, src KnowledgeSource) (Knowledge, error) {
+	raw, err := src.Read("_data.tex")
+	if err != nil {
+		return nil, errors.New("could not read _data.tex")
+	}
+
+	// A new math knowledge has no equations yet.
+	return MathKnowledge{
+		KnowledgeInfo: ki,
+		Equations:     splitParagraphs(string(raw)),
+	}, nil
+}
+
+type TableKnowledge struct {
+	KnowledgeInfo
+	Header []string
+	Rows   [][]string
+}
+
+func (TableKnowledge) knowledgeTag() {}
+func (k TableKnowledge) GetInfo() KnowledgeInfo {
+	return k.KnowledgeInfo
+}
+func (k TableKnowledge) Text() string {
+	var b strings.Builder
+	b.WriteString(strings.Join(k.Header, " "))
+	for _, row := range k.Rows {
+		b.WriteString("\n" + strings.Join(row, " "))
+	}
+	return b.String()
+}
+
+func parseTableKnowledge(ki KnowledgeInfo, src KnowledgeSource) (Knowledge, error) {
+	var info struct {
+		NoHeader bool
+	}
+	if err := json.Unmarshal(src.Info, &info); err != nil {
+		return nil, err
+	}
+
+	raw, err := src.Read("_data.csv")
+	if err != nil {
+		return nil, errors.New("could not read _data.csv")
+	}
+
+	r := csv.NewReader(bytes.NewReader(raw))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, errors.New("_data.csv: " + err.Error())
+	}
+
+	k := TableKnowledge{KnowledgeInfo: ki}
+	if !info.NoHeader && len(records) > 0 {
+		k.Header, records = records[0], records[1:]
+	}
+	k.Rows = records
+	return k, nil
+}
+
+type ImageKnowledge struct {
+	KnowledgeInfo
+	File    string
+	Caption string
+}
+
+func (ImageKnowledge) knowledgeTag() {}
+func (k ImageKnowledge) GetInfo() KnowledgeInfo {
+	return k.KnowledgeInfo
+}
+func (k ImageKnowledge) Text() string {
+	return k.Caption
+}
+
+func parseImageKnowledge(ki KnowledgeInfo, src KnowledgeSource) (Knowledge, error) {
+	var info struct {
+		File    string
+		Caption string
+	}
+	if err := json.Unmarshal(src.Info, &info); err != nil {
+		return nil, err
+	}
+
+	// A new image knowledge has no File until one is uploaded.
+	if info.File != "" && !src.Has("_media/"+info.File) {
+		return nil, errors.New("_media/" + info.File + " does not exist")
+	}
+
+	return ImageKnowledge{
+		KnowledgeInfo: ki,
+		File:          info.File,
+		Caption:       info.Caption,
+	}, nil
+}
+
+type Definition struct {
+	Terms       []string
+	Definitions []string
+}
+
+// DefinitionsKnowledge is a glossary. Its _data.txt is a series of entries
+// separated by blank lines. Each entry is one or more terms, one per line,
+// followed by definitions which each start with ": " and may continue on
+// the following lines:
+//
+//	Mitochondrion
+//	Mitochondria
+//	: The organelle which produces most of a cell's energy.
+//
+// Definitions are markdown.
+type DefinitionsKnowledge struct {
+	KnowledgeInfo
+	Definitions []Definition
+}
+
+func (DefinitionsKnowledge) knowledgeTag() {}
+func (k DefinitionsKnowledge) GetInfo() KnowledgeInfo {
+	return k.KnowledgeInfo
+}
+func (k DefinitionsKnowledge) Text() string {
+	var b strings.Builder
+	for _, d := range k.Definitions {
+		b.WriteString(strings.Join(d.Terms, "\n") + "\n")
+		b.WriteString(strings.Join(d.Definitions, "\n") + "\n\n")
+	}
+	return b.String()
+}
+
+func parseDefinitions(text string) ([]Definition, error) {
+	var definitions []Definition
+
+	for _, entry := range splitParagraphs(text) {
+		var d Definition
+		for _, line := range strings.Split(entry, "\n") {
+			switch {
+			case strings.HasPrefix(line, ":"):
+				d.Definitions = append(d.Definitions, strings.TrimSpace(line[1:]))
+			case len(d.Definitions) > 0:
+				last := len(d.Definitions) - 1
+				d.Definitions[last] += "\n" + strings.TrimSpace(line)
+			default:
+				d.Terms = append(d.Terms, strings.TrimSpace(line))
+			}
+		}
+
+		if len(d.Terms) == 0 {
+			return nil, errors.New("definition without a term: " + entry)
+		}
+		if len(d.Definitions) == 0 {
+			return nil, errors.New("term without a definition: " + d.Terms[0])
+		}
+		definitions = append(definitions, d)
+	}
+
+	return definitions, nil
+}
+
+func parseDefinitionsKnowledge(ki KnowledgeInfo, src KnowledgeSource) (Knowledge, error) {
+	raw, err := src.Read("_data.txt")
+	if err != nil {
+		return nil, errors.New("could not read _data.txt")
+	}
+
+	definitions, err := parseDefinitions(string(raw))
+	if err != nil {
+		return nil, errors.New("_data.txt: " + err.Error())
+	}
+
+	return DefinitionsKnowledge{
+		KnowledgeInfo: ki,
+		Definitions:   definitions,
+	}, nil
+}
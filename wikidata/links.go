@@ -0,0 +1,324 @@
+package wikidata
+
+import (
+	"bytes"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+type LinkKind int
+
+const (
+	PageLink LinkKind = iota
+	KnowledgeLink
+)
+
+// Link is a wiki link, written [[/path/to/page]] or [[kid:knowledge-id]],
+// optionally followed by a label as in [[/path/to/page|label]].
+type Link struct {
+	Kind   LinkKind
+	Target string
+	Label  string
+}
+
+// ParseLink parses the inside of a wiki link, without the surrounding
+// brackets.
+func ParseLink(inner string) (Link, bool) {
+	target := inner
+	label := ""
+	if i := strings.IndexByte(inner, '|'); i != -1 {
+		target = inner[:i]
+		label = strings.TrimSpace(inner[i+1:])
+	}
+	target = strings.TrimSpace(target)
+
+	if strings.HasPrefix(target, "kid:") {
+		kid := strings.TrimSpace(target[len("kid:"):])
+		if kid == "" {
+			return Link{}, false
+		}
+		return Link{Kind: KnowledgeLink, Target: kid, Label: label}, true
+	}
+
+	if strings.HasPrefix(target, "/") {
+		return Link{Kind: PageLink, Target: path.Clean(target), Label: label}, true
+	}
+
+	return Link{}, false
+}
+
+// ScanLink parses the wiki link at the start of line, if there is one, and
+// returns it with the number of bytes it spans. Markdown parsers call it
+// where an inline may start, so that links in code are left alone.
+func ScanLink(line []byte) (Link, int, bool) {
+	if !bytes.HasPrefix(line, []byte("[[")) {
+		return Link{}, 0, false
+	}
+
+	end := bytes.Index(line, []byte("]]"))
+	if end == -1 {
+		return Link{}, 0, false
+	}
+
+	link, ok := ParseLink(string(line[2:end]))
+	return link, end + 2, ok
+}
+
+var kindLink = ast.NewNodeKind("WikiDataLink")
+
+// linkNode is a wiki link found in markdown, with the offsets of its source.
+type linkNode struct {
+	ast.BaseInline
+
+	Link  Link
+	Start int
+	Stop  int
+}
+
+func (n *linkNode) Kind() ast.NodeKind {
+	return kindLink
+}
+
+func (n *linkNode) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Target": n.Link.Target}, nil)
+}
+
+type linkParser struct{}
+
+func (linkParser) Trigger() []byte {
+	return []byte{'['}
+}
+
+func (linkParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, segment := block.PeekLine()
+	link, n, ok := ScanLink(line)
+	if !ok {
+		return nil
+	}
+	block.Advance(n)
+	return &linkNode{Link: link, Start: segment.Start, Stop: segment.Start + n}
+}
+
+// linkMarkdown parses markdown the way the wiki renders it, with just
+// enough extensions that the same text ends up in code spans and blocks.
+var linkMarkdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM, extension.Footnote),
+	goldmark.WithParserOptions(parser.WithInlineParsers(util.Prioritized(linkParser{}, 199))),
+)
+
+// findLinks returns every wiki link in markdown outside of code, in order
+// of appearance.
+func findLinks(markdown string) []*linkNode {
+	var found []*linkNode
+	doc := linkMarkdown.Parser().Parse(text.NewReader([]byte(markdown)))
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if ln, ok := n.(*linkNode); ok && entering {
+			found = append(found, ln)
+		}
+		return ast.WalkContinue, nil
+	})
+	return found
+}
+
+// ExtractLinks returns every wiki link in markdown, in order of appearance.
+// Links in code spans and code blocks are not links.
+func ExtractLinks(markdown string) []Link {
+	var links []Link
+	for _, ln := range findLinks(markdown) {
+		links = append(links, ln.Link)
+	}
+	return links
+}
+
+// RewriteLinks returns text with the target of every wiki link for which f
+// returns a new one replaced. Labels and the rest of text, including code,
+// are kept as written.
+func RewriteLinks(text string, f func(l Link) (string, bool)) string {
+	var b strings.Builder
+	last := 0
+	for _, ln := range findLinks(text) {
+		target, ok := f(ln.Link)
+		if !ok {
+			continue
+		}
+		if ln.Link.Kind == KnowledgeLink {
+			target = "kid:" + target
+		}
+
+		b.WriteString(text[last:ln.Start])
+		b.WriteString("[[" + target)
+		inner := text[ln.Start+2 : ln.Stop-2]
+		if i := strings.IndexByte(inner, '|'); i != -1 {
+			b.WriteString(inner[i:])
+		}
+		b.WriteString("]]")
+		last = ln.Stop
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+func (l Link) String() string {
+	if l.Kind == KnowledgeLink {
+		return "[[kid:" + l.Target + "]]"
+	}
+	return "[[" + l.Target + "]]"
+}
+
+// ResolveLink returns the URL a link points to and a default label for it.
+// ok is false for broken links.
+func (s *Snapshot) ResolveLink(l Link) (href string, title string, ok bool) {
+	switch l.Kind {
+	case PageLink:
+		page, ok := s.LookupPage(l.Target)
+		if !ok {
+			return "", l.Target, false
+		}
+		title := page.Title
+		if title == "" {
+			title = l.Target
+		}
+		return l.Target, title, true
+
+	case KnowledgeLink:
+		km, ok := s.LookupKnowledgeMeta(KnowledgeId(l.Target))
+		if !ok {
+			return "", l.Target, false
+		}
+		return km.ParentPath + "#" + l.Target, l.Target, true
+	}
+
+	return "", l.Target, false
+}
+
+// Backlink is a knowledge which links to a page, either directly or through
+// one of the page's knowledges.
+type Backlink struct {
+	Source     KnowledgeId
+	SourcePath string
+}
+
+// linkTargetPage returns the page a link points at, if it resolves in st.
+func (st *Snapshot) linkTargetPage(l Link) (string, bool) {
+	switch l.Kind {
+	case PageLink:
+		_, ok := st.pages[l.Target]
+		return l.Target, ok
+	case KnowledgeLink:
+		km, ok := st.knowledges[KnowledgeId(l.Target)]
+		return km.ParentPath, ok
+	}
+	return "", false
+}
+
+// refreshLinks rebuilds the outgoing link and backlink indices from the
+// markdown of every knowledge.
+func (wd *WikiData) refreshLinks(st *Snapshot) {
+	seen := make(map[string]map[KnowledgeId]bool)
+
+	for kid, km := range st.knowledges {
+		links := wd.cache.entries[km.TreeOid].Links
+		if len(links) == 0 {
+			continue
+		}
+		st.links[kid] = links
+
+		for _, l := range links {
+			target, ok := st.linkTargetPage(l)
+			if !ok || target == km.ParentPath {
+				continue
+			}
+
+			if seen[target] == nil {
+				seen[target] = make(map[KnowledgeId]bool)
+			}
+			if seen[target][kid] {
+				continue
+			}
+			seen[target][kid] = true
+
+			st.backlinks[target] = append(st.backlinks[target], Backlink{
+				Source:     kid,
+				SourcePath: km.ParentPath,
+			})
+		}
+	}
+
+	for _, bl := range st.backlinks {
+		sort.Slice(bl, func(i, j int) bool {
+			if bl[i].SourcePath != bl[j].SourcePath {
+				return bl[i].SourcePath < bl[j].SourcePath
+			}
+			return bl[i].Source < bl[j].Source
+		})
+	}
+}
+
+// Backlinks returns the knowledges on other pages which link to the page at
+// path or to one of its knowledges.
+func (s *Snapshot) Backlinks(path string) []Backlink {
+	return s.backlinks[path]
+}
+
+// KnowledgesLinkingTo returns the knowledges with a page link to the page at
+// path or to one of its subpages, in no particular order.
+func (s *Snapshot) KnowledgesLinkingTo(path string) []KnowledgeId {
+	var kids []KnowledgeId
+	for kid, links := range s.links {
+		for _, l := range links {
+			if l.Kind == PageLink && InSubtree(l.Target, path) {
+				kids = append(kids, kid)
+				break
+			}
+		}
+	}
+	return kids
+}
+
+// InSubtree reports whether the page at path is root or one of its subpages.
+func InSubtree(path string, root string) bool {
+	return root == "/" || path == root || strings.HasPrefix(path, root+"/")
+}
+
+type BrokenLink struct {
+	Source     KnowledgeId
+	SourcePath string
+	Link       Link
+}
+
+// BrokenLinks returns every wiki link in a knowledge which does not
+// resolve, sorted by the page it appears on.
+func (s *Snapshot) BrokenLinks() []BrokenLink {
+	var broken []BrokenLink
+
+	for kid, links := range s.links {
+		km := s.knowledges[kid]
+
+		for _, l := range links {
+			if _, _, ok := s.ResolveLink(l); !ok {
+				broken = append(broken, BrokenLink{
+					Source:     km.Identifier,
+					SourcePath: km.ParentPath,
+					Link:       l,
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(broken, func(i, j int) bool {
+		if broken[i].SourcePath != broken[j].SourcePath {
+			return broken[i].SourcePath < broken[j].SourcePath
+		}
+		return broken[i].Source < broken[j].Source
+	})
+
+	return broken
+}
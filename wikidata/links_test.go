@@ -0,0 +1,115 @@
+package wikidata
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseLink(t *testing.T) {
+	l, ok := ParseLink("/foo/../bar/ | Bar page")
+	if !ok || l.Kind != PageLink || l.Target != "/bar" || l.Label != "Bar page" {
+		t.Errorf("ParseLink = %#v, %#v", l, ok)
+	}
+
+	l, ok = ParseLink("kid:some-knowledge")
+	if !ok || l.Kind != KnowledgeLink || l.Target != "some-knowledge" || l.Label != "" {
+		t.Errorf("ParseLink = %#v, %#v", l, ok)
+	}
+
+	if l, ok := ParseLink("relative/path"); ok {
+		t.Errorf("ParseLink = %#v, %#v", l, ok)
+	}
+
+	if l, ok := ParseLink("kid:"); ok {
+		t.Errorf("ParseLink = %#v, %#v", l, ok)
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	links := ExtractLinks("See [[/a]], [[kid:b|the b]] and [not a link] or [[nope]].\n[[/c\n]]")
+
+	if len(links) != 2 {
+		t.Fatalf("links = %#v", links)
+	}
+	if links[0].Kind != PageLink || links[0].Target != "/a" {
+		t.Errorf("links[0] = %#v", links[0])
+	}
+	if links[1].Kind != KnowledgeLink || links[1].Target != "b" || links[1].Label != "the b" {
+		t.Errorf("links[1] = %#v", links[1])
+	}
+}
+
+func TestExtractLinksOutsideCode(t *testing.T) {
+	links := ExtractLinks("[[/a]] `[[/b]]` ``x [[/c]]``\n\n```\n[[/d]]\n```\n\n    [[/e]]\n\n| [[/f]] |\n|---|\n| `[[/g]]` |")
+
+	var targets []string
+	for _, l := range links {
+		targets = append(targets, l.Target)
+	}
+	if len(targets) != 2 || targets[0] != "/a" || targets[1] != "/f" {
+		t.Errorf("targets = %#v", targets)
+	}
+}
+
+func TestRewriteLinks(t *testing.T) {
+	text := RewriteLinks("[[/a]], [[ /a/b | label ]], [[/ab]], [[kid:a]] and [[/c]]", func(l Link) (string, bool) {
+		if l.Kind == PageLink && InSubtree(l.Target, "/a") {
+			return "/x" + l.Target[len("/a"):], true
+		}
+		return "", false
+	})
+	if text != "[[/x]], [[/x/b| label ]], [[/ab]], [[kid:a]] and [[/c]]" {
+		t.Errorf("text = %q", text)
+	}
+
+	text = RewriteLinks("[[/a]] `[[/a]]`\n\n```\n[[/a]]\n```\n", func(l Link) (string, bool) {
+		return "/x", true
+	})
+	if text != "[[/x]] `[[/a]]`\n\n```\n[[/a]]\n```\n" {
+		t.Errorf("text = %q", text)
+	}
+}
+
+func TestBacklinks(t *testing.T) {
+	dir, repo := tempRepo(t)
+	defer os.RemoveAll(dir)
+	commitFiles(t, repo, map[string]string{
+		"_wiki/_page/_info":         `{"Title": "Root"}`,
+		"_wiki/a/_page/_info":       `{"Title": "A"}`,
+		"_wiki/a/_page/k1/_info":    `{"Type": "markdown"}`,
+		"_wiki/a/_page/k1/_data.md": "[[/b]], [[kid:k3]], [[/c]] and [[/a]]",
+		"_wiki/a/_page/k2/_info":    `{"Type": "markdown"}`,
+		"_wiki/a/_page/k2/_data.md": "[[kid:k1]]",
+		"_wiki/b/_page/_info":       `{"Title": "B"}`,
+		"_wiki/c/_page/_info":       `{"Title": "C"}`,
+		"_wiki/c/_page/k3/_info":    `{"Type": "markdown"}`,
+		"_wiki/c/_page/k3/_data.md": "text",
+	})
+	wd := New(repo, "master", filepath.Join(dir, "private"))
+
+	fromK1 := []Backlink{{Source: "k1", SourcePath: "/a"}}
+	snap := wd.Snapshot()
+	if bl := snap.Backlinks("/b"); !reflect.DeepEqual(bl, fromK1) {
+		t.Errorf("Backlinks(/b) = %#v", bl)
+	}
+	if bl := snap.Backlinks("/c"); !reflect.DeepEqual(bl, fromK1) {
+		t.Errorf("Backlinks(/c) = %#v", bl)
+	}
+	if bl := snap.Backlinks("/a"); bl != nil {
+		t.Errorf("Backlinks(/a) = %#v", bl)
+	}
+
+	commitFiles(t, repo, map[string]string{
+		"_wiki/a/_page/k1/_data.md": "[[/c]]",
+		"_wiki/c/_page/k3/_data.md": "[[/b]]",
+	})
+	snap = wd.Snapshot()
+	if bl := snap.Backlinks("/b"); !reflect.DeepEqual(bl, []Backlink{{Source: "k3", SourcePath: "/c"}}) {
+		t.Errorf("Backlinks(/b) = %#v", bl)
+	}
+	if bl := snap.Backlinks("/c"); !reflect.DeepEqual(bl, fromK1) {
+		t.Errorf("Backlinks(/c) = %#v", bl)
+	}
+}
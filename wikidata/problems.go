@@ -0,0 +1,156 @@
+package wikidata
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/MerryMage/libellus/objstore/objid"
+	"github.com/MerryMage/libellus/objstore/tree"
+)
+
+type Severity int
+
+const (
+	// Warning is a problem which RefreshState worked around, such as an
+	// unexpected file which is ignored.
+	Warning Severity = iota
+	// Error is a problem which leaves part of the wiki missing or broken.
+	Error
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Warning:
+		return "warning"
+	case Error:
+		return "error"
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+type ErrorKind string
+
+const (
+	UnreadableErrorKind      ErrorKind = "unreadable"
+	LooseFileErrorKind       ErrorKind = "loose-file"
+	UnexpectedEntryErrorKind ErrorKind = "unexpected-entry"
+	MissingInfoErrorKind     ErrorKind = "missing-info"
+	BadInfoErrorKind         ErrorKind = "bad-info"
+	BadCardIdErrorKind       ErrorKind = "bad-card-id"
+	DuplicateCardErrorKind   ErrorKind = "duplicate-card"
+)
+
+// RefreshStateErrorInfo is a problem with the contents of the wiki found by
+// RefreshState. Path is relative to _wiki.
+type RefreshStateErrorInfo struct {
+	Path     string
+	Severity Severity
+	Kind     ErrorKind
+	Err      error
+}
+
+// NewProblemsError is returned when a commit is rejected because it would
+// add the listed errors to the wiki.
+type NewProblemsError []RefreshStateErrorInfo
+
+func (e NewProblemsError) Error() string {
+	return fmt.Sprintf("wikidata: commit introduces %d new errors, first at %s: %v", len(e), e[0].Path, e[0].Err)
+}
+
+// addProblem records a problem found while building the page at page. It is
+// kept with the page so that it carries over when the page is reused.
+func (st *Snapshot) addProblem(page string, path string, severity Severity, kind ErrorKind, err error) {
+	st.problems[page] = append(st.problems[page], RefreshStateErrorInfo{
+		Path:     path,
+		Severity: severity,
+		Kind:     kind,
+		Err:      err,
+	})
+}
+
+// Problems returns every problem found in the wiki, sorted by path.
+func (s *Snapshot) Problems() []RefreshStateErrorInfo {
+	var problems []RefreshStateErrorInfo
+	for _, p := range s.problems {
+		problems = append(problems, p...)
+	}
+	problems = append(problems, s.clozeProblems...)
+
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].Path != problems[j].Path {
+			return problems[i].Path < problems[j].Path
+		}
+		return problems[i].Kind < problems[j].Kind
+	})
+	return problems
+}
+
+// Validate returns the problems the wiki would have at the commit coid,
+// without refreshing wd.
+func (wd *WikiData) Validate(coid objid.Oid) ([]RefreshStateErrorInfo, error) {
+	c, err := wd.repo.Commit(coid)
+	if err != nil {
+		return nil, err
+	}
+
+	rootTreeEntry, err := tree.Lookup(wd.repo, c.Tree, "_wiki")
+	if err != nil {
+		return nil, err
+	}
+
+	st := newSnapshot(wd.repo)
+	wd.refreshStateHelper(st, wd.Snapshot(), "", rootTreeEntry.Oid)
+
+	// Cloze cards are only generated by a full refresh, so look for the
+	// ones which would collide with a card.
+	for kid, km := range st.knowledges {
+		if _, taken := st.cards[VirtualCardId(kid)]; !taken {
+			continue
+		}
+		if k, ok := st.parseKnowledge(km).(MarkdownKnowledge); ok {
+			if dataOid, ok := st.clozeData(km, k); ok {
+				st.addClozeCard(km, dataOid)
+			}
+		}
+	}
+
+	return st.Problems(), nil
+}
+
+type problemKey struct {
+	Path string
+	Kind ErrorKind
+}
+
+// RejectNewProblems makes every Transaction on the repository which updates
+// wd's ref fail with a NewProblemsError if the new commit has errors which
+// the current state of the wiki does not.
+func (wd *WikiData) RejectNewProblems() {
+	wd.repo.ValidateRefUpdate(func(ref string, coid objid.Oid) error {
+		if ref != wd.ref {
+			return nil
+		}
+
+		problems, err := wd.Validate(coid)
+		if err != nil {
+			return err
+		}
+
+		existing := make(map[problemKey]bool)
+		for _, p := range wd.Snapshot().Problems() {
+			existing[problemKey{p.Path, p.Kind}] = true
+		}
+
+		var introduced NewProblemsError
+		for _, p := range problems {
+			if p.Severity == Error && !existing[problemKey{p.Path, p.Kind}] {
+				introduced = append(introduced, p)
+			}
+		}
+
+		if len(introduced) > 0 {
+			return introduced
+		}
+		return nil
+	})
+}
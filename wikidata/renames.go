@@ -0,0 +1,88 @@
+package wikidata
+
+import (
+	"sort"
+)
+
+// CardRename records that the card From in one snapshot is the card To in a
+// later one.
+type CardRename struct {
+	From CardId
+	To   CardId
+}
+
+// cardLocation identifies a card blob by its knowledge and filename, which
+// stay the same when the knowledge moves to another page.
+func cardLocation(cm CardMeta) string {
+	return string(cm.ParentIdentifier) + "/" + cm.Name
+}
+
+// CardRenames finds the cards of old which are in new under another id. A
+// card is renamed if its blob kept its knowledge and filename but gained or
+// changed its ID header, or if its blob was renamed without changing its
+// contents. Cards which were both renamed and edited are not detected.
+func CardRenames(old *Snapshot, new *Snapshot) []CardRename {
+	gone := make(map[string]CardId)
+	goneByOid := make(map[string][]CardId)
+	for cid, cm := range old.cards {
+		if _, ok := new.cards[cid]; ok {
+			continue
+		}
+		gone[cardLocation(cm)] = cid
+		goneByOid[cm.BlobOid.String()] = append(goneByOid[cm.BlobOid.String()], cid)
+	}
+	if len(gone) == 0 {
+		return nil
+	}
+
+	var added []CardMeta
+	for cid, cm := range new.cards {
+		if _, ok := old.cards[cid]; !ok {
+			added = append(added, cm)
+		}
+	}
+	sort.Slice(added, func(i, j int) bool {
+		return added[i].Identifier < added[j].Identifier
+	})
+	for _, cids := range goneByOid {
+		sort.Slice(cids, func(i, j int) bool {
+			return cids[i] < cids[j]
+		})
+	}
+
+	var renames []CardRename
+	used := make(map[CardId]bool)
+
+	// Matching by location first means that a card which gains an ID header
+	// keeps its history even if another card has the same contents.
+	var unmatched []CardMeta
+	for _, cm := range added {
+		if from, ok := gone[cardLocation(cm)]; ok && !used[from] {
+			used[from] = true
+			renames = append(renames, CardRename{From: from, To: cm.Identifier})
+			continue
+		}
+		unmatched = append(unmatched, cm)
+	}
+
+	for _, cm := range unmatched {
+		for _, from := range goneByOid[cm.BlobOid.String()] {
+			if !used[from] {
+				used[from] = true
+				renames = append(renames, CardRename{From: from, To: cm.Identifier})
+				break
+			}
+		}
+	}
+
+	return renames
+}
+
+// CardIds returns the id of every card in s.
+func (s *Snapshot) CardIds() map[CardId]bool {
+	ids := make(map[CardId]bool, len(s.cards))
+	for cid := range s.cards {
+		ids[cid] = true
+	}
+	return ids
+}
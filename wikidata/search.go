@@ -0,0 +1,55 @@
+package wikidata
+
+import (
+	"github.com/MerryMage/libellus/search"
+)
+
+// refreshSearch builds the full-text index from page titles and the analyzed
+// text of every knowledge. The index depends only on the _wiki tree, so one
+// built for the same tree, by old or before a restart, is reused instead.
+func (wd *WikiData) refreshSearch(st *Snapshot, old *Snapshot) {
+	if old.rootTree == st.rootTree {
+		st.search = old.search
+		return
+	}
+	if wd.cache.search != nil && wd.cache.searchTree == st.rootTree {
+		st.search = wd.cache.search
+		return
+	}
+	defer func() {
+		wd.cache.search = st.search
+		wd.cache.searchTree = st.rootTree
+		wd.cache.dirty = true
+	}()
+
+	idx := st.search
+
+	for _, page := range st.pages {
+		if page.Title == "" {
+			continue
+		}
+		idx.Add(search.Document{
+			Path:  page.Path,
+			Title: page.Title,
+			Text:  page.Title,
+		})
+	}
+
+	for kid, km := range st.knowledges {
+		entry := wd.cache.entries[km.TreeOid]
+		if !entry.Indexed {
+			continue
+		}
+		idx.AddAnalyzed(search.Document{
+			Path:      km.ParentPath,
+			Knowledge: string(kid),
+			Title:     st.pages[km.ParentPath].Title,
+		}, entry.Analysis)
+	}
+}
+
+// Search returns up to limit pages and knowledges matching query, best match
+// first.
+func (s *Snapshot) Search(query string, limit int) []search.Result {
+	return s.search.Search(query, limit)
+}
@@ -0,0 +1,82 @@
+package wikidata
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchPollInterval is how often the ref is checked for changes when the
+// filesystem cannot be watched.
+const watchPollInterval = 10 * time.Second
+
+// Watch refreshes wd in the background whenever its ref changes, including
+// changes made by other processes such as git itself.
+func (wd *WikiData) Watch() {
+	watcher, files, err := wd.newRefWatcher()
+	if err != nil {
+		wd.addError("/", err)
+		go wd.poll()
+		return
+	}
+
+	go wd.watch(watcher, files)
+}
+
+// newRefWatcher watches the directories containing the files which make up
+// the ref. Git replaces these files rather than writing to them, so the
+// files themselves cannot be watched.
+func (wd *WikiData) newRefWatcher() (*fsnotify.Watcher, map[string]bool, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, f := range wd.repo.RefFiles(wd.ref) {
+		files[filepath.Clean(f)] = true
+		dirs[filepath.Dir(f)] = true
+	}
+
+	for dir := range dirs {
+		err = watcher.Add(dir)
+		if err != nil {
+			watcher.Close()
+			return nil, nil, err
+		}
+	}
+
+	return watcher, files, nil
+}
+
+func (wd *WikiData) watch(watcher *fsnotify.Watcher, files map[string]bool) {
+	defer watcher.Close()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				go wd.poll()
+				return
+			}
+			if files[filepath.Clean(event.Name)] {
+				wd.RefreshState()
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				go wd.poll()
+				return
+			}
+			wd.addError("/", err)
+		}
+	}
+}
+
+func (wd *WikiData) poll() {
+	for range time.Tick(watchPollInterval) {
+		wd.RefreshState()
+	}
+}
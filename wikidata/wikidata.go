@@ -1,14 +1,20 @@
 package wikidata
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/MerryMage/libellus/objstore"
 	"github.com/MerryMage/libellus/objstore/filemode"
 	"github.com/MerryMage/libellus/objstore/objid"
 	"github.com/MerryMage/libellus/objstore/tree"
+	"github.com/MerryMage/libellus/search"
 )
 
 type KnowledgeId string
@@ -19,13 +25,20 @@ type KnowledgeMeta struct {
 	Identifier KnowledgeId
 	TreeOid    objid.Oid
 	Cards      []CardId
+	History    History
 }
 
+// CardMeta describes a card blob. Identifier is the card's stable id, taken
+// from its ID header if it has one and from Name, its filename under _cards,
+// otherwise. A Virtual card is generated from the cloze deletions in the
+// markdown of its knowledge, and BlobOid is then that of the _data.md.
 type CardMeta struct {
 	ParentParentPath string
 	ParentIdentifier KnowledgeId
 	Identifier       CardId
+	Name             string
 	BlobOid          objid.Oid
+	Virtual          bool
 }
 
 type PageInfo struct {
@@ -37,45 +50,133 @@ type Page struct {
 	PageInfo
 	ActualKnowledges []KnowledgeId
 	Path             string
+	TreeOid          objid.Oid
 	Children         []string
 	NoInfo           bool
+	History          History
 }
 
-type WikiData struct {
-	repo *objstore.Repository
-	ref  string
-
+// Snapshot is everything known about the wiki at one commit. A Snapshot is
+// never modified once it has been published, so it is safe to use from any
+// number of goroutines; a request should take one Snapshot and use it
+// throughout so that it sees a consistent wiki.
+type Snapshot struct {
+	repo       *objstore.Repository
+	revision   Revision
+	rootTree   objid.Oid
 	knowledges map[KnowledgeId]KnowledgeMeta
 	cards      map[CardId]CardMeta
 	pages      map[string]Page
+	links      map[KnowledgeId][]Link
+	backlinks  map[string][]Backlink
+	search     *search.Index
+	problems   map[string][]RefreshStateErrorInfo
+	historical bool
+	// clozeProblems are found after the pages are built, so unlike problems
+	// they are not carried over with unchanged pages.
+	clozeProblems []RefreshStateErrorInfo
 }
 
-type RefreshStateErrorInfo struct {
-	Path string
-	Err  error
-}
-
-func New(repo *objstore.Repository, ref string) *WikiData {
-	wd := &WikiData{
+func newSnapshot(repo *objstore.Repository) *Snapshot {
+	return &Snapshot{
 		repo:       repo,
-		ref:        ref,
 		knowledges: make(map[KnowledgeId]KnowledgeMeta),
+		cards:      make(map[CardId]CardMeta),
 		pages:      make(map[string]Page),
+		links:      make(map[KnowledgeId][]Link),
+		backlinks:  make(map[string][]Backlink),
+		search:     search.NewIndex(),
+		problems:   make(map[string][]RefreshStateErrorInfo),
+	}
+}
+
+// WikiData follows a branch of the repository. RefreshState builds a new
+// Snapshot of the head of the branch and then swaps it in, so readers never
+// observe a partially refreshed wiki.
+type WikiData struct {
+	repo *objstore.Repository
+	ref  string
+
+	// refreshLock serializes refreshes and guards cache and refreshHooks.
+	refreshLock  sync.Mutex
+	cache        *knowledgeCache
+	refreshHooks []func(old *Snapshot, new *Snapshot)
+
+	lock     sync.RWMutex
+	snapshot *Snapshot
+}
+
+func newWikiData(repo *objstore.Repository, ref string, cache *knowledgeCache) *WikiData {
+	return &WikiData{
+		repo:     repo,
+		ref:      ref,
+		cache:    cache,
+		snapshot: newSnapshot(repo),
+	}
+}
+
+// New returns the wiki at the head of ref. Derived data such as the search
+// index is persisted in privateDir so that it need not be rebuilt from
+// scratch on every start. The wiki is refreshed as soon as a Transaction on
+// repo updates ref; see Watch for changes made outside the server.
+func New(repo *objstore.Repository, ref string, privateDir string) *WikiData {
+	cache, err := loadKnowledgeCache(privateDir)
+	if err != nil {
+		log.Println(privateDir, "-", err)
 	}
 
+	wd := newWikiData(repo, ref, cache)
 	wd.RefreshState()
 
+	repo.OnRefUpdate(func(updated string) {
+		if updated == ref {
+			wd.RefreshState()
+		}
+	})
+
 	return wd
 }
 
+// SnapshotAt returns a Snapshot of the wiki as it was at the commit coid.
+func SnapshotAt(repo *objstore.Repository, coid objid.Oid) (*Snapshot, error) {
+	cache, _ := loadKnowledgeCache("")
+	wd := newWikiData(repo, "", cache)
+	err := wd.loadCommit(coid)
+	if err != nil {
+		return nil, err
+	}
+	return wd.Snapshot(), nil
+}
+
+// PageTreePath returns the location of the _page tree of the page at path,
+// relative to the root of the repository.
+func PageTreePath(path string) string {
+	if path == "/" {
+		return "_wiki/_page"
+	}
+	return "_wiki" + path + "/_page"
+}
+
+// PageDirPath returns the location of the directory of the page at path,
+// which holds its _page tree and its subpages, relative to the root of the
+// repository.
+func PageDirPath(path string) string {
+	if path == "/" {
+		return "_wiki"
+	}
+	return "_wiki" + path
+}
+
 func (wd *WikiData) addError(path string, err error) {
 	log.Println(path, "-", err)
 }
 
-func (wd *WikiData) parsePageInfo(currentPage *Page, pageTreeEntry *tree.Entry) {
+func (wd *WikiData) parsePageInfo(st *Snapshot, currentPage *Page, pageTreeEntry *tree.Entry) {
+	pageTreePath := strings.TrimSuffix(currentPage.Path, "/") + "/_page"
+
 	pageTree, err := wd.repo.Tree(pageTreeEntry.Oid)
 	if err != nil {
-		wd.addError(currentPage.Path+"/_page", err)
+		st.addProblem(currentPage.Path, pageTreePath, Error, UnreadableErrorKind, err)
 		return
 	}
 
@@ -94,37 +195,71 @@ func (wd *WikiData) parsePageInfo(currentPage *Page, pageTreeEntry *tree.Entry)
 				TreeOid:    e.Oid,
 			}
 
+			knowledgeInfoPath := pageTreePath + "/" + e.Name + "/_info"
+			if infoRaw, err := wd.repo.ReadBlobFromTreeOid(e.Oid, "_info"); err != nil {
+				st.addProblem(currentPage.Path, knowledgeInfoPath, Error, MissingInfoErrorKind, err)
+			} else if err := json.Unmarshal(infoRaw, &KnowledgeInfo{}); err != nil {
+				st.addProblem(currentPage.Path, knowledgeInfoPath, Error, BadInfoErrorKind, err)
+			}
+
 			if cardsTreeEntry, err := tree.Lookup(wd.repo, e.Oid, "_cards"); err == nil {
-				wd.parseCardInfo(currentPage, &km, cardsTreeEntry)
+				wd.parseCardInfo(st, currentPage, &km, cardsTreeEntry)
 			}
 
-			wd.knowledges[kid] = km
+			st.knowledges[kid] = km
 
 			continue
 		}
 
-		wd.addError(currentPage.Path+"/_page/"+e.Name, errors.New("wikidata/parsePageInfo: unexpected loose file"))
+		st.addProblem(currentPage.Path, pageTreePath+"/"+e.Name, Warning, LooseFileErrorKind, errors.New("wikidata/parsePageInfo: unexpected loose file"))
 	}
 
 	infoRaw, err := wd.repo.ReadBlobFromTree(pageTree, "_info")
 	if err != nil {
-		wd.addError(currentPage.Path+"/_page/_info", err)
+		st.addProblem(currentPage.Path, pageTreePath+"/_info", Error, MissingInfoErrorKind, err)
 		return
 	}
 
 	err = json.Unmarshal(infoRaw, &currentPage.PageInfo)
 	if err != nil {
-		wd.addError(currentPage.Path+"/_page/_info", err)
+		st.addProblem(currentPage.Path, pageTreePath+"/_info", Error, BadInfoErrorKind, err)
 		return
 	}
 
+	currentPage.ActualKnowledges = orderKnowledges(currentPage.ActualKnowledges, currentPage.Knowledges)
 	currentPage.NoInfo = false
 }
 
-func (wd *WikiData) parseCardInfo(currentPage *Page, km *KnowledgeMeta, cardsTreeEntry *tree.Entry) {
+// orderKnowledges sorts the knowledges actually on a page into the order
+// listed in its _info. Knowledges which are not listed follow in tree order,
+// and listed knowledges which do not exist are ignored.
+func orderKnowledges(actual []KnowledgeId, listed []KnowledgeId) []KnowledgeId {
+	present := make(map[KnowledgeId]bool)
+	for _, kid := range actual {
+		present[kid] = true
+	}
+
+	ordered := make([]KnowledgeId, 0, len(actual))
+	for _, kid := range listed {
+		if present[kid] {
+			ordered = append(ordered, kid)
+			delete(present, kid)
+		}
+	}
+	for _, kid := range actual {
+		if present[kid] {
+			ordered = append(ordered, kid)
+		}
+	}
+	return ordered
+}
+
+func (wd *WikiData) parseCardInfo(st *Snapshot, currentPage *Page, km *KnowledgeMeta, cardsTreeEntry *tree.Entry) {
+	cardsTreePath := strings.TrimSuffix(currentPage.Path, "/") + "/_page/" + string(km.Identifier) + "/_cards"
+
 	cardsTree, err := wd.repo.Tree(cardsTreeEntry.Oid)
 	if err != nil {
-		wd.addError(currentPage.Path+"/_page/"+string(km.Identifier)+"/_cards", err)
+		st.addProblem(currentPage.Path, cardsTreePath, Error, UnreadableErrorKind, err)
 		return
 	}
 
@@ -134,41 +269,132 @@ func (wd *WikiData) parseCardInfo(currentPage *Page, km *KnowledgeMeta, cardsTre
 		}
 
 		if e.Mode == filemode.Regular {
+			cardPath := cardsTreePath + "/" + e.Name
 			cid := CardId(e.Name)
+
+			raw, err := wd.repo.ReadBlob(e.Oid)
+			if err != nil {
+				st.addProblem(currentPage.Path, cardPath, Error, UnreadableErrorKind, err)
+			} else if id, ok := cardHeaderId(raw); ok {
+				if validCardId(id) {
+					cid = id
+				} else {
+					st.addProblem(currentPage.Path, cardPath, Warning, BadCardIdErrorKind, errors.New("wikidata/parseCardInfo: invalid card id "+strconv.Quote(string(id))))
+				}
+			}
+
+			if other, ok := st.cards[cid]; ok {
+				st.addProblem(currentPage.Path, cardPath, Error, DuplicateCardErrorKind, errors.New("wikidata/parseCardInfo: card id "+strconv.Quote(string(cid))+" is already used on "+other.ParentParentPath))
+				continue
+			}
+
 			km.Cards = append(km.Cards, cid)
 
-			wd.cards[cid] = CardMeta{
+			st.cards[cid] = CardMeta{
 				ParentParentPath: currentPage.Path,
 				ParentIdentifier: km.Identifier,
 				Identifier:       cid,
+				Name:             e.Name,
 				BlobOid:          e.Oid,
 			}
 
 			continue
 		}
 
-		wd.addError(currentPage.Path+"/_page/"+string(km.Identifier)+"/_cards/"+e.Name, errors.New("wikidata/parseCardInfo: unexpected non-regular entry"))
+		st.addProblem(currentPage.Path, cardsTreePath+"/"+e.Name, Warning, UnexpectedEntryErrorKind, errors.New("wikidata/parseCardInfo: unexpected non-regular entry"))
+	}
+}
+
+// copySubtree copies the page at path, its knowledges and cards, and all of
+// its subpages from old into st. It is used for subtrees whose oid has not
+// changed since old was built and which canCopySubtree allows.
+func (st *Snapshot) copySubtree(old *Snapshot, path string) {
+	page := old.pages[path]
+	st.pages[path] = page
+	if problems, ok := old.problems[path]; ok {
+		st.problems[path] = problems
+	}
+
+	for _, kid := range page.ActualKnowledges {
+		km, ok := old.knowledges[kid]
+		if !ok || km.ParentPath != path {
+			continue
+		}
+		st.knowledges[kid] = km
+
+		for _, cid := range km.Cards {
+			if cm, ok := old.cards[cid]; ok {
+				st.cards[cid] = cm
+			}
+		}
+	}
+
+	for _, child := range page.Children {
+		if _, ok := old.pages[child]; ok {
+			st.copySubtree(old, child)
+		}
+	}
+}
+
+// canCopySubtree reports whether copying the subtree at path from old into
+// st gives the same result as parsing it again. That is not the case if
+// another page had a knowledge with the same id as one of its own, if one of
+// its cards lost its id to another card, or if a card parsed from a changed
+// subtree has taken the id of one of its cards since: which one wins may
+// have changed, and the problems have to be recorded again.
+func (st *Snapshot) canCopySubtree(old *Snapshot, path string) bool {
+	for _, p := range old.problems[path] {
+		if p.Kind == DuplicateCardErrorKind {
+			return false
+		}
+	}
+
+	page := old.pages[path]
+	for _, kid := range page.ActualKnowledges {
+		km, ok := old.knowledges[kid]
+		if !ok || km.ParentPath != path {
+			return false
+		}
+		for _, cid := range km.Cards {
+			if _, taken := st.cards[cid]; taken {
+				return false
+			}
+		}
+	}
+
+	for _, child := range page.Children {
+		if _, ok := old.pages[child]; ok && !st.canCopySubtree(old, child) {
+			return false
+		}
 	}
+	return true
 }
 
-func (wd *WikiData) refreshStateHelper(currentPath string, currentTree objid.Oid) {
+func (wd *WikiData) refreshStateHelper(st *Snapshot, old *Snapshot, currentPath string, currentTree objid.Oid) {
+	pagePath := currentPath
+	if currentPath == "" {
+		pagePath = "/"
+	}
+
+	if page, ok := old.pages[pagePath]; ok && page.TreeOid == currentTree && st.canCopySubtree(old, pagePath) {
+		st.copySubtree(old, pagePath)
+		return
+	}
+
 	tree, err := wd.repo.Tree(currentTree)
 	if err != nil {
-		wd.addError(currentPath, err)
+		st.addProblem(pagePath, pagePath, Error, UnreadableErrorKind, err)
 		return
 	}
 
 	currentPage := &Page{
-		Path:   currentPath,
-		NoInfo: true,
-	}
-
-	if currentPath == "" {
-		currentPage.Path = "/"
+		Path:    pagePath,
+		TreeOid: currentTree,
+		NoInfo:  true,
 	}
 
 	if pageTreeEntry := tree.Find("_page"); pageTreeEntry != nil {
-		wd.parsePageInfo(currentPage, pageTreeEntry)
+		wd.parsePageInfo(st, currentPage, pageTreeEntry)
 	}
 
 	for _, e := range tree.Entries {
@@ -181,37 +407,124 @@ func (wd *WikiData) refreshStateHelper(currentPath string, currentTree objid.Oid
 		currentPage.Children = append(currentPage.Children, path)
 
 		if e.Mode == filemode.Dir {
-			wd.refreshStateHelper(path, e.Oid)
+			wd.refreshStateHelper(st, old, path, e.Oid)
 			continue
 		}
 
-		wd.addError(path, errors.New("wikidata: unexpected loose file"))
+		st.addProblem(pagePath, path, Warning, LooseFileErrorKind, errors.New("wikidata: unexpected loose file"))
+	}
+
+	st.pages[currentPage.Path] = *currentPage
+}
+
+// loadCommit builds a Snapshot of the wiki at the commit coid, reusing
+// whatever is unchanged from the current Snapshot, and then publishes it.
+func (wd *WikiData) loadCommit(coid objid.Oid) error {
+	wd.refreshLock.Lock()
+	defer wd.refreshLock.Unlock()
+
+	c, err := wd.repo.Commit(coid)
+	if err != nil {
+		return err
+	}
+
+	rootTreeEntry, err := tree.Lookup(wd.repo, c.Tree, "_wiki")
+	if err != nil {
+		return err
+	}
+
+	old := wd.Snapshot()
+	if old.revision.Commit == coid {
+		return nil
+	}
+
+	st := newSnapshot(wd.repo)
+	st.revision = Revision{
+		Commit: coid,
+		Author: c.Author,
+	}
+	st.rootTree = rootTreeEntry.Oid
+	st.historical = wd.ref == ""
+
+	wd.refreshStateHelper(st, old, "", rootTreeEntry.Oid)
+	wd.refreshHistory(st, old)
+
+	wd.refreshKnowledgeCache(st)
+	wd.refreshLinks(st)
+	wd.refreshSearch(st, old)
+	wd.saveCache()
+
+	wd.lock.Lock()
+	wd.snapshot = st
+	wd.lock.Unlock()
+
+	for _, f := range wd.refreshHooks {
+		f(old, st)
 	}
+	return nil
+}
 
-	wd.pages[currentPage.Path] = *currentPage
+// OnRefresh registers f to be called with the previous and the new Snapshot
+// each time a new Snapshot is published. Calls are made one at a time, in
+// the order the Snapshots were published.
+func (wd *WikiData) OnRefresh(f func(old *Snapshot, new *Snapshot)) {
+	wd.refreshLock.Lock()
+	defer wd.refreshLock.Unlock()
+	wd.refreshHooks = append(wd.refreshHooks, f)
 }
 
 func (wd *WikiData) RefreshState() {
-	rootTreeEntry, err := wd.repo.LookupEntryByPath(wd.ref, "_wiki")
+	if wd.ref == "" {
+		return
+	}
+
+	coid, err := wd.repo.RefOid(wd.ref)
 	if err != nil {
 		wd.addError("/", err)
 		return
 	}
-	wd.refreshStateHelper("", rootTreeEntry.Oid)
+
+	err = wd.loadCommit(coid)
+	if err != nil {
+		wd.addError("/", err)
+	}
+}
+
+// Ref returns the branch this WikiData follows.
+func (wd *WikiData) Ref() string {
+	return wd.ref
+}
+
+// Snapshot returns the most recently published state of the wiki.
+func (wd *WikiData) Snapshot() *Snapshot {
+	wd.lock.RLock()
+	defer wd.lock.RUnlock()
+	return wd.snapshot
+}
+
+// Revision returns the commit s was built from.
+func (s *Snapshot) Revision() Revision {
+	return s.revision
+}
+
+// Historical reports whether s was made by SnapshotAt rather than by
+// following a branch.
+func (s *Snapshot) Historical() bool {
+	return s.historical
 }
 
-func (wd *WikiData) LookupPage(path string) (Page, bool) {
-	page, ok := wd.pages[path]
+func (s *Snapshot) LookupPage(path string) (Page, bool) {
+	page, ok := s.pages[path]
 	return page, ok
 }
 
-func (wd *WikiData) LookupKnowledgeMeta(kid KnowledgeId) (KnowledgeMeta, bool) {
-	k, ok := wd.knowledges[kid]
+func (s *Snapshot) LookupKnowledgeMeta(kid KnowledgeId) (KnowledgeMeta, bool) {
+	k, ok := s.knowledges[kid]
 	return k, ok
 }
 
-func (wd *WikiData) LookupKnowledge(kid KnowledgeId) (KnowledgeMeta, Knowledge) {
-	k, ok := wd.knowledges[kid]
+func (s *Snapshot) LookupKnowledge(kid KnowledgeId) (KnowledgeMeta, Knowledge) {
+	k, ok := s.knowledges[kid]
 	if !ok {
 		return KnowledgeMeta{
 			ParentPath: "/_error",
@@ -219,14 +532,89 @@ func (wd *WikiData) LookupKnowledge(kid KnowledgeId) (KnowledgeMeta, Knowledge)
 		}, NewErrorKnowledge("kid \"" + string(kid) + "\" not found")
 	}
 
-	return k, wd.parseKnowledge(k)
+	return k, s.parseKnowledge(k)
+}
+
+// NewKnowledgeId returns a random knowledge id which is not in use.
+func (s *Snapshot) NewKnowledgeId() (KnowledgeId, error) {
+	for {
+		var b [6]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return "", err
+		}
+		kid := KnowledgeId(hex.EncodeToString(b[:]))
+		if _, ok := s.knowledges[kid]; !ok {
+			return kid, nil
+		}
+	}
+}
+
+// ReadKnowledgeMedia returns the contents of the file name in the _media
+// tree of the knowledge kid.
+func (s *Snapshot) ReadKnowledgeMedia(kid KnowledgeId, name string) ([]byte, error) {
+	km, ok := s.knowledges[kid]
+	if !ok {
+		return nil, errors.New("wikidata: knowledge " + strconv.Quote(string(kid)) + " not found")
+	}
+	return s.repo.ReadBlobFromTreeOid(km.TreeOid, "_media/"+name)
+}
+
+// ValidMediaName reports whether name may be used for a file in the _media
+// tree of a knowledge.
+func ValidMediaName(name string) bool {
+	return name != "" && name[0] != '_' && name[0] != '.' && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// MediaFile is a file in the _media tree of a knowledge.
+type MediaFile struct {
+	Name string
+	Oid  objid.Oid
+}
+
+// LookupKnowledgeMedia returns the oid of the blob of the file name in the
+// _media tree of the knowledge kid.
+func (s *Snapshot) LookupKnowledgeMedia(kid KnowledgeId, name string) (objid.Oid, bool) {
+	km, ok := s.knowledges[kid]
+	if !ok || !ValidMediaName(name) {
+		return objid.Oid{}, false
+	}
+	e, err := tree.Lookup(s.repo, km.TreeOid, "_media/"+name)
+	if err != nil || (e.Mode != filemode.Regular && e.Mode != filemode.Executable) {
+		return objid.Oid{}, false
+	}
+	return e.Oid, true
+}
+
+// KnowledgeMedia lists the files in the _media tree of the knowledge kid, in
+// order of name.
+func (s *Snapshot) KnowledgeMedia(kid KnowledgeId) []MediaFile {
+	km, ok := s.knowledges[kid]
+	if !ok {
+		return nil
+	}
+	e, err := tree.Lookup(s.repo, km.TreeOid, "_media")
+	if err != nil || e.Mode != filemode.Dir {
+		return nil
+	}
+	t, err := s.repo.Tree(e.Oid)
+	if err != nil {
+		return nil
+	}
+
+	var files []MediaFile
+	for _, e := range t.Entries {
+		if (e.Mode == filemode.Regular || e.Mode == filemode.Executable) && ValidMediaName(e.Name) {
+			files = append(files, MediaFile{Name: e.Name, Oid: e.Oid})
+		}
+	}
+	return files
 }
 
-func (wd *WikiData) LookupCardMeta(cid CardId) (CardMeta, bool) {
-	c, ok := wd.cards[cid]
+func (s *Snapshot) LookupCardMeta(cid CardId) (CardMeta, bool) {
+	c, ok := s.cards[cid]
 	return c, ok
 }
 
-func (wd *WikiData) LookupCard(cid CardId) (CardMeta, Card) {
-	return wd.parseCard(cid)
+func (s *Snapshot) LookupCard(cid CardId) (CardMeta, Card) {
+	return s.parseCard(cid)
 }
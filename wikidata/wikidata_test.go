@@ -0,0 +1,527 @@
+package wikidata
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/MerryMage/libellus/objstore"
+	"github.com/MerryMage/libellus/objstore/commit"
+	"github.com/MerryMage/libellus/objstore/objid"
+	"github.com/MerryMage/libellus/objstore/objtype"
+)
+
+var testSignature = commit.Signature{Name: "Test", Email: "test@example.com", Timestamp: 1500000000, Timezone: "+0000"}
+
+// tempRepo creates a repository whose master branch has a single empty
+// commit.
+func tempRepo(t *testing.T) (string, *objstore.Repository) {
+	dir, err := ioutil.TempDir("", "wikidata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(dir, "refs", "heads"), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := objstore.NewRepository(dir)
+	treeoid, err := repo.Store(objtype.Tree, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	commit.Commit{Author: testSignature, Committer: testSignature, Message: "Initial\n", Tree: treeoid}.Write(&b)
+	coid, err := repo.Store(objtype.Commit, b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "refs", "heads", "master"), []byte(coid.String()+"\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, repo
+}
+
+// commitFiles commits files, keyed by path, on top of master.
+func commitFiles(t *testing.T, repo *objstore.Repository, files map[string]string) objid.Oid {
+	return commitChanges(t, repo, files, nil)
+}
+
+// commitChanges commits files, keyed by path, on top of master and removes
+// the files and trees at the deleted paths.
+func commitChanges(t *testing.T, repo *objstore.Repository, files map[string]string, deleted []string) objid.Oid {
+	trans, err := repo.StartTransaction("master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range deleted {
+		if err := trans.DeleteTree(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, contents := range files {
+		if err := trans.AddOrReplace(path, []byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = trans.Store(commit.Commit{Author: testSignature, Committer: testSignature, Message: "Test\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	coid, err := repo.RefOid("master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return coid
+}
+
+type problemInfo struct {
+	Path     string
+	Severity Severity
+	Kind     ErrorKind
+	Err      string
+}
+
+// checkIncremental fails t unless the current Snapshot of wd, which was
+// refreshed commit by commit, is the same as one built from scratch.
+func checkIncremental(t *testing.T, wd *WikiData) {
+	got := wd.Snapshot()
+	want, err := SnapshotAt(wd.repo, got.Revision().Commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problems := func(s *Snapshot) []problemInfo {
+		var infos []problemInfo
+		for _, p := range s.Problems() {
+			infos = append(infos, problemInfo{p.Path, p.Severity, p.Kind, p.Err.Error()})
+		}
+		return infos
+	}
+
+	if !reflect.DeepEqual(got.pages, want.pages) {
+		t.Errorf("pages = %#v, want %#v", got.pages, want.pages)
+	}
+	if !reflect.DeepEqual(got.knowledges, want.knowledges) {
+		t.Errorf("knowledges = %#v, want %#v", got.knowledges, want.knowledges)
+	}
+	if !reflect.DeepEqual(got.cards, want.cards) {
+		t.Errorf("cards = %#v, want %#v", got.cards, want.cards)
+	}
+	if !reflect.DeepEqual(got.backlinks, want.backlinks) {
+		t.Errorf("backlinks = %#v, want %#v", got.backlinks, want.backlinks)
+	}
+	if got, want := problems(got), problems(want); !reflect.DeepEqual(got, want) {
+		t.Errorf("problems = %#v, want %#v", got, want)
+	}
+}
+
+func TestPageProblems(t *testing.T) {
+	dir, repo := tempRepo(t)
+	defer os.RemoveAll(dir)
+
+	coid := commitFiles(t, repo, map[string]string{
+		"_wiki/_page/_info":           `{"Title": `,
+		"_wiki/_page/loose":           "x",
+		"_wiki/_page/k1/_info":        `{"Type": "markdown"`,
+		"_wiki/_page/k1/_data.md":     "text",
+		"_wiki/foo/_page/_info":       `{"Title": "Foo"}`,
+		"_wiki/foo/_page/k2/_info":    `{"Type": "markdown"}`,
+		"_wiki/foo/_page/k2/_data.md": "text",
+	})
+	snap, err := SnapshotAt(repo, coid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []problemKey
+	for _, p := range snap.Problems() {
+		got = append(got, problemKey{p.Path, p.Kind})
+	}
+	want := []problemKey{
+		{"/_page/_info", BadInfoErrorKind},
+		{"/_page/k1/_info", BadInfoErrorKind},
+		{"/_page/loose", LooseFileErrorKind},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("problems = %#v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("problems = %#v", got)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir, repo := tempRepo(t)
+	defer os.RemoveAll(dir)
+	privateDir := filepath.Join(dir, "private")
+
+	first := commitFiles(t, repo, map[string]string{
+		"_wiki/_page/_info":     `{"Title": "Root"}`,
+		"_wiki/foo/_page/_info": `{"Title": "Foo"}`,
+	})
+	second := commitFiles(t, repo, map[string]string{
+		"_wiki/foo/_page/_info": `{"Title": "Foo 2"}`,
+	})
+
+	check := func(wd *WikiData, modified objid.Oid) {
+		root, _ := wd.Snapshot().LookupPage("/")
+		if root.History.Created.Commit != first || root.History.LastModified.Commit != first {
+			t.Errorf("root.History = %#v", root.History)
+		}
+		foo, _ := wd.Snapshot().LookupPage("/foo")
+		if foo.History.Created.Commit != first || foo.History.LastModified.Commit != modified {
+			t.Errorf("foo.History = %#v", foo.History)
+		}
+	}
+
+	wd := New(repo, "master", privateDir)
+	check(wd, second)
+
+	// A restart walks back only to the history persisted before the
+	// server went down.
+	offline := objstore.NewRepository(dir)
+	third := commitFiles(t, offline, map[string]string{
+		"_wiki/foo/_page/_info": `{"Title": "Foo 3"}`,
+	})
+	if kc, _ := loadKnowledgeCache(privateDir); kc.history == nil || kc.history.Commit != second {
+		t.Fatalf("kc.history = %#v", kc.history)
+	}
+	check(New(offline, "master", privateDir), third)
+}
+
+func TestPersistedSearch(t *testing.T) {
+	dir, repo := tempRepo(t)
+	defer os.RemoveAll(dir)
+	privateDir := filepath.Join(dir, "private")
+
+	commitFiles(t, repo, map[string]string{
+		"_wiki/_page/_info":       `{"Title": "Root"}`,
+		"_wiki/_page/k1/_info":    `{"Type": "markdown"}`,
+		"_wiki/_page/k1/_data.md": "Zebrafish are fish.",
+	})
+	wd := New(repo, "master", privateDir)
+
+	kc, err := loadKnowledgeCache(privateDir)
+	if err != nil || kc.search == nil || kc.searchTree != wd.Snapshot().rootTree {
+		t.Fatalf("kc = %#v, err = %v", kc, err)
+	}
+
+	wd = New(repo, "master", privateDir)
+	if results := wd.Snapshot().Search("zebrafish", 0); len(results) != 1 || results[0].Knowledge != "k1" {
+		t.Errorf("results = %#v", results)
+	}
+}
+
+func TestClozeCardProblem(t *testing.T) {
+	dir, repo := tempRepo(t)
+	defer os.RemoveAll(dir)
+
+	coid := commitFiles(t, repo, map[string]string{
+		"_wiki/_page/_info":                  `{"Title": "Root"}`,
+		"_wiki/_page/k1/_info":               `{"Type": "markdown"}`,
+		"_wiki/_page/k1/_data.md":            "{{c1::Paris}} is in France.",
+		"_wiki/foo/_page/_info":              `{"Title": "Foo"}`,
+		"_wiki/foo/_page/k2/_info":           `{"Type": "markdown"}`,
+		"_wiki/foo/_page/k2/_data.md":        "text",
+		"_wiki/foo/_page/k2/_cards/k1.cloze": "Front\n---\nBack\n",
+	})
+	wd := New(repo, "master", filepath.Join(dir, "private"))
+
+	check := func(problems []RefreshStateErrorInfo) {
+		if len(problems) != 1 || problems[0].Path != "/_page/k1" || problems[0].Kind != DuplicateCardErrorKind {
+			t.Errorf("problems = %#v", problems)
+		}
+	}
+	check(wd.Snapshot().Problems())
+	if cm, ok := wd.Snapshot().LookupCardMeta("k1.cloze"); !ok || cm.Virtual {
+		t.Errorf("cm = %#v", cm)
+	}
+
+	problems, err := wd.Validate(coid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(problems)
+
+	// The problem is not carried over along with the unchanged page.
+	commitFiles(t, repo, map[string]string{
+		"_wiki/foo/_page/k2/_data.md": "more text",
+	})
+	check(wd.Snapshot().Problems())
+}
+
+func TestDuplicateCardInUnchangedPage(t *testing.T) {
+	dir, repo := tempRepo(t)
+	defer os.RemoveAll(dir)
+
+	commitFiles(t, repo, map[string]string{
+		"_wiki/b/_page/_info":          `{"Title": "B"}`,
+		"_wiki/b/_page/k2/_info":       `{"Type": "markdown"}`,
+		"_wiki/b/_page/k2/_data.md":    "text",
+		"_wiki/b/_page/k2/_cards/c1":   "Front\n---\nBack\n",
+		"_wiki/b/c/_page/_info":        `{"Title": "C"}`,
+		"_wiki/b/c/_page/k3/_info":     `{"Type": "markdown"}`,
+		"_wiki/b/c/_page/k3/_data.md":  "text",
+		"_wiki/b/c/_page/k3/_cards/c2": "Front\n---\nBack\n",
+		"_wiki/a/_page/_info":          `{"Title": "A"}`,
+		"_wiki/a/_page/k1/_info":       `{"Type": "markdown"}`,
+		"_wiki/a/_page/k1/_data.md":    "text",
+	})
+	wd := New(repo, "master", filepath.Join(dir, "private"))
+
+	// /a is parsed before the unchanged /b, and takes c1 from it.
+	commitFiles(t, repo, map[string]string{
+		"_wiki/a/_page/k1/_cards/c1": "Front\n---\nBack\n",
+	})
+	checkIncremental(t, wd)
+	snap := wd.Snapshot()
+
+	if cm, ok := snap.LookupCardMeta("c1"); !ok || cm.ParentParentPath != "/a" {
+		t.Errorf("cm = %#v", cm)
+	}
+	if km, ok := snap.LookupKnowledgeMeta("k2"); !ok || len(km.Cards) != 0 {
+		t.Errorf("km = %#v", km)
+	}
+	if cm, ok := snap.LookupCardMeta("c2"); !ok || cm.ParentParentPath != "/b/c" {
+		t.Errorf("cm = %#v", cm)
+	}
+	problems := snap.Problems()
+	if len(problems) != 1 || problems[0].Path != "/b/_page/k2/_cards/c1" || problems[0].Kind != DuplicateCardErrorKind {
+		t.Errorf("problems = %#v", problems)
+	}
+}
+
+func TestDuplicateCardResolved(t *testing.T) {
+	dir, repo := tempRepo(t)
+	defer os.RemoveAll(dir)
+
+	commitFiles(t, repo, map[string]string{
+		"_wiki/a/_page/_info":        `{"Title": "A"}`,
+		"_wiki/a/_page/k1/_info":     `{"Type": "markdown"}`,
+		"_wiki/a/_page/k1/_data.md":  "text",
+		"_wiki/a/_page/k1/_cards/c1": "Front\n---\nBack\n",
+		"_wiki/b/_page/_info":        `{"Title": "B"}`,
+		"_wiki/b/_page/k2/_info":     `{"Type": "markdown"}`,
+		"_wiki/b/_page/k2/_data.md":  "text",
+		"_wiki/b/_page/k2/_cards/c1": "Front\n---\nBack\n",
+	})
+	wd := New(repo, "master", filepath.Join(dir, "private"))
+	checkIncremental(t, wd)
+	if len(wd.Snapshot().Problems()) != 1 {
+		t.Errorf("problems = %#v", wd.Snapshot().Problems())
+	}
+
+	// /b is unchanged, but now gets c1.
+	commitChanges(t, repo, map[string]string{
+		"_wiki/a/_page/k1/_data.md": "more text",
+	}, []string{"_wiki/a/_page/k1/_cards/c1"})
+	checkIncremental(t, wd)
+	if cm, ok := wd.Snapshot().LookupCardMeta("c1"); !ok || cm.ParentParentPath != "/b" {
+		t.Errorf("cm = %#v", cm)
+	}
+	if problems := wd.Snapshot().Problems(); len(problems) != 0 {
+		t.Errorf("problems = %#v", problems)
+	}
+}
+
+func TestIncrementalRefresh(t *testing.T) {
+	dir, repo := tempRepo(t)
+	defer os.RemoveAll(dir)
+	wd := New(repo, "master", filepath.Join(dir, "private"))
+
+	const card = "Front\n---\nBack\n"
+	steps := []struct {
+		name       string
+		files      map[string]string
+		deleted    []string
+		pages      []string
+		knowledges map[KnowledgeId]string
+		cards      map[CardId]string
+	}{
+		{
+			name: "initial",
+			files: map[string]string{
+				"_wiki/_page/_info":             `{"Title": "Root"}`,
+				"_wiki/a/_page/_info":           `{"Title": "A"}`,
+				"_wiki/a/_page/k1/_info":        `{"Type": "markdown"}`,
+				"_wiki/a/_page/k1/_data.md":     "[[/b]]",
+				"_wiki/a/_page/k1/_cards/c1":    card,
+				"_wiki/a/sub/_page/_info":       `{"Title": "Sub"}`,
+				"_wiki/a/sub/_page/k2/_info":    `{"Type": "markdown"}`,
+				"_wiki/a/sub/_page/k2/_data.md": "text",
+				"_wiki/b/_page/_info":           `{"Title": "B"}`,
+				"_wiki/b/_page/k3/_info":        `{"Type": "markdown"}`,
+				"_wiki/b/_page/k3/_data.md":     "text",
+				"_wiki/b/_page/k3/_cards/c3":    card,
+			},
+			pages:      []string{"/", "/a", "/a/sub", "/b"},
+			knowledges: map[KnowledgeId]string{"k1": "/a", "k2": "/a/sub", "k3": "/b"},
+			cards:      map[CardId]string{"c1": "/a", "c3": "/b"},
+		},
+		{
+			name:       "unrelated edit keeps /a",
+			files:      map[string]string{"_wiki/b/_page/k3/_data.md": "more text"},
+			pages:      []string{"/", "/a", "/a/sub", "/b"},
+			knowledges: map[KnowledgeId]string{"k1": "/a", "k2": "/a/sub", "k3": "/b"},
+			cards:      map[CardId]string{"c1": "/a", "c3": "/b"},
+		},
+		{
+			name:       "delete card",
+			deleted:    []string{"_wiki/b/_page/k3/_cards/c3"},
+			pages:      []string{"/", "/a", "/a/sub", "/b"},
+			knowledges: map[KnowledgeId]string{"k1": "/a", "k2": "/a/sub", "k3": "/b"},
+			cards:      map[CardId]string{"c1": "/a"},
+		},
+		{
+			name:       "delete knowledge",
+			deleted:    []string{"_wiki/a/sub/_page/k2"},
+			pages:      []string{"/", "/a", "/a/sub", "/b"},
+			knowledges: map[KnowledgeId]string{"k1": "/a", "k3": "/b"},
+			cards:      map[CardId]string{"c1": "/a"},
+		},
+		{
+			name: "move knowledge",
+			files: map[string]string{
+				"_wiki/_page/k3/_info":    `{"Type": "markdown"}`,
+				"_wiki/_page/k3/_data.md": "text",
+			},
+			deleted:    []string{"_wiki/b/_page/k3"},
+			pages:      []string{"/", "/a", "/a/sub", "/b"},
+			knowledges: map[KnowledgeId]string{"k1": "/a", "k3": "/"},
+			cards:      map[CardId]string{"c1": "/a"},
+		},
+		{
+			name: "knowledge id on two pages",
+			files: map[string]string{
+				"_wiki/c/_page/_info":       `{"Title": "C"}`,
+				"_wiki/c/_page/k1/_info":    `{"Type": "markdown"}`,
+				"_wiki/c/_page/k1/_data.md": "text",
+			},
+			pages:      []string{"/", "/a", "/a/sub", "/b", "/c"},
+			knowledges: map[KnowledgeId]string{"k1": "/c", "k3": "/"},
+			cards:      map[CardId]string{"c1": "/a"},
+		},
+		{
+			name:       "delete page",
+			deleted:    []string{"_wiki/c"},
+			pages:      []string{"/", "/a", "/a/sub", "/b"},
+			knowledges: map[KnowledgeId]string{"k1": "/a", "k3": "/"},
+			cards:      map[CardId]string{"c1": "/a"},
+		},
+		{
+			name:       "delete page with subpages",
+			deleted:    []string{"_wiki/a"},
+			pages:      []string{"/", "/b"},
+			knowledges: map[KnowledgeId]string{"k3": "/"},
+			cards:      map[CardId]string{},
+		},
+	}
+
+	for _, step := range steps {
+		commitChanges(t, repo, step.files, step.deleted)
+		checkIncremental(t, wd)
+		snap := wd.Snapshot()
+
+		var pages []string
+		for path := range snap.pages {
+			pages = append(pages, path)
+		}
+		sort.Strings(pages)
+		if !reflect.DeepEqual(pages, step.pages) {
+			t.Errorf("%s: pages = %#v", step.name, pages)
+		}
+
+		knowledges := make(map[KnowledgeId]string)
+		for kid, km := range snap.knowledges {
+			knowledges[kid] = km.ParentPath
+		}
+		if !reflect.DeepEqual(knowledges, step.knowledges) {
+			t.Errorf("%s: knowledges = %#v", step.name, knowledges)
+		}
+
+		cards := make(map[CardId]string)
+		for cid, cm := range snap.cards {
+			cards[cid] = cm.ParentParentPath
+		}
+		if !reflect.DeepEqual(cards, step.cards) {
+			t.Errorf("%s: cards = %#v", step.name, cards)
+		}
+	}
+}
+
+// Run with -race: readers must never see a Snapshot which is being built.
+func TestConcurrentSnapshots(t *testing.T) {
+	dir, repo := tempRepo(t)
+	defer os.RemoveAll(dir)
+	commitFiles(t, repo, map[string]string{
+		"_wiki/_page/_info":   `{"Title": "Root"}`,
+		"_wiki/b/_page/_info": `{"Title": "B"}`,
+	})
+	wd := New(repo, "master", filepath.Join(dir, "private"))
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// Every version commits a matching title, knowledge and link,
+				// so a mix of two versions shows up as a mismatch.
+				snap := wd.Snapshot()
+				page, ok := snap.LookupPage("/a")
+				if !ok {
+					continue
+				}
+				_, k := snap.LookupKnowledge("k1")
+				mk, ok := k.(MarkdownKnowledge)
+				if !ok {
+					t.Errorf("k1 = %#v", k)
+					return
+				}
+				md := mk.Markdown
+				n, _ := strconv.Atoi(page.Title)
+				linked := len(snap.Backlinks("/b")) == 1
+				if md != version(n) || linked != (n%2 == 1) {
+					t.Errorf("Title = %q, Markdown = %q, Backlinks = %v", page.Title, md, snap.Backlinks("/b"))
+					return
+				}
+			}
+		}()
+	}
+
+	for n := 0; n < 10; n++ {
+		commitFiles(t, repo, map[string]string{
+			"_wiki/a/_page/_info":       fmt.Sprintf(`{"Title": "%d"}`, n),
+			"_wiki/a/_page/k1/_info":    `{"Type": "markdown"}`,
+			"_wiki/a/_page/k1/_data.md": version(n),
+		})
+	}
+	close(done)
+	wg.Wait()
+}
+
+// version is the markdown of k1 in TestConcurrentSnapshots at version n.
+func version(n int) string {
+	if n%2 == 1 {
+		return fmt.Sprintf("%d [[/b]]", n)
+	}
+	return fmt.Sprintf("%d", n)
+}